@@ -64,13 +64,15 @@ func (s *Server) Run(c *cli.Context) error {
 	// Account hierarchy routes
 	accountRoute := routes.NewAccountRoute(
 		&routes.NewAccountProps{
-			ConfigService: configService,
+			ConfigService:      configService,
+			AccountPermissions: accountPermissions,
 		},
 	)
 
 	// Register routes
 	authRoute.Register(container)
 	accountRoute.RegisterAccountRoute("/accounts/{accountId}", false, container)
+	accountRoute.RegisterGlobalRoute("/global/config", container)
 
 	// Answer health checks immediately
 	container.Filter(func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
@@ -83,9 +85,9 @@ func (s *Server) Run(c *cli.Context) error {
 
 	cors := restful.CrossOriginResourceSharing{
 		// ExposeHeaders:  []string{"X-My-Header"},
-		ExposeHeaders:  []string{"Range", "Content-Length", "Content-Range", "ETag", "X-Content-Hash"},
-		AllowedHeaders: []string{"Content-Type", "Accept", "Accept-Language", "Authorization", "Referer", "User-Agent", "Origin", "Range", "If-None-Match"},
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		ExposeHeaders:  []string{"Range", "Content-Length", "Content-Range", "ETag", "X-Content-Hash", "X-Config-Version-Hash"},
+		AllowedHeaders: []string{"Content-Type", "Accept", "Accept-Language", "Authorization", "Referer", "User-Agent", "Origin", "Range", "If-None-Match", "If-Match", "X-Config-Commit-Message", "X-Config-Commit-Trailer"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedDomainFunc: func(origin string) bool {
 			log.Printf("checking domain: %s", origin)
 
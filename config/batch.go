@@ -0,0 +1,137 @@
+package config
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+// A single record write within a batch
+type ConfigBatchWrite struct {
+	RecordMetadata ConfigRecordMetadata `json:"record_metadata"`
+	// Defaults to replace_all, tombstone deletes the record
+	Mode   ValueSettingMode `json:"mode"`
+	Values *util.Data       `json:"values"`
+	// Merge strategies of a deep_merge, on top of those declared by the collection's schema
+	MergeStrategies ConfigMergeStrategies `json:"merge_strategies,omitempty"`
+	// Fail the whole batch unless the record is still at this version, "*" matches any existing version
+	ExpectedVersionHash util.ConfigVersionHash `json:"expected_version_hash,omitempty"`
+}
+
+type ConfigBatchOptions struct {
+	// Commit to the named branch instead of head
+	RefName string `json:"ref_name"`
+	// Stored as the note of every version written by the batch
+	Note     string               `json:"note"`
+	Trailers ConfigCommitTrailers `json:"trailers"`
+}
+
+type ConfigBatchResult struct {
+	// The last node written by the batch, the ref points here once it commits
+	NodeMetadata *ConfigNodeMetadata `json:"node_metadata"`
+	// The version the batch was written on top of
+	ParentRef *ConfigVersionRef      `json:"parent_ref"`
+	Records   []ConfigRecordMetadata `json:"records"`
+}
+
+// CommitBatch writes every record as a chain of nodes sharing a batch id, then moves
+// the ref once to the last of them, all in a single transaction. The first write locks
+// the ref until the transaction ends, so readers either see the ref before the batch or
+// after all of it, and any failure discards every write. The log shows the chain as a
+// single entry.
+func (s *ConfigService) CommitBatch(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, writes []ConfigBatchWrite, options *ConfigBatchOptions) (*ConfigBatchResult, error) {
+	if len(writes) == 0 {
+		return nil, NewMissingRequiredParameter("writes")
+	}
+
+	if options == nil {
+		options = &ConfigBatchOptions{}
+	}
+
+	// A batch must not write the same record twice, the later write would silently win
+	seen := map[string]bool{}
+	for i, write := range writes {
+		if write.Values == nil && write.Mode != ValueSettingModeTombstone {
+			return nil, NewConfigSettingError(fmt.Errorf("write %d has no values", i))
+		}
+		if write.RecordMetadata.CollectionKey == "" {
+			return nil, NewConfigSettingError(fmt.Errorf("write %d has no collection key", i))
+		}
+		key := mergeRecordKey(recordMetadataKind(&write.RecordMetadata), write.RecordMetadata.CollectionKey, write.RecordMetadata.ItemKey)
+		if seen[key] {
+			return nil, NewConfigSettingError(fmt.Errorf("record %s is written more than once", key))
+		}
+		seen[key] = true
+	}
+
+	res := &ConfigBatchResult{}
+	batchId := util.NewUUID()
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		var parentRef *ConfigVersionRef
+
+		for _, write := range writes {
+			kind := recordMetadataKind(&write.RecordMetadata)
+			recordMetadata := write.RecordMetadata
+			recordMetadata.RecordKind = &kind
+
+			mode := write.Mode
+			if mode == "" {
+				mode = ValueSettingModeReplace
+			}
+
+			setOptions := &SetRecordValuesOptions{
+				RefName:             options.RefName,
+				Note:                options.Note,
+				Trailers:            options.Trailers,
+				ExpectedVersionHash: write.ExpectedVersionHash,
+				MergeStrategies:     write.MergeStrategies,
+				DeferRefUpdate:      true,
+				ParentVersionRef:    parentRef,
+				BatchId:             batchId,
+			}
+
+			values := write.Values
+			if values == nil {
+				values = &util.Data{}
+			}
+
+			nodeMetadata, err := s.SetRecordValuesWithOptions(ctx, tx, scope, accountId, userId, kind, &recordMetadata, mode, values, setOptions)
+			if err != nil {
+				return err
+			}
+
+			if res.ParentRef == nil {
+				res.ParentRef = nodeMetadata.ParentRef
+			}
+			res.NodeMetadata = nodeMetadata
+			res.Records = append(res.Records, recordMetadata)
+			parentRef = &nodeMetadata.VersionRef
+		}
+
+		refKind, refName := ConfigReferenceKindHead, ""
+		if options.RefName != "" {
+			refKind, refName = ConfigReferenceKindBranch, options.RefName
+		}
+
+		return s.refService.SetNamedConfigReference(ctx, tx, scope, accountId, userId, refKind, refName, parentRef)
+	})
+	if err != nil {
+		s.logger.Printf("CommitBatch: Error writing batch of %d records: %v\n", len(writes), err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Records with an item key are documents unless the kind is given
+func recordMetadataKind(recordMetadata *ConfigRecordMetadata) ConfigRecordKind {
+	if recordMetadata.RecordKind != nil {
+		return *recordMetadata.RecordKind
+	} else if recordMetadata.ItemKey != nil {
+		return ConfigRecordKindDocument
+	}
+	return ConfigRecordKindKeyed
+}
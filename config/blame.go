@@ -0,0 +1,160 @@
+package config
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+// The version that last changed one field of a record
+type ConfigBlameEntry struct {
+	// JSON pointer of the field in record_contents
+	Pointer string      `json:"pointer"`
+	Value   interface{} `json:"value"`
+
+	VersionRef  ConfigVersionRef     `json:"version_ref"`
+	CreatedBy   util.UserId          `json:"created_by"`
+	CommittedAt *time.Time           `json:"committed_at"`
+	Note        *string              `json:"note"`
+	Trailers    ConfigCommitTrailers `json:"trailers,omitempty"`
+}
+
+type ConfigBlame struct {
+	ToVersion      *ConfigVersionRef     `json:"to_version"`
+	RecordMetadata *ConfigRecordMetadata `json:"record_metadata"`
+	Fields         []*ConfigBlameEntry   `json:"fields"`
+}
+
+// Blame attributes each field (JSON pointer to a value that isn't a non-empty object or
+// array) of the record matching the query at toVersion (head when nil) to the version
+// that last changed it. History before a delete or move of the record is not followed,
+// the fields are attributed to the version that recreated or moved it. Returns nil if the
+// record doesn't exist.
+func (s *ConfigService) Blame(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, toVersion *ConfigVersionRef, recordQuery *ConfigRecordQuery) (*ConfigBlame, error) {
+	version, err := s.GetLatestRecordWithHistory(ctx, tx, scope, accountId, userId, nil, toVersion, recordQuery)
+	if err != nil {
+		return nil, err
+	} else if version == nil || version.RecordMetadata == nil {
+		return nil, nil
+	}
+
+	history := recordOnlyHistory(version.RecordMetadata, version.RecordHistory)
+
+	// The history of a collection holds all of its items, the patches have to be
+	// computed again between the versions of this record
+	AnnotateHistory(&history)
+
+	current := map[string]interface{}{}
+	if version.RecordContents != nil {
+		flattenPointers("", map[string]interface{}(*version.RecordContents), current)
+	}
+
+	blame := &ConfigBlame{
+		ToVersion:      version.ToVersion,
+		RecordMetadata: version.RecordMetadata,
+		Fields:         []*ConfigBlameEntry{},
+	}
+
+	for pointer, value := range current {
+		entry := &ConfigBlameEntry{
+			Pointer: pointer,
+			Value:   value,
+		}
+
+		// Newest first, the first version whose patch touches the field last changed it
+		for i, historyEntry := range history {
+			if historyEntry.NodeMetadata == nil {
+				continue
+			}
+			if i < len(history)-1 && !patchTouchesPointer(historyEntry, pointer) {
+				continue
+			}
+
+			entry.VersionRef = historyEntry.NodeMetadata.VersionRef
+			entry.CreatedBy = historyEntry.NodeMetadata.VersionRef.CreatedBy
+			entry.CommittedAt = historyEntry.NodeMetadata.CommittedAt
+			entry.Note = historyEntry.NodeMetadata.VersionRef.Note
+			entry.Trailers = historyEntry.NodeMetadata.VersionRef.Trailers
+			break
+		}
+
+		blame.Fields = append(blame.Fields, entry)
+	}
+
+	sort.Slice(blame.Fields, func(i, j int) bool {
+		return blame.Fields[i].Pointer < blame.Fields[j].Pointer
+	})
+
+	return blame, nil
+}
+
+// Returns the history entries of the record, newest first, up to the version that
+// created, recreated or moved it
+func recordOnlyHistory(recordMetadata *ConfigRecordMetadata, entries []*ConfigDiffVersionHistoryEntry) []*ConfigDiffVersionHistoryEntry {
+	history := []*ConfigDiffVersionHistoryEntry{}
+
+	for _, entry := range entries {
+		if entry == nil || entry.RecordCollectionKey == nil || *entry.RecordCollectionKey != recordMetadata.CollectionKey {
+			continue
+		}
+		if (entry.RecordItemKey == nil) != (recordMetadata.ItemKey == nil) || (entry.RecordItemKey != nil && *entry.RecordItemKey != *recordMetadata.ItemKey) {
+			continue
+		}
+		if entry.NodeMetadata != nil && entry.NodeMetadata.NodeKind == ConfigNodeKindTombstone {
+			break
+		}
+
+		history = append(history, entry)
+
+		if entry.ConfigRecordMetadata != nil && entry.ConfigRecordMetadata.MovedFrom != nil {
+			break
+		}
+	}
+
+	return history
+}
+
+func patchTouchesPointer(entry *ConfigDiffVersionHistoryEntry, pointer string) bool {
+	if entry.RecordContentsPatch == nil {
+		return false
+	}
+
+	for _, op := range *entry.RecordContentsPatch {
+		// The field itself, a parent that was replaced or a child of a field that was
+		// an object or array before
+		if op.Path == pointer || strings.HasPrefix(pointer, op.Path+"/") || strings.HasPrefix(op.Path, pointer+"/") || op.Path == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Collects the JSON pointers of the leaf values, empty objects and arrays are leaves
+func flattenPointers(prefix string, value interface{}, out map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 && prefix != "" {
+			out[prefix] = v
+		}
+		for key, child := range v {
+			flattenPointers(prefix+"/"+escapeJsonPointer(key), child, out)
+		}
+	case util.Data:
+		flattenPointers(prefix, map[string]interface{}(v), out)
+	case []interface{}:
+		if len(v) == 0 {
+			out[prefix] = v
+		}
+		for i, child := range v {
+			flattenPointers(prefix+"/"+strconv.Itoa(i), child, out)
+		}
+	default:
+		out[prefix] = v
+	}
+}
@@ -0,0 +1,372 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/tmzt/config-api/util"
+	"github.com/wI2L/jsondiff"
+	"gorm.io/gorm"
+)
+
+type ConfigCherryPickRecord struct {
+	RecordMetadata ConfigRecordMetadata `json:"record_metadata"`
+	// The change introduced by the picked version, against its logical parent
+	Patch jsondiff.Patch `json:"record_diff"`
+}
+
+type ConfigCherryPickResult struct {
+	// The last node written on the target, unchanged if the change was already applied
+	NodeMetadata  *ConfigNodeMetadata      `json:"node_metadata"`
+	PickedRef     *ConfigVersionRef        `json:"picked_ref"`
+	PickedRecords []ConfigCherryPickRecord `json:"picked_records"`
+}
+
+// Returns the value at the JSON pointer, or absent
+func getJsonPointerOrAbsent(doc interface{}, path []string) interface{} {
+	value, err := getJsonPointer(doc, path)
+	if err != nil {
+		return absent
+	}
+	return value
+}
+
+// As copyJsonValue, an absent record is empty
+func cloneJsonValue(v interface{}) (interface{}, error) {
+	if v == absent {
+		return map[string]interface{}{}, nil
+	}
+	return copyJsonValue(v)
+}
+
+func joinJsonPointer(tokens []string) string {
+	path := ""
+	for _, token := range tokens {
+		path += "/" + escapeJsonPointer(token)
+	}
+	return path
+}
+
+// Replaces operations inside arrays with a single replace of the outermost array,
+// since array indexes from base do not line up with a target that has diverged
+func coarsenArrayOps(patch jsondiff.Patch, base, after interface{}) (jsondiff.Patch, error) {
+	res := jsondiff.Patch{}
+	replaced := map[string]bool{}
+
+	for _, op := range patch {
+		tokens, err := parseJsonPointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		arrayPath := ""
+		for k := 0; k < len(tokens); k++ {
+			if _, ok := getJsonPointerOrAbsent(base, tokens[:k]).([]interface{}); ok {
+				arrayPath = joinJsonPointer(tokens[:k])
+				if !replaced[arrayPath] {
+					replaced[arrayPath] = true
+					res = append(res, jsondiff.Operation{
+						Type:  jsondiff.OperationReplace,
+						Path:  arrayPath,
+						Value: getJsonPointerOrAbsent(after, tokens[:k]),
+					})
+				}
+				break
+			}
+		}
+
+		if arrayPath == "" {
+			res = append(res, op)
+		}
+	}
+
+	return res, nil
+}
+
+// Applies the patch computed from base to after on top of target. Operations on paths where
+// target differs from base are conflicts, unless resolved or already applied on target.
+func applyRecordPatch(m *threeWayMerge, patch jsondiff.Patch, base, after, target interface{}) (interface{}, error) {
+	src, err := cloneJsonValue(base)
+	if err != nil {
+		return nil, err
+	}
+	res, err := cloneJsonValue(target)
+	if err != nil {
+		return nil, err
+	}
+
+	ops, err := coarsenArrayOps(patch, base, after)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range ops {
+		if op.Type != jsondiff.OperationAdd && op.Type != jsondiff.OperationReplace && op.Type != jsondiff.OperationRemove {
+			return nil, fmt.Errorf("unsupported patch operation %s", op.Type)
+		}
+
+		tokens, err := parseJsonPointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		expected := getJsonPointerOrAbsent(src, tokens)
+		current := getJsonPointerOrAbsent(res, tokens)
+
+		var value interface{} = op.Value
+		if op.Type == jsondiff.OperationRemove {
+			value = absent
+		}
+
+		if src, err = applyPatchOperation(src, op); err != nil {
+			return nil, err
+		}
+
+		if reflect.DeepEqual(current, value) {
+			// Already applied on the target
+			continue
+		}
+
+		picked := op
+		if !reflect.DeepEqual(current, expected) {
+			resolution, ok := m.resolutions[op.Path]
+			if !ok {
+				m.conflicts = append(m.conflicts, ConfigMergeConflict{
+					RecordKind:          m.kind,
+					RecordCollectionKey: m.collectionKey,
+					RecordItemKey:       m.itemKey,
+					Path:                op.Path,
+					Base:                absentAsNil(expected),
+					Ours:                absentAsNil(current),
+					Theirs:              absentAsNil(value),
+				})
+				continue
+			}
+			if resolution.Remove {
+				if current == absent {
+					continue
+				}
+				picked.Type = jsondiff.OperationRemove
+			} else {
+				picked.Type = jsondiff.OperationReplace
+				if current == absent {
+					picked.Type = jsondiff.OperationAdd
+				}
+				picked.Value = resolution.Value
+			}
+		}
+
+		// Errors are returned before the document is modified
+		updated, err := applyPatchOperation(res, picked)
+		if err != nil {
+			m.conflicts = append(m.conflicts, ConfigMergeConflict{
+				RecordKind:          m.kind,
+				RecordCollectionKey: m.collectionKey,
+				RecordItemKey:       m.itemKey,
+				Path:                op.Path,
+				Base:                absentAsNil(expected),
+				Ours:                absentAsNil(current),
+				Theirs:              absentAsNil(value),
+			})
+			continue
+		}
+		res = updated
+	}
+
+	return res, nil
+}
+
+// A record change applied on top of a target by applyRecordChange
+type pickedRecordChange struct {
+	entry    *ConfigListEntry
+	patch    jsondiff.Patch
+	contents map[string]interface{}
+	changed  bool
+	deleted  bool
+}
+
+// Applies the change of a record from before to after on top of ours, the contents of
+// the record on the target. Paths where ours differs from before are conflicts unless
+// resolved or already applied, as for applyRecordPatch.
+func applyRecordChange(key string, before, after *ConfigListEntry, ours interface{}, resolutions map[string]ConfigMergeResolution) (*pickedRecordChange, []ConfigMergeConflict, error) {
+	if after == nil || after.RecordContents == nil {
+		// The change deleted the record, delete it on the target unless it was changed there
+		entry := before
+		m := &threeWayMerge{
+			kind:          *entry.RecordKind,
+			collectionKey: *entry.RecordCollectionKey,
+			itemKey:       entry.RecordItemKey,
+			resolutions:   resolutions,
+		}
+
+		v := m.merge("", entryContents(before), ours, absent)
+		if v == absent {
+			return &pickedRecordChange{entry: entry, changed: ours != absent, deleted: true}, m.conflicts, nil
+		}
+
+		contents, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, nil, NewConfigSettingError(fmt.Errorf("cannot apply deletion of record %s", key))
+		}
+		return &pickedRecordChange{entry: entry, contents: contents, changed: !reflect.DeepEqual(v, ours)}, m.conflicts, nil
+	}
+
+	// Same comparison AnnotateHistory uses for record history
+	startingValues := &util.Data{}
+	if before != nil && before.RecordContents != nil {
+		startingValues = before.RecordContents
+	}
+	patch, err := jsondiff.Compare(startingValues, after.RecordContents)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry := after
+	m := &threeWayMerge{
+		kind:          *entry.RecordKind,
+		collectionKey: *entry.RecordCollectionKey,
+		itemKey:       entry.RecordItemKey,
+		resolutions:   resolutions,
+	}
+
+	v, err := applyRecordPatch(m, patch, map[string]interface{}(*startingValues), entryContents(after), ours)
+	if err != nil {
+		return nil, nil, NewConfigSettingError(fmt.Errorf("cannot apply change to record %s: %w", key, err))
+	}
+
+	contents, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, nil, NewConfigSettingError(fmt.Errorf("cannot apply change to record %s", key))
+	}
+
+	return &pickedRecordChange{
+		entry:    entry,
+		patch:    patch,
+		contents: contents,
+		changed:  !reflect.DeepEqual(v, ours),
+	}, m.conflicts, nil
+}
+
+// CherryPick applies the record changes introduced by a version, relative to its
+// logical parent (for a version written by a batch, the parent of the batch), on top
+// of target (head or a branch). Paths changed on the target since the parent are
+// reported as conflicts unless resolved in options.
+func (s *ConfigService) CherryPick(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, version *ConfigVersionRef, target string, options *ConfigMergeOptions) (*ConfigCherryPickResult, error) {
+	if version == nil {
+		return nil, NewMissingRequiredParameter("version")
+	}
+
+	if options == nil {
+		options = &ConfigMergeOptions{}
+	}
+
+	res := &ConfigCherryPickResult{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		targetRef, targetVersion, err := s.resolveMergeTarget(ctx, tx, scope, accountId, userId, target)
+		if err != nil {
+			return err
+		}
+
+		nodeMetadata, err := s.refService.GetNodeMetadata(ctx, tx, scope, accountId, userId, version.ConfigVersionHash)
+		if err != nil {
+			return err
+		}
+		res.PickedRef = &nodeMetadata.VersionRef
+
+		if nodeMetadata.ParentRef == nil {
+			return NewConfigSettingError(fmt.Errorf("cannot cherry-pick the root version %s", version.ConfigVersionHash))
+		}
+
+		changes, err := s.listRecordChanges(ctx, tx, scope, accountId, userId, nodeMetadata)
+		if err != nil {
+			return err
+		} else if len(changes) == 0 {
+			return NewConfigSettingError(fmt.Errorf("version %s does not change any records", version.ConfigVersionHash))
+		}
+
+		targetRecords, err := s.listRecordsByKey(ctx, tx, scope, accountId, userId, targetVersion)
+		if err != nil {
+			return err
+		}
+
+		resolutions := map[string]map[string]ConfigMergeResolution{}
+		for _, resolution := range options.Resolutions {
+			key := mergeRecordKey(resolution.RecordKind, resolution.RecordCollectionKey, resolution.RecordItemKey)
+			if resolutions[key] == nil {
+				resolutions[key] = map[string]ConfigMergeResolution{}
+			}
+			resolutions[key][resolution.Path] = resolution
+		}
+
+		picked := []*pickedRecordChange{}
+		conflicts := []ConfigMergeConflict{}
+
+		for _, change := range changes {
+			record, recordConflicts, err := applyRecordChange(change.key, change.before, change.after, entryContents(targetRecords[change.key]), resolutions[change.key])
+			if err != nil {
+				return err
+			}
+			conflicts = append(conflicts, recordConflicts...)
+			picked = append(picked, record)
+		}
+
+		if len(conflicts) > 0 {
+			s.logger.Printf("CherryPick: %d conflicts picking %s onto %s\n", len(conflicts), version.ConfigVersionHash, target)
+			return NewConfigMergeConflict(conflicts)
+		}
+
+		setOptions := &SetRecordValuesOptions{
+			Note:     fmt.Sprintf("Cherry-pick %s", nodeMetadata.VersionRef.ConfigVersionHash),
+			Trailers: options.Trailers,
+		}
+		if options.Note != "" {
+			setOptions.Note = options.Note
+		}
+		if targetRef.Kind == ConfigReferenceKindBranch {
+			setOptions.RefName = targetRef.Name
+		}
+
+		for _, record := range picked {
+			recordMetadata := &ConfigRecordMetadata{
+				CollectionKey: *record.entry.RecordCollectionKey,
+				ItemKey:       record.entry.RecordItemKey,
+				RecordKind:    record.entry.RecordKind,
+			}
+			if record.entry.RecordId != nil {
+				recordMetadata.RecordId = *record.entry.RecordId
+			}
+
+			if record.changed && record.deleted {
+				res.NodeMetadata, err = s.DeleteRecord(ctx, tx, scope, accountId, userId, *record.entry.RecordKind, recordMetadata, setOptions)
+				if err != nil {
+					return err
+				}
+			} else if record.changed {
+				values := util.Data(record.contents)
+
+				res.NodeMetadata, err = s.SetRecordValuesWithOptions(ctx, tx, scope, accountId, userId, *record.entry.RecordKind, recordMetadata, ValueSettingModeReplace, &values, setOptions)
+				if err != nil {
+					return err
+				}
+			}
+
+			res.PickedRecords = append(res.PickedRecords, ConfigCherryPickRecord{
+				RecordMetadata: *recordMetadata,
+				Patch:          record.patch,
+			})
+		}
+
+		if res.NodeMetadata == nil {
+			res.NodeMetadata, err = s.refService.GetNodeMetadata(ctx, tx, scope, accountId, userId, targetVersion.ConfigVersionHash)
+		}
+		return err
+	})
+	if err != nil {
+		s.logger.Printf("CherryPick: Error picking %s onto %s: %v\n", version.ConfigVersionHash, target, err)
+		return nil, err
+	}
+
+	return res, nil
+}
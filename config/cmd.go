@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/tmzt/config-api/util"
 	"github.com/urfave/cli/v2"
 	"gorm.io/gorm"
@@ -55,6 +56,8 @@ func getCmdAddConfigSchemaParams(c *cli.Context) *cmdAddConfigSchemaParams {
 			}
 			params.UserId = util.UserIdPtr(userId)
 		}
+	} else {
+		params.AccountId = util.AccountIdPtr(string(util.GlobalScopeAccountId))
 	}
 
 	if c.Bool("all") {
@@ -219,9 +222,115 @@ func CreateConfigSchemaCommand(db *gorm.DB) *cli.Command {
 	}
 }
 
-func CreateConfigCommand(db *gorm.DB) *cli.Command {
+func CreateConfigFsckCommand(db *gorm.DB, rdb *redis.Client) *cli.Command {
+	return &cli.Command{
+		Name:  "fsck",
+		Usage: "Check node hashes, parents and refs of every scope (DAG)",
+		Action: func(c *cli.Context) error {
+			options := &ConfigFsckOptions{
+				Repair: c.Bool("repair"),
+			}
+			if accountId := c.String("account"); accountId != "" {
+				options.AccountId = util.AccountIdPtr(accountId)
+			}
+
+			configService := NewConfigService(db, rdb, util.NewCacheService(rdb))
+
+			report, err := configService.Fsck(c.Context, nil, options)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(util.ToJsonPretty(report))
+
+			if !report.Ok() {
+				return cli.Exit("fsck found problems that were not repaired", 1)
+			}
+			return nil
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "account",
+				Usage: "Account id (only check the scopes of this account)",
+			},
+			&cli.BoolFlag{
+				Name:  "repair",
+				Usage: "Repair dangling refs (root and head are moved to existing nodes, other refs and tags are deleted)",
+			},
+		},
+	}
+}
+
+func CreateConfigGcCommand(db *gorm.DB, rdb *redis.Client) *cli.Command {
+	return &cli.Command{
+		Name:  "gc",
+		Usage: "Squash history older than the retention policy of each scope (DAG)",
+		Action: func(c *cli.Context) error {
+			options := &ConfigGcOptions{
+				DryRun: c.Bool("dry-run"),
+			}
+			if accountId := c.String("account"); accountId != "" {
+				options.AccountId = util.AccountIdPtr(accountId)
+			}
+
+			configService := NewConfigService(db, rdb, util.NewCacheService(rdb))
+
+			runs, err := configService.Gc(c.Context, nil, options)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(util.ToJsonPretty(runs))
+			return nil
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "account",
+				Usage: "Account id (only collect the scopes of this account)",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Report the versions that would be squashed without changing anything",
+			},
+		},
+	}
+}
+
+func CreateConfigRebuildLatestCommand(db *gorm.DB, rdb *redis.Client) *cli.Command {
+	return &cli.Command{
+		Name:  "rebuild-latest",
+		Usage: "Rebuild the materialized latest records of every ref from the version chain (DAG)",
+		Action: func(c *cli.Context) error {
+			var accountId *util.AccountId
+			if id := c.String("account"); id != "" {
+				accountId = util.AccountIdPtr(id)
+			}
+
+			configService := NewConfigService(db, rdb, util.NewCacheService(rdb))
+
+			rebuilt, err := configService.RebuildLatestRecords(c.Context, nil, accountId)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Rebuilt %d refs\n", rebuilt)
+			return nil
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "account",
+				Usage: "Account id (only rebuild the refs of this account)",
+			},
+		},
+	}
+}
+
+func CreateConfigCommand(db *gorm.DB, rdb *redis.Client) *cli.Command {
 	subcommands := []*cli.Command{
 		CreateConfigSchemaCommand(db),
+		CreateConfigFsckCommand(db, rdb),
+		CreateConfigGcCommand(db, rdb),
+		CreateConfigRebuildLatestCommand(db, rdb),
 	}
 
 	return &cli.Command{
@@ -324,6 +324,10 @@ func (s *ConfigDagService) GetReferences(ctx context.Context, tx *gorm.DB, scope
 	refs := make(map[ConfigReferenceKind]ConfigReferenceORM, len(results))
 
 	for _, result := range results {
+		// Named refs (branches) are not keyed by kind alone
+		if result.RefName != "" {
+			continue
+		}
 		refs[result.ConfigReferenceKind] = result
 	}
 
@@ -406,3 +410,53 @@ func (s *ConfigDagService) CommitNode(ctx context.Context, tx *gorm.DB, scope ut
 
 	return nil
 }
+
+// A ref to advance when inserting a node, Name is only set for branches
+type ConfigRefUpdate struct {
+	Kind ConfigReferenceKind `json:"kind"`
+	Name string              `json:"name,omitempty"`
+}
+
+// InsertMergeNode commits a merge node joining parentRef with the additional parents and advances the given refs,
+// the note, trailers and batch id are stored on its version_ref when set
+func (s *ConfigDagService) InsertMergeNode(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, parentRef *ConfigVersionRef, additionalParentRefs []ConfigVersionRef, contents *util.Data, updateRefs []ConfigRefUpdate, note string, trailers ConfigCommitTrailers, batchId string) (*ConfigNodeMetadata, error) {
+	if parentRef == nil {
+		return nil, NewMissingRequiredParameter("parentRef")
+	}
+
+	if len(additionalParentRefs) == 0 {
+		return nil, NewMissingRequiredParameter("additionalParentRefs")
+	}
+
+	if contents == nil {
+		contents = &util.Data{}
+	}
+
+	nodeMetadata := util.Data{
+		"node_kind":              ConfigNodeKindMerge,
+		"parent_ref":             parentRef,
+		"additional_parent_refs": additionalParentRefs,
+	}
+	// Moved into the version_ref by insert_dag_node_internal
+	if note != "" {
+		nodeMetadata["note"] = note
+	}
+	if len(trailers) > 0 {
+		nodeMetadata["trailers"] = trailers
+	}
+	if batchId != "" {
+		nodeMetadata["batch_id"] = batchId
+	}
+
+	query := `SELECT insert_dag_node($1, $2, $3, $4, $5, $6)`
+
+	res := &ConfigNodeMetadata{}
+
+	err := util.RawGetJsonValue(ctx, s.db, tx, res, query, scope, accountId, userId, nodeMetadata, contents, updateRefs)
+	if err != nil {
+		s.logger.Printf("ConfigDagService.InsertMergeNode: error calling insert_dag_node(): %v\n", err)
+		return nil, err
+	}
+
+	return res, nil
+}
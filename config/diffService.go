@@ -56,11 +56,27 @@ func NewConfigDiffService(db *gorm.DB, rdb *redis.Client, cacheService *util.Cac
 	}
 }
 
+// One side of a diff, either a resolved version or the name of one: a version hash, tag,
+// branch, head, root or stage/<stage>. Nil or empty means the start of the chain for From
+// and head for To.
 type ConfigDiffSpec struct {
-	// TODO: Support other refs/tags
-
+	Name    string            `json:"name,omitempty"`
 	Version *ConfigVersionRef `json:"version"`
-	// Kind    *ConfigReferenceKind `json:"kind"`
+}
+
+// Resolves the version of the spec from its name, if it wasn't given one
+func (s *ConfigDiffService) resolveDiffSpec(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, spec *ConfigDiffSpec) error {
+	if spec == nil || spec.Version != nil || spec.Name == "" {
+		return nil
+	}
+
+	version, err := s.refService.ResolveVersion(ctx, tx, scope, accountId, userId, spec.Name)
+	if err != nil {
+		return err
+	}
+
+	spec.Version = version
+	return nil
 }
 
 type ConfigDiffParams struct {
@@ -184,9 +200,10 @@ type RecordMatchFilter struct {
 	RecordCollectionKey *util.ConfigCollectionKey `json:"record_collection_key"`
 	RecordItemKey       *util.ConfigItemKey       `json:"record_item_key"`
 	OnlyMatching        bool                      `json:"only_matching"`
+	// Also follow the additional parents of merge nodes
+	AllParents bool `json:"all_parents,omitempty"`
 }
 
-// TODO: Support tags and other refs, not just versions or head..root
 // TODO: Support matching conditions
 
 // CREATE OR REPLACE FUNCTION get_version_chain(param_scope TEXT, param_account_id TEXT, param_user_id TEXT, param_from_version TEXT, param_to_version TEXT)
@@ -204,8 +221,14 @@ func (s *ConfigDiffService) GetVersionChain(ctx context.Context, tx *gorm.DB, sc
 
 	matchFilter := &RecordMatchFilter{}
 
-	// TODO: Support other refs/tags
 	if params != nil {
+		if err := s.resolveDiffSpec(ctx, tx, scope, accountId, userId, params.From); err != nil {
+			return nil, err
+		}
+		if err := s.resolveDiffSpec(ctx, tx, scope, accountId, userId, params.To); err != nil {
+			return nil, err
+		}
+
 		if params.From != nil && params.From.Version != nil {
 			fromVersion = params.From.Version
 			fromHash = util.StrPtr(string(params.From.Version.ConfigVersionHash))
@@ -428,3 +451,52 @@ func (s *ConfigDiffService) GetLatestRecord(ctx context.Context, tx *gorm.DB, sc
 
 	return version, nil
 }
+
+// GetAncestorHashes returns the hashes of the version and all of its ancestors (following
+// every parent of merge nodes), closest first. The empty root node is not included.
+func (s *ConfigDiffService) GetAncestorHashes(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, version *ConfigVersionRef) ([]util.ConfigVersionHash, error) {
+	if version == nil {
+		return nil, NewMissingRequiredParameter("version")
+	}
+
+	query := `SELECT jsonb_agg(c.cur_hash ORDER BY c.row_number) FROM get_version_chain_raw($1, $2, $3, $4, $5, $6) c`
+
+	matchFilter := &RecordMatchFilter{AllParents: true}
+
+	hashes := []util.ConfigVersionHash{}
+
+	err := util.RawGetJsonValue(ctx, s.db, tx, &hashes, query, scope, accountId, userId, nil, util.StrPtr(string(version.ConfigVersionHash)), matchFilter)
+	if err != nil {
+		s.logger.Printf("Error getting ancestors of %s: %s\n", version.ConfigVersionHash, err)
+		return nil, fmt.Errorf("error getting ancestors: %w", err)
+	}
+
+	return hashes, nil
+}
+
+// FindCommonAncestor returns the closest common ancestor of the two versions,
+// or nil if they only share the (empty) root node
+func (s *ConfigDiffService) FindCommonAncestor(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, a *ConfigVersionRef, b *ConfigVersionRef) (*ConfigVersionRef, error) {
+	aHashes, err := s.GetAncestorHashes(ctx, tx, scope, accountId, userId, a)
+	if err != nil {
+		return nil, err
+	}
+
+	bHashes, err := s.GetAncestorHashes(ctx, tx, scope, accountId, userId, b)
+	if err != nil {
+		return nil, err
+	}
+
+	inA := make(map[util.ConfigVersionHash]bool, len(aHashes))
+	for _, hash := range aHashes {
+		inA[hash] = true
+	}
+
+	for _, hash := range bHashes {
+		if inA[hash] {
+			return &ConfigVersionRef{ConfigVersionHash: hash}, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+// A scope read by an effective read and the version of the record found in it
+type ConfigEffectiveLayer struct {
+	Scope     util.ScopeKind `json:"scope"`
+	AccountId util.AccountId `json:"account_id"`
+	UserId    *util.UserId   `json:"user_id"`
+
+	// The version that last wrote the record in this scope
+	ConfigVersionHash util.ConfigVersionHash `json:"config_version_hash"`
+	RecordMetadata    *ConfigRecordMetadata  `json:"record_metadata"`
+}
+
+type ConfigEffectiveRecord struct {
+	RecordMetadata *ConfigRecordMetadata `json:"record_metadata"`
+	RecordContents *util.Data            `json:"record_contents"`
+	// The scopes that have the record, in the order they were merged
+	Layers []*ConfigEffectiveLayer `json:"layers"`
+	// The last layer that set each top-level key
+	Sources map[string]*ConfigEffectiveLayer `json:"sources"`
+}
+
+// Returns the scopes an effective read merges, lowest precedence first: global, the
+// inherited ancestors (given nearest first) from the top down, the account, then the
+// user when userId is set. Reads of the global scope only read global.
+func effectiveLayers(accountId util.AccountId, ancestors []util.AccountId, userId *util.UserId) []*ConfigEffectiveLayer {
+	layers := []*ConfigEffectiveLayer{
+		{Scope: util.ScopeKindGlobal, AccountId: util.GlobalScopeAccountId},
+	}
+
+	if accountId == util.GlobalScopeAccountId {
+		return layers
+	}
+
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		layers = append(layers, &ConfigEffectiveLayer{Scope: util.ScopeKindAccount, AccountId: ancestors[i]})
+	}
+
+	layers = append(layers, &ConfigEffectiveLayer{Scope: util.ScopeKindAccount, AccountId: accountId})
+
+	if userId != nil {
+		layers = append(layers, &ConfigEffectiveLayer{Scope: util.ScopeKindUser, AccountId: accountId, UserId: userId})
+	}
+
+	return layers
+}
+
+// Effective reads the record matching the query at the head of the global, account and
+// (when userId is set) user scopes and deep merges them in that order, so later scopes
+// override earlier ones. Each scope is merged by the merge strategies of the schema of the
+// collection as seen from that scope (see schemaMergeStrategies), like a deep_merge write. When the account inherits the collection from
+// its parent (see SetInheritance), the parent accounts are merged between global and the
+// account. Returns nil if no scope has the record.
+func (s *ConfigService) Effective(ctx context.Context, tx *gorm.DB, accountId util.AccountId, userId *util.UserId, recordQuery *ConfigRecordQuery) (*ConfigEffectiveRecord, error) {
+	if recordQuery == nil || recordQuery.CollectionKey == nil {
+		return nil, NewMissingRequiredParameter("collectionKey")
+	}
+
+	// The scope of the query is taken from each layer
+	layerQuery := &ConfigRecordQuery{
+		RecordKind:    recordQuery.RecordKind,
+		CollectionKey: recordQuery.CollectionKey,
+		ItemKey:       recordQuery.ItemKey,
+	}
+
+	effective := &ConfigEffectiveRecord{
+		Layers:  []*ConfigEffectiveLayer{},
+		Sources: map[string]*ConfigEffectiveLayer{},
+	}
+
+	var requestUserId util.UserId
+	if userId != nil {
+		requestUserId = *userId
+	}
+
+	ancestors := []util.AccountId{}
+	if accountId != util.GlobalScopeAccountId {
+		var err error
+		ancestors, err = s.inheritedAccounts(ctx, tx, accountId, *recordQuery.CollectionKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, layer := range effectiveLayers(accountId, ancestors, userId) {
+		layerUserId := requestUserId
+		if layer.UserId != nil {
+			layerUserId = *layer.UserId
+		}
+
+		version, err := s.GetLatestRecord(ctx, tx, layer.Scope, layer.AccountId, layerUserId, nil, nil, layerQuery)
+		if err != nil {
+			s.logger.Printf("Effective: Error reading %s scope (account_id %s): %v\n", layer.Scope, layer.AccountId, err)
+			return nil, fmt.Errorf("error reading %s scope: %w", layer.Scope, err)
+		} else if version == nil || version.RecordMetadata == nil || version.RecordContents == nil {
+			continue
+		}
+
+		if version.ToVersion != nil {
+			layer.ConfigVersionHash = version.ToVersion.ConfigVersionHash
+		}
+		layer.RecordMetadata = version.RecordMetadata
+
+		if effective.RecordContents == nil {
+			effective.RecordContents = version.RecordContents
+		} else {
+			strategies, err := s.schemaMergeStrategies(ctx, tx, layer.Scope, layer.AccountId, layerUserId, nil, *recordQuery.CollectionKey)
+			if err != nil {
+				s.logger.Printf("Effective: Error reading merge strategies of %s scope: %v\n", layer.Scope, err)
+				return nil, err
+			}
+
+			merged, err := s.mergeData(effective.RecordContents, version.RecordContents, ValueSettingModeDeepMerge, strategies)
+			if err != nil {
+				s.logger.Printf("Effective: Error merging %s scope: %v\n", layer.Scope, err)
+				return nil, fmt.Errorf("error merging %s scope: %w", layer.Scope, err)
+			}
+			effective.RecordContents = merged
+		}
+
+		for key := range *version.RecordContents {
+			effective.Sources[key] = layer
+		}
+
+		effective.RecordMetadata = version.RecordMetadata
+		effective.Layers = append(effective.Layers, layer)
+	}
+
+	if len(effective.Layers) == 0 {
+		return nil, nil
+	}
+
+	return effective, nil
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/tmzt/config-api/util"
 )
@@ -11,6 +12,7 @@ type ErrReferenceNotFound struct {
 	AccountId     util.AccountId      `json:"account_id"`
 	UserId        *util.UserId        `json:"user_id"`
 	ReferenceKind ConfigReferenceKind `json:"reference_kind"`
+	RefName       string              `json:"ref_name,omitempty"`
 }
 
 func NewReferenceNotFound(scope util.ScopeKind, accountId util.AccountId, userId *util.UserId, kind ConfigReferenceKind) *ErrReferenceNotFound {
@@ -22,14 +24,117 @@ func NewReferenceNotFound(scope util.ScopeKind, accountId util.AccountId, userId
 	}
 }
 
+func NewNamedReferenceNotFound(scope util.ScopeKind, accountId util.AccountId, userId *util.UserId, kind ConfigReferenceKind, name string) *ErrReferenceNotFound {
+	return &ErrReferenceNotFound{
+		Scope:         scope,
+		AccountId:     accountId,
+		UserId:        userId,
+		ReferenceKind: kind,
+		RefName:       name,
+	}
+}
+
 func (e *ErrReferenceNotFound) Error() string {
 	userId := e.UserId
 	if e.Scope != util.ScopeKindUser {
 		userId = nil
 	}
+	if e.RefName != "" {
+		return fmt.Sprintf("config reference not found: scope=%s accountId=%s userId=%s refKind=%s refName=%s", e.Scope, e.AccountId, util.DebugStr(util.UserIdStrOrNil(userId)), e.ReferenceKind, e.RefName)
+	}
 	return fmt.Sprintf("config reference not found: scope=%s accountId=%s userId=%s refKind=%s", e.Scope, e.AccountId, util.DebugStr(util.UserIdStrOrNil(userId)), e.ReferenceKind)
 }
 
+// ErrReferenceAlreadyExists is returned when creating a named reference that already exists
+type ErrReferenceAlreadyExists struct {
+	ReferenceKind ConfigReferenceKind `json:"reference_kind"`
+	RefName       string              `json:"ref_name"`
+}
+
+func NewReferenceAlreadyExists(kind ConfigReferenceKind, name string) *ErrReferenceAlreadyExists {
+	return &ErrReferenceAlreadyExists{
+		ReferenceKind: kind,
+		RefName:       name,
+	}
+}
+
+func (e *ErrReferenceAlreadyExists) Error() string {
+	return fmt.Sprintf("config reference already exists: refKind=%s refName=%s", e.ReferenceKind, e.RefName)
+}
+
+// ErrInvalidReferenceName is returned when a reference name is empty, reserved or contains invalid characters
+type ErrInvalidReferenceName struct {
+	RefName string `json:"ref_name"`
+}
+
+func NewInvalidReferenceName(name string) *ErrInvalidReferenceName {
+	return &ErrInvalidReferenceName{RefName: name}
+}
+
+func (e *ErrInvalidReferenceName) Error() string {
+	return fmt.Sprintf("invalid config reference name: %q", e.RefName)
+}
+
+// ErrVersionNotFound is returned when a version hash does not resolve to a node in the scope
+type ErrVersionNotFound struct {
+	ConfigVersionHash util.ConfigVersionHash `json:"config_version_hash"`
+}
+
+func NewVersionNotFound(hash util.ConfigVersionHash) *ErrVersionNotFound {
+	return &ErrVersionNotFound{ConfigVersionHash: hash}
+}
+
+func (e *ErrVersionNotFound) Error() string {
+	return fmt.Sprintf("config version not found: %s", e.ConfigVersionHash)
+}
+
+// ErrVersionNotFoundAsOf is returned when nothing on a ref was committed at or before a time
+type ErrVersionNotFoundAsOf struct {
+	AsOf time.Time `json:"as_of"`
+}
+
+func NewVersionNotFoundAsOf(asOf time.Time) *ErrVersionNotFoundAsOf {
+	return &ErrVersionNotFoundAsOf{AsOf: asOf}
+}
+
+func (e *ErrVersionNotFoundAsOf) Error() string {
+	return fmt.Sprintf("no config version committed at or before %s", e.AsOf.Format(time.RFC3339))
+}
+
+// ErrRecordNotFound is returned when a record does not exist or has been deleted
+type ErrRecordNotFound struct {
+	CollectionKey util.ConfigCollectionKey `json:"record_collection_key"`
+	ItemKey       *util.ConfigItemKey      `json:"record_item_key,omitempty"`
+}
+
+func NewRecordNotFound(collectionKey util.ConfigCollectionKey, itemKey *util.ConfigItemKey) *ErrRecordNotFound {
+	return &ErrRecordNotFound{CollectionKey: collectionKey, ItemKey: itemKey}
+}
+
+func (e *ErrRecordNotFound) Error() string {
+	if e.ItemKey != nil {
+		return fmt.Sprintf("config record not found: %s/%s", e.CollectionKey, *e.ItemKey)
+	}
+	return fmt.Sprintf("config record not found: %s", e.CollectionKey)
+}
+
+// ErrRecordAlreadyExists is returned when moving a record onto a key that is in use
+type ErrRecordAlreadyExists struct {
+	CollectionKey util.ConfigCollectionKey `json:"record_collection_key"`
+	ItemKey       *util.ConfigItemKey      `json:"record_item_key,omitempty"`
+}
+
+func NewRecordAlreadyExists(collectionKey util.ConfigCollectionKey, itemKey *util.ConfigItemKey) *ErrRecordAlreadyExists {
+	return &ErrRecordAlreadyExists{CollectionKey: collectionKey, ItemKey: itemKey}
+}
+
+func (e *ErrRecordAlreadyExists) Error() string {
+	if e.ItemKey != nil {
+		return fmt.Sprintf("config record already exists: %s/%s", e.CollectionKey, *e.ItemKey)
+	}
+	return fmt.Sprintf("config record already exists: %s", e.CollectionKey)
+}
+
 type ErrMissingRequiredParameter struct {
 	ParamName string `json:"param_name"`
 }
@@ -137,9 +242,22 @@ func (e *ErrConfigSettingError) Unwrap() error {
 // ErrConfigObjectSettingConflict is returned when a conflict is detected
 type ErrConfigObjectSettingConflict struct {
 	Err error `json:"error"`
+
+	// Set when merging, one entry per conflicting JSON path
+	Conflicts []ConfigMergeConflict `json:"conflicts,omitempty"`
+
+	// Set when the expected record version did not match, nil if the record does not exist
+	ExpectedVersionHash *util.ConfigVersionHash `json:"expected_version_hash,omitempty"`
+	CurrentVersionHash  *util.ConfigVersionHash `json:"current_version_hash,omitempty"`
 }
 
 func (e *ErrConfigObjectSettingConflict) Error() string {
+	if len(e.Conflicts) > 0 {
+		return fmt.Sprintf("conflict setting config object: %d conflicting paths", len(e.Conflicts))
+	}
+	if e.ExpectedVersionHash != nil {
+		return fmt.Sprintf("conflict setting config object: expected version %s, current version %s", *e.ExpectedVersionHash, util.DebugStr((*string)(e.CurrentVersionHash)))
+	}
 	return fmt.Sprintf("conflict setting config object: %v", e.Err)
 }
 
@@ -152,6 +270,19 @@ func NewConfigObjectSettingConflict(err error) *ErrConfigObjectSettingConflict {
 	return &ErrConfigObjectSettingConflict{Err: err}
 }
 
+// NewConfigVersionConflict returns a new error indicating the record changed since the expected version
+func NewConfigVersionConflict(expected util.ConfigVersionHash, current *util.ConfigVersionHash) *ErrConfigObjectSettingConflict {
+	return &ErrConfigObjectSettingConflict{
+		ExpectedVersionHash: &expected,
+		CurrentVersionHash:  current,
+	}
+}
+
+// NewConfigMergeConflict returns a new error listing the conflicting paths of a merge
+func NewConfigMergeConflict(conflicts []ConfigMergeConflict) *ErrConfigObjectSettingConflict {
+	return &ErrConfigObjectSettingConflict{Conflicts: conflicts}
+}
+
 // ErrInvalidConfigDiffParams is returned when invalid parameters are passed to the diff function
 type ErrInvalidConfigDiffParams struct {
 	Err error `json:"error"`
@@ -171,3 +302,38 @@ func (e *ErrInvalidConfigDiffParams) Error() string {
 func (e *ErrInvalidConfigDiffParams) Unwrap() error {
 	return e.Err
 }
+
+// ErrStagePromotionNotAllowed is returned when a promotion would skip a stage or move a stage backwards
+type ErrStagePromotionNotAllowed struct {
+	Stage  ConfigStageKind `json:"stage"`
+	Reason string          `json:"reason"`
+}
+
+func NewStagePromotionNotAllowed(stage ConfigStageKind, reason string) *ErrStagePromotionNotAllowed {
+	return &ErrStagePromotionNotAllowed{
+		Stage:  stage,
+		Reason: reason,
+	}
+}
+
+func (e *ErrStagePromotionNotAllowed) Error() string {
+	return fmt.Sprintf("promotion to stage %s not allowed: %s", e.Stage, e.Reason)
+}
+
+// ErrConfigPatchTestFailed is returned when a test operation of a JSON Patch does not match, nothing is written
+type ErrConfigPatchTestFailed struct {
+	// Index of the operation in the patch
+	Index int    `json:"index"`
+	Path  string `json:"path"`
+}
+
+func NewConfigPatchTestFailed(index int, path string) *ErrConfigPatchTestFailed {
+	return &ErrConfigPatchTestFailed{
+		Index: index,
+		Path:  path,
+	}
+}
+
+func (e *ErrConfigPatchTestFailed) Error() string {
+	return fmt.Sprintf("patch test operation %d failed at %q", e.Index, e.Path)
+}
@@ -0,0 +1,351 @@
+package config
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+type ConfigFsckProblemKind string
+
+const (
+	// The hash stored in the node does not match the hash of its metadata
+	ConfigFsckProblemKindHashMismatch ConfigFsckProblemKind = "hash_mismatch"
+	// The parent_ref (or one of the additional_parent_refs) of a node does not resolve
+	ConfigFsckProblemKindMissingParent ConfigFsckProblemKind = "missing_parent"
+	// A ref or tag points at a node that does not exist
+	ConfigFsckProblemKindDanglingRef ConfigFsckProblemKind = "dangling_ref"
+	// A node that cannot be reached from any ref or tag
+	ConfigFsckProblemKindOrphan ConfigFsckProblemKind = "orphan"
+)
+
+type ConfigFsckOptions struct {
+	// Only check the scopes of this account, otherwise every scope is checked
+	AccountId *util.AccountId `json:"account_id"`
+	// Point dangling root and head refs at existing nodes and delete other dangling refs
+	Repair bool `json:"repair"`
+}
+
+type ConfigFsckProblem struct {
+	Kind      ConfigFsckProblemKind `json:"kind"`
+	Scope     util.ScopeKind        `json:"scope"`
+	AccountId util.AccountId        `json:"account_id"`
+	UserId    *util.UserId          `json:"user_id"`
+
+	// The node with the problem, or the hash a dangling ref points at
+	ConfigVersionHash util.ConfigVersionHash `json:"config_version_hash"`
+	// Hash recomputed from the node metadata (hash_mismatch)
+	ComputedHash *util.ConfigVersionHash `json:"computed_hash,omitempty"`
+	// Parent hash that does not resolve (missing_parent)
+	ParentHash *util.ConfigVersionHash `json:"parent_hash,omitempty"`
+	// The dangling ref, tags use the tag kind (dangling_ref)
+	RefKind *ConfigReferenceKind `json:"ref_kind,omitempty"`
+	RefName *string              `json:"ref_name,omitempty"`
+
+	// Set when the ref was repaired, RepairedRef is nil when it was deleted
+	Repaired    bool              `json:"repaired"`
+	RepairedRef *ConfigVersionRef `json:"repaired_ref,omitempty"`
+}
+
+type ConfigFsckReport struct {
+	Scopes   int                 `json:"scopes"`
+	Nodes    int                 `json:"nodes"`
+	Problems []ConfigFsckProblem `json:"problems"`
+}
+
+// Returns true if every problem found was repaired. Orphans are only reported, deleting
+// a branch leaves its nodes behind.
+func (r *ConfigFsckReport) Ok() bool {
+	for _, problem := range r.Problems {
+		if !problem.Repaired && problem.Kind != ConfigFsckProblemKindOrphan {
+			return false
+		}
+	}
+	return true
+}
+
+type configFsckScope struct {
+	Scope     util.ScopeKind `json:"scope"`
+	AccountId util.AccountId `json:"account_id"`
+	UserId    *util.UserId   `json:"user_id"`
+}
+
+const fsckScopesQuery = `
+SELECT COALESCE(jsonb_agg(jsonb_build_object('scope', s.scope, 'account_id', s.account_id, 'user_id', s.user_id)
+	ORDER BY s.scope, s.account_id, s.user_id), '[]'::JSONB)
+FROM (
+	SELECT n.scope, n.account_id, n.user_id FROM config_nodes n
+	UNION SELECT r.scope, r.account_id, r.user_id FROM config_refs r
+	UNION SELECT t.scope, t.account_id, t.user_id FROM config_tags t
+) s
+WHERE $1::TEXT IS NULL OR s.account_id = $1
+`
+
+// Recomputes the hash the same way as insert_dag_node_internal, the stored hash is
+// replaced with the empty hash before hashing
+const fsckHashQuery = `
+SELECT jsonb_build_object(
+	'nodes', count(*),
+	'problems', COALESCE(jsonb_agg(jsonb_build_object(
+		'kind', 'hash_mismatch',
+		'config_version_hash', h.stored_hash,
+		'computed_hash', h.computed_hash
+	) ORDER BY h.created_at) FILTER (WHERE h.stored_hash IS DISTINCT FROM h.computed_hash), '[]'::JSONB)
+)
+FROM (
+	SELECT
+		n.created_at,
+		n.node_metadata->'version_ref'->>'config_version_hash' stored_hash,
+		substr(digest(jsonb_set(n.node_metadata, '{version_ref, config_version_hash}',
+			'"44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"')::TEXT, 'sha256')::TEXT, 3) computed_hash
+	FROM config_nodes n
+	WHERE n.scope = $1 AND n.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN n.user_id = $3 ELSE n.user_id IS NULL END
+	)
+) h
+`
+
+const fsckMissingParentQuery = `
+WITH scope_nodes AS (
+	SELECT n.created_at, n.node_metadata
+	FROM config_nodes n
+	WHERE n.scope = $1 AND n.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN n.user_id = $3 ELSE n.user_id IS NULL END
+	)
+), edges AS (
+	SELECT n.created_at, n.node_metadata->'version_ref'->>'config_version_hash' hash, n.node_metadata->'parent_ref'->>'config_version_hash' parent_hash
+	FROM scope_nodes n
+	WHERE n.node_metadata->'parent_ref' IS NOT NULL AND n.node_metadata->'parent_ref' <> 'null'::JSONB
+	UNION ALL
+	SELECT n.created_at, n.node_metadata->'version_ref'->>'config_version_hash' hash, p->>'config_version_hash' parent_hash
+	FROM scope_nodes n, jsonb_array_elements(CASE
+		WHEN jsonb_typeof(n.node_metadata->'additional_parent_refs') = 'array' THEN n.node_metadata->'additional_parent_refs'
+		ELSE '[]'::JSONB
+	END) p
+)
+SELECT COALESCE(jsonb_agg(jsonb_build_object(
+	'kind', 'missing_parent',
+	'config_version_hash', e.hash,
+	'parent_hash', e.parent_hash
+) ORDER BY e.created_at), '[]'::JSONB)
+FROM edges e
+WHERE NOT EXISTS (
+	SELECT 1 FROM scope_nodes n WHERE n.node_metadata->'version_ref'->>'config_version_hash' = e.parent_hash
+)
+`
+
+const fsckDanglingRefQuery = `
+WITH scope_refs AS (
+	SELECT r.config_reference_kind ref_kind, r.ref_name, r.version_ref->>'config_version_hash' hash
+	FROM config_refs r
+	WHERE r.scope = $1 AND r.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN r.user_id = $3 ELSE r.user_id IS NULL END
+	)
+	UNION ALL
+	SELECT 'tag' ref_kind, t.tag ref_name, t.version_ref->>'config_version_hash' hash
+	FROM config_tags t
+	WHERE t.scope = $1 AND t.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN t.user_id = $3 ELSE t.user_id IS NULL END
+	)
+)
+SELECT COALESCE(jsonb_agg(jsonb_build_object(
+	'kind', 'dangling_ref',
+	'config_version_hash', r.hash,
+	'ref_kind', r.ref_kind,
+	'ref_name', r.ref_name
+) ORDER BY r.ref_kind, r.ref_name), '[]'::JSONB)
+FROM scope_refs r
+WHERE NOT EXISTS (
+	SELECT 1 FROM config_nodes n
+	WHERE n.scope = $1 AND n.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN n.user_id = $3 ELSE n.user_id IS NULL END
+	)
+	AND n.node_metadata->'version_ref'->>'config_version_hash' = r.hash
+)
+`
+
+// Walks every parent (including the additional parents of merge nodes) from the
+// refs and tags, the nodes never reached are orphans
+const fsckOrphanQuery = `
+WITH RECURSIVE scope_nodes AS (
+	SELECT n.created_at, n.node_metadata->'version_ref'->>'config_version_hash' hash, n.node_metadata
+	FROM config_nodes n
+	WHERE n.scope = $1 AND n.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN n.user_id = $3 ELSE n.user_id IS NULL END
+	)
+), edges AS (
+	SELECT n.hash, n.node_metadata->'parent_ref'->>'config_version_hash' parent_hash
+	FROM scope_nodes n
+	WHERE n.node_metadata->'parent_ref' IS NOT NULL AND n.node_metadata->'parent_ref' <> 'null'::JSONB
+	UNION ALL
+	SELECT n.hash, p->>'config_version_hash' parent_hash
+	FROM scope_nodes n, jsonb_array_elements(CASE
+		WHEN jsonb_typeof(n.node_metadata->'additional_parent_refs') = 'array' THEN n.node_metadata->'additional_parent_refs'
+		ELSE '[]'::JSONB
+	END) p
+), reachable(hash) AS (
+	SELECT r.version_ref->>'config_version_hash'
+	FROM config_refs r
+	WHERE r.scope = $1 AND r.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN r.user_id = $3 ELSE r.user_id IS NULL END
+	)
+	UNION
+	SELECT t.version_ref->>'config_version_hash'
+	FROM config_tags t
+	WHERE t.scope = $1 AND t.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN t.user_id = $3 ELSE t.user_id IS NULL END
+	)
+	UNION
+	SELECT e.parent_hash
+	FROM reachable re
+	JOIN edges e ON e.hash = re.hash
+)
+SELECT COALESCE(jsonb_agg(jsonb_build_object(
+	'kind', 'orphan',
+	'config_version_hash', n.hash
+) ORDER BY n.created_at), '[]'::JSONB)
+FROM scope_nodes n
+WHERE NOT EXISTS (SELECT 1 FROM reachable re WHERE re.hash = n.hash)
+`
+
+// Returns the version ref of the newest node in the scope, only empty nodes when emptyOnly is set
+const fsckLatestNodeQuery = `
+SELECT n.node_metadata->'version_ref'
+FROM config_nodes n
+WHERE n.scope = $1 AND n.account_id = $2 AND (
+	CASE WHEN $1 = 'user' THEN n.user_id = $3 ELSE n.user_id IS NULL END
+)
+AND (NOT $4::BOOLEAN OR n.node_metadata->>'node_kind' = 'empty')
+ORDER BY n.created_at DESC
+LIMIT 1
+`
+
+// Fsck checks the integrity of the DAG in every scope (or every scope of one account):
+// node hashes are recomputed, parents must resolve, refs and tags must point at existing
+// nodes and every node must be reachable from a ref or tag. With the repair option,
+// a dangling root is pointed back at the empty node of the scope, a dangling head at
+// the newest node in the scope, and any other dangling ref or tag is deleted. Nodes
+// are never changed.
+func (s *ConfigService) Fsck(ctx context.Context, tx *gorm.DB, options *ConfigFsckOptions) (*ConfigFsckReport, error) {
+	if options == nil {
+		options = &ConfigFsckOptions{}
+	}
+
+	report := &ConfigFsckReport{
+		Problems: []ConfigFsckProblem{},
+	}
+
+	scopes := []configFsckScope{}
+	if err := util.RawGetJsonValue(ctx, s.db, tx, &scopes, fsckScopesQuery, options.AccountId); err != nil {
+		s.logger.Printf("Fsck: Error listing scopes: %v\n", err)
+		return nil, fmt.Errorf("error listing scopes: %w", err)
+	}
+
+	for _, scope := range scopes {
+		problems, nodes, err := s.fsckScope(ctx, tx, scope, options.Repair)
+		if err != nil {
+			s.logger.Printf("Fsck: Error checking scope %s (account_id %s): %v\n", scope.Scope, scope.AccountId, err)
+			return nil, err
+		}
+
+		report.Scopes++
+		report.Nodes += nodes
+		report.Problems = append(report.Problems, problems...)
+	}
+
+	s.logger.Printf("Fsck: Checked %d nodes in %d scopes, %d problems\n", report.Nodes, report.Scopes, len(report.Problems))
+
+	return report, nil
+}
+
+// Checks a single scope, returning the problems found and the number of nodes checked
+func (s *ConfigService) fsckScope(ctx context.Context, tx *gorm.DB, scope configFsckScope, repair bool) ([]ConfigFsckProblem, int, error) {
+	userId := util.UserId("")
+	if scope.UserId != nil {
+		userId = *scope.UserId
+	}
+
+	problems := []ConfigFsckProblem{}
+	nodes := 0
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		hashes := struct {
+			Nodes    int                 `json:"nodes"`
+			Problems []ConfigFsckProblem `json:"problems"`
+		}{}
+		if err := util.RawGetJsonValue(ctx, s.db, tx, &hashes, fsckHashQuery, scope.Scope, scope.AccountId, userId); err != nil {
+			return fmt.Errorf("error checking node hashes: %w", err)
+		}
+		nodes = hashes.Nodes
+		problems = append(problems, hashes.Problems...)
+
+		for _, query := range []string{fsckMissingParentQuery, fsckDanglingRefQuery, fsckOrphanQuery} {
+			found := []ConfigFsckProblem{}
+			if err := util.RawGetJsonValue(ctx, s.db, tx, &found, query, scope.Scope, scope.AccountId, userId); err != nil {
+				return fmt.Errorf("error checking nodes: %w", err)
+			}
+			problems = append(problems, found...)
+		}
+
+		for i := range problems {
+			problems[i].Scope = scope.Scope
+			problems[i].AccountId = scope.AccountId
+			problems[i].UserId = scope.UserId
+
+			if repair && problems[i].Kind == ConfigFsckProblemKindDanglingRef {
+				if err := s.fsckRepairRef(ctx, tx, scope.Scope, scope.AccountId, userId, &problems[i]); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return problems, nodes, nil
+}
+
+// Repairs a dangling ref, root and head are pointed at existing nodes since every scope
+// needs them, anything else is deleted
+func (s *ConfigService) fsckRepairRef(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, problem *ConfigFsckProblem) error {
+	if problem.RefKind == nil || problem.RefName == nil {
+		return nil
+	}
+	kind, name := *problem.RefKind, *problem.RefName
+
+	switch kind {
+	case ConfigReferenceKindRoot, ConfigReferenceKindHead:
+		versionRef := &ConfigVersionRef{}
+		err := util.RawGetJsonValue(ctx, s.db, tx, versionRef, fsckLatestNodeQuery, scope, accountId, userId, kind == ConfigReferenceKindRoot)
+		if err == gorm.ErrRecordNotFound || err == sql.ErrNoRows {
+			s.logger.Printf("fsckRepairRef: No node to point %s at (scope %s, account_id %s)\n", kind, scope, accountId)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := s.refService.SetConfigReference(ctx, tx, scope, accountId, userId, kind, versionRef); err != nil {
+			return err
+		}
+		problem.RepairedRef = versionRef
+	case ConfigReferenceKindTag:
+		if err := s.refService.DeleteTag(ctx, tx, scope, accountId, userId, name); err != nil {
+			return err
+		}
+	default:
+		if err := s.refService.deleteNamedReference(ctx, tx, scope, accountId, userId, kind, name); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Printf("fsckRepairRef: Repaired dangling %s %s (scope %s, account_id %s)\n", kind, name, scope, accountId)
+	problem.Repaired = true
+
+	return nil
+}
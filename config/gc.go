@@ -0,0 +1,283 @@
+package config
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+type ConfigGcOptions struct {
+	// Only collect the scopes of this account, otherwise every scope with a policy
+	AccountId *util.AccountId `json:"account_id"`
+	// Report what would be squashed without changing anything
+	DryRun bool `json:"dry_run"`
+}
+
+// Returns the first parent chain of head, newest first, without the empty root
+const gcHeadChainQuery = `
+WITH RECURSIVE walk AS (
+	SELECT 1 depth, n.node_metadata
+	FROM config_nodes n
+	JOIN config_refs r ON r.version_ref->>'config_version_hash' = n.node_metadata->'version_ref'->>'config_version_hash'
+	WHERE n.scope = $1 AND n.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN n.user_id = $3 ELSE n.user_id IS NULL END
+	)
+	AND r.scope = $1 AND r.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN r.user_id = $3 ELSE r.user_id IS NULL END
+	)
+	AND r.config_reference_kind = 'head' AND r.ref_name = ''
+	UNION ALL
+	SELECT w.depth + 1, n.node_metadata
+	FROM walk w
+	JOIN config_nodes n ON n.node_metadata->'version_ref'->>'config_version_hash' = w.node_metadata->'parent_ref'->>'config_version_hash'
+	WHERE n.scope = $1 AND n.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN n.user_id = $3 ELSE n.user_id IS NULL END
+	)
+)
+SELECT COALESCE(jsonb_agg(w.node_metadata ORDER BY w.depth), '[]'::JSONB)
+FROM walk w
+WHERE w.node_metadata->>'node_kind' <> 'empty'
+`
+
+const gcSquashQuery = `SELECT squash_dag_history($1, $2, $3, $4)`
+
+// GetRetentionPolicy returns the retention policy of the scope, or nil if it has none
+func (s *ConfigService) GetRetentionPolicy(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId) (*ConfigRetentionPolicyORM, error) {
+	where, params := tagScopeWhere(scope, accountId, userId)
+
+	res := &ConfigRetentionPolicyORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		return tx.Table("config_retention_policies t").
+			Where(where, params...).
+			First(res).Error
+	})
+	if err == gorm.ErrRecordNotFound || err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		s.logger.Printf("Error getting retention policy (scope %s, account_id %s): %s\n", scope, accountId, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// SetRetentionPolicy creates or replaces the retention policy of the scope
+func (s *ConfigService) SetRetentionPolicy(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, keepVersions int, keepDays int) (*ConfigRetentionPolicyORM, error) {
+	if keepVersions < 0 || keepDays < 0 {
+		return nil, NewConfigSettingError(fmt.Errorf("keep_versions and keep_days cannot be negative"))
+	}
+	if keepVersions == 0 && keepDays == 0 {
+		return nil, NewConfigSettingError(fmt.Errorf("one of keep_versions or keep_days must be set"))
+	}
+
+	attrs := &ConfigRetentionPolicyORM{
+		Scope:     scope,
+		AccountId: accountId,
+	}
+	if scope == util.ScopeKindUser {
+		attrs.UserId = &userId
+	}
+
+	assign := map[string]interface{}{
+		"keep_versions": keepVersions,
+		"keep_days":     keepDays,
+		"updated_by":    userId,
+	}
+
+	res := &ConfigRetentionPolicyORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		return util.Upsert(tx, attrs, assign, res)
+	})
+	if err != nil {
+		s.logger.Printf("Error setting retention policy (scope %s, account_id %s): %s\n", scope, accountId, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Gc applies the retention policy of every scope that has one. The versions of head
+// older than the policy keeps are squashed into a single baseline node holding the
+// records as they were, the newer versions are re-linked onto it (which changes their
+// hashes) and refs and tags are moved to the new hashes. Versions with a ref or tag,
+// and the versions on head their history branches from, are always kept. Each run is
+// recorded in config_gc_runs, whose rewritten_refs keep the old hashes resolving to
+// the new ones (see ConfigReferenceService.RewrittenVersion).
+func (s *ConfigService) Gc(ctx context.Context, tx *gorm.DB, options *ConfigGcOptions) ([]*ConfigGcRunORM, error) {
+	if options == nil {
+		options = &ConfigGcOptions{}
+	}
+
+	policies := []*ConfigRetentionPolicyORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		query := tx.Table("config_retention_policies t")
+		if options.AccountId != nil {
+			query = query.Where("t.account_id = ?", *options.AccountId)
+		}
+		return query.Order("t.scope, t.account_id, t.user_id").Find(&policies).Error
+	})
+	if err != nil {
+		s.logger.Printf("Gc: Error listing retention policies: %v\n", err)
+		return nil, err
+	}
+
+	runs := []*ConfigGcRunORM{}
+
+	for _, policy := range policies {
+		run, err := s.gcScope(ctx, tx, policy, options.DryRun)
+		if err != nil {
+			s.logger.Printf("Gc: Error collecting scope %s (account_id %s): %v\n", policy.Scope, policy.AccountId, err)
+			return nil, err
+		}
+		if run != nil {
+			runs = append(runs, run)
+		}
+	}
+
+	return runs, nil
+}
+
+// Applies the policy to its scope, returns nil when nothing is old enough to squash
+func (s *ConfigService) gcScope(ctx context.Context, tx *gorm.DB, policy *ConfigRetentionPolicyORM, dryRun bool) (*ConfigGcRunORM, error) {
+	scope, accountId := policy.Scope, policy.AccountId
+
+	// The baseline is committed by the user who set the policy, or the user of a user scope
+	userId := policy.UpdatedBy
+	if scope == util.ScopeKindUser && policy.UserId != nil {
+		userId = *policy.UserId
+	}
+
+	var run *ConfigGcRunORM
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		chain := []ConfigNodeMetadata{}
+		if err := util.RawGetJsonValue(ctx, s.db, tx, &chain, gcHeadChainQuery, scope, accountId, userId); err != nil {
+			return fmt.Errorf("error getting the history of head: %w", err)
+		}
+
+		keep, err := s.gcProtectedIndex(ctx, tx, scope, accountId, userId, chain)
+		if err != nil {
+			return err
+		}
+
+		cutoff := time.Now().AddDate(0, 0, -policy.KeepDays)
+		for i, node := range chain {
+			if i < policy.KeepVersions || (policy.KeepDays > 0 && node.CommittedAt != nil && node.CommittedAt.After(cutoff)) {
+				keep = max(keep, i)
+			}
+		}
+
+		cut := keep + 1
+		if cut >= len(chain) || (cut == len(chain)-1 && chain[cut].NodeKind == ConfigNodeKindBaseline) {
+			s.logger.Printf("gcScope: Nothing to squash (scope %s, account_id %s)\n", scope, accountId)
+			return nil
+		}
+
+		run = &ConfigGcRunORM{
+			Id:           util.NewUUID(),
+			Scope:        scope,
+			AccountId:    accountId,
+			UserId:       policy.UserId,
+			KeepVersions: policy.KeepVersions,
+			KeepDays:     policy.KeepDays,
+			SquashedRef:  &chain[cut].VersionRef,
+			RanBy:        userId,
+			DryRun:       dryRun,
+		}
+
+		if dryRun {
+			for _, node := range chain[cut:] {
+				run.RemovedHashes = append(run.RemovedHashes, node.VersionRef.ConfigVersionHash)
+			}
+			return nil
+		}
+
+		squashed := struct {
+			Baseline  *ConfigNodeMetadata   `json:"baseline"`
+			Removed   ConfigVersionHashList `json:"removed"`
+			Rewritten ConfigVersionRefMap   `json:"rewritten"`
+		}{}
+		if err := util.RawGetJsonValue(ctx, s.db, tx, &squashed, gcSquashQuery, scope, accountId, userId, chain[cut].VersionRef.ConfigVersionHash); err != nil {
+			return fmt.Errorf("error squashing history: %w", err)
+		}
+
+		run.BaselineRef = &squashed.Baseline.VersionRef
+		run.RemovedHashes = squashed.Removed
+		run.RewrittenRefs = squashed.Rewritten
+
+		return tx.Create(run).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The refs were moved by the squash, drop the cached copies
+	if run != nil && !dryRun {
+		s.refService.clearCachedReferences(ctx, tx, scope, accountId, userId)
+	}
+
+	return run, nil
+}
+
+// Returns the index in the chain of the oldest version that must be kept because a ref
+// or tag points at it or branches from it, or -1 if there is none
+func (s *ConfigService) gcProtectedIndex(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, chain []ConfigNodeMetadata) (int, error) {
+	chainIndex := map[util.ConfigVersionHash]int{}
+	for i, node := range chain {
+		chainIndex[node.VersionRef.ConfigVersionHash] = i
+	}
+
+	refWhere, refParams := refScopeWhere(scope, accountId, userId)
+	refParams = append(refParams, ConfigReferenceKindHead, ConfigReferenceKindRoot)
+	tagWhere, tagParams := tagScopeWhere(scope, accountId, userId)
+
+	refs := []*ConfigReferenceORM{}
+	tags := []*ConfigTagORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		if err := tx.Table("config_refs r").Where(refWhere+" AND r.config_reference_kind NOT IN (?, ?)", refParams...).Find(&refs).Error; err != nil {
+			return err
+		}
+		return tx.Table("config_tags t").Where(tagWhere, tagParams...).Find(&tags).Error
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	versions := []*ConfigVersionRef{}
+	for _, ref := range refs {
+		versions = append(versions, ref.VersionRef)
+	}
+	for _, tag := range tags {
+		versions = append(versions, tag.VersionRef)
+	}
+
+	protected := -1
+	for _, version := range versions {
+		if version == nil {
+			continue
+		}
+
+		ancestors, err := s.diffService.GetAncestorHashes(ctx, tx, scope, accountId, userId, version)
+		if err != nil {
+			return -1, err
+		}
+
+		// The closest ancestor on head is where the ref branches from (or the ref itself)
+		for _, hash := range ancestors {
+			if i, ok := chainIndex[hash]; ok {
+				protected = max(protected, i)
+				break
+			}
+		}
+	}
+
+	return protected, nil
+}
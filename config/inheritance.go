@@ -0,0 +1,126 @@
+package config
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+// Stops the walk up the account hierarchy if the parents form a cycle
+const maxInheritanceDepth = 16
+
+// GetInheritance returns the inheritance settings of the account, nil if it has none
+func (s *ConfigService) GetInheritance(ctx context.Context, tx *gorm.DB, accountId util.AccountId) (*ConfigInheritanceORM, error) {
+	res := &ConfigInheritanceORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		return tx.Where("account_id = ?", accountId).First(res).Error
+	})
+	if err == gorm.ErrRecordNotFound || err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		s.logger.Printf("Error getting inheritance (account_id %s): %s\n", accountId, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// SetInheritance creates or replaces the inheritance settings of the account
+func (s *ConfigService) SetInheritance(ctx context.Context, tx *gorm.DB, accountId util.AccountId, userId util.UserId, inheritFromParent bool, excludedCollections []util.ConfigCollectionKey) (*ConfigInheritanceORM, error) {
+	if accountId == util.GlobalScopeAccountId {
+		return nil, NewConfigSettingError(fmt.Errorf("the global scope has no parent to inherit from"))
+	}
+
+	for _, collectionKey := range excludedCollections {
+		if collectionKey == "" {
+			return nil, NewConfigSettingError(fmt.Errorf("excluded collection keys cannot be empty"))
+		}
+	}
+	if excludedCollections == nil {
+		excludedCollections = []util.ConfigCollectionKey{}
+	}
+
+	attrs := &ConfigInheritanceORM{
+		AccountId: accountId,
+	}
+
+	assign := map[string]interface{}{
+		"inherit_from_parent":  inheritFromParent,
+		"excluded_collections": ConfigCollectionKeyList(excludedCollections),
+		"updated_by":           userId,
+	}
+
+	res := &ConfigInheritanceORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		return util.Upsert(tx, attrs, assign, res)
+	})
+	if err != nil {
+		s.logger.Printf("Error setting inheritance (account_id %s): %s\n", accountId, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// GetParentAccountId returns the parent of the account, nil at the top of the hierarchy
+func (s *ConfigService) GetParentAccountId(ctx context.Context, tx *gorm.DB, accountId util.AccountId) (*util.AccountId, error) {
+	var parentAccountId *string
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		return tx.Raw(`SELECT parent_account_id FROM accounts WHERE id = ?`, accountId).Scan(&parentAccountId).Error
+	})
+	if err != nil {
+		s.logger.Printf("Error getting parent of account %s: %s\n", accountId, err)
+		return nil, fmt.Errorf("error getting parent account: %w", err)
+	}
+
+	if parentAccountId == nil || *parentAccountId == "" {
+		return nil, nil
+	}
+
+	parent := util.AccountId(*parentAccountId)
+	return &parent, nil
+}
+
+// Returns the ancestors of the account the collection is inherited from, nearest first.
+// The walk stops at the first account that doesn't inherit the collection, at the top of
+// the hierarchy or at the platform account, whose config is the global scope.
+func (s *ConfigService) inheritedAccounts(ctx context.Context, tx *gorm.DB, accountId util.AccountId, collectionKey util.ConfigCollectionKey) ([]util.AccountId, error) {
+	ancestors := []util.AccountId{}
+	seen := map[util.AccountId]bool{accountId: true}
+
+	current := accountId
+	for depth := 0; depth < maxInheritanceDepth; depth++ {
+		inheritance, err := s.GetInheritance(ctx, tx, current)
+		if err != nil {
+			return nil, err
+		} else if inheritance == nil || !inheritance.Inherits(collectionKey) {
+			break
+		}
+
+		parentAccountId, err := s.GetParentAccountId(ctx, tx, current)
+		if err != nil {
+			return nil, err
+		} else if parentAccountId == nil {
+			break
+		}
+
+		parent := *parentAccountId
+		if parent == util.GlobalScopeAccountId {
+			break
+		} else if seen[parent] {
+			s.logger.Printf("inheritedAccounts: Account %s is its own ancestor, stopping\n", parent)
+			break
+		}
+
+		seen[parent] = true
+		ancestors = append(ancestors, parent)
+		current = parent
+	}
+
+	return ancestors, nil
+}
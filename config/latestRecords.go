@@ -0,0 +1,125 @@
+package config
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+// Returns the materialized records of the ref at $4 (head when NULL) with the record kind,
+// collection key, item key and record id $5-$8 (any when NULL), no rows when no ref was
+// materialized at that version. Keyed records have no item key and match any, as in
+// record_matches_filter().
+const latestRecordsQuery = `
+WITH state AS (
+	SELECT s.config_reference_kind, s.ref_name
+	FROM config_latest_record_refs s
+	WHERE s.scope = $1 AND s.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN s.user_id = $3 ELSE s.user_id IS NULL END
+	)
+	AND s.version_hash = COALESCE($4::TEXT, (
+		SELECT r.version_ref->>'config_version_hash'
+		FROM config_refs r
+		WHERE r.scope = $1 AND r.account_id = $2 AND (
+			CASE WHEN $1 = 'user' THEN r.user_id = $3 ELSE r.user_id IS NULL END
+		)
+		AND r.config_reference_kind = 'head' AND r.ref_name = ''
+	))
+	LIMIT 1
+)
+SELECT COALESCE((
+	SELECT jsonb_agg(jsonb_build_object(
+		'record_kind', l.record_kind,
+		'record_collection_key', l.record_collection_key,
+		'record_item_key', l.record_item_key,
+		'record_metadata', l.record_metadata,
+		'node_metadata', l.node_metadata,
+		'record_contents', l.record_contents
+	) ORDER BY l.record_kind, l.record_collection_key, l.record_item_key)
+	FROM config_latest_records l
+	WHERE l.scope = $1 AND l.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN l.user_id = $3 ELSE l.user_id IS NULL END
+	)
+	AND l.config_reference_kind = s.config_reference_kind AND l.ref_name = s.ref_name
+	AND ($5::TEXT IS NULL OR l.record_kind = $5::TEXT)
+	AND ($6::TEXT IS NULL OR l.record_collection_key = $6::TEXT)
+	AND ($7::TEXT IS NULL OR l.record_kind = 'keyed' OR l.record_item_key = $7::TEXT)
+	AND ($8::TEXT IS NULL OR l.record_metadata->>'record_id' = $8::TEXT)
+), '[]'::JSONB)
+FROM state s
+`
+
+const rebuildLatestRecordsQuery = `SELECT to_jsonb(rebuild_all_latest_records($1))`
+
+type latestRecordEntry struct {
+	ConfigListEntry
+	RecordMetadata *ConfigRecordMetadata `json:"record_metadata"`
+}
+
+// Reads the records at toVersion from config_latest_records, the second result is false
+// when the version isn't materialized and the version chain has to be walked instead
+func (s *ConfigService) getLatestRecords(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, toVersion *ConfigVersionRef, recordQuery *ConfigRecordQuery) ([]*latestRecordEntry, bool, error) {
+	var kind, collectionKey, itemKey, recordId *string
+	if recordQuery != nil {
+		if recordQuery.RecordKind != nil {
+			kind = util.StrPtr(string(*recordQuery.RecordKind))
+		}
+		if recordQuery.CollectionKey != nil {
+			collectionKey = util.StrPtr(string(*recordQuery.CollectionKey))
+		}
+		if recordQuery.ItemKey != nil {
+			itemKey = util.StrPtr(string(*recordQuery.ItemKey))
+		}
+		if recordQuery.RecordId != nil {
+			recordId = util.StrPtr(string(*recordQuery.RecordId))
+		}
+	}
+
+	var toHash *string = nil
+	if toVersion != nil {
+		toHash = util.StrPtr(string(toVersion.ConfigVersionHash))
+	}
+
+	entries := []*latestRecordEntry{}
+	err := util.RawGetJsonValue(ctx, s.db, tx, &entries, latestRecordsQuery, scope, accountId, userId, toHash, kind, collectionKey, itemKey, recordId)
+	if err == gorm.ErrRecordNotFound {
+		s.logger.Printf("getLatestRecords: Version %v is not materialized (scope %s, account_id %s)\n", toHash, scope, accountId)
+		return nil, false, nil
+	} else if err != nil {
+		s.logger.Printf("getLatestRecords: Error reading latest records: %v\n", err)
+		return nil, false, fmt.Errorf("error reading latest records: %w", err)
+	}
+
+	for _, entry := range entries {
+		entryKey := ""
+		if entry.RecordCollectionKey != nil {
+			entryKey = string(*entry.RecordCollectionKey)
+		}
+		if entry.RecordItemKey != nil {
+			entryKey += "/" + string(*entry.RecordItemKey)
+		}
+		entry.RecordKey = util.ConfigRecordKeyPtr(entryKey)
+
+		if entry.RecordMetadata != nil {
+			entry.RecordId = &entry.RecordMetadata.RecordId
+		}
+	}
+
+	return entries, true, nil
+}
+
+// RebuildLatestRecords rebuilds config_latest_records for every ref, or the refs of one
+// account, and returns the number of refs rebuilt
+func (s *ConfigService) RebuildLatestRecords(ctx context.Context, tx *gorm.DB, accountId *util.AccountId) (int, error) {
+	rebuilt := 0
+
+	err := util.RawGetJsonValue(ctx, s.db, tx, &rebuilt, rebuildLatestRecordsQuery, accountId)
+	if err != nil {
+		s.logger.Printf("RebuildLatestRecords: Error rebuilding latest records: %v\n", err)
+		return 0, fmt.Errorf("error rebuilding latest records: %w", err)
+	}
+
+	return rebuilt, nil
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tmzt/config-api/util"
+	"github.com/wI2L/jsondiff"
+	"gorm.io/gorm"
+)
+
+const (
+	ConfigLogDefaultLimit = 50
+	ConfigLogMaxLimit     = 500
+)
+
+type ConfigLogOptions struct {
+	// Start from this version instead of head
+	ToVersion *ConfigVersionRef `json:"to_version"`
+	// Continue after this version, the next_cursor of the previous page. A version that
+	// is not on the chain gives ErrVersionNotFound.
+	Cursor *util.ConfigVersionHash `json:"cursor"`
+	Limit  int                     `json:"limit"`
+
+	Since         *time.Time                `json:"since"`
+	Until         *time.Time                `json:"until"`
+	Author        *util.UserId              `json:"author"`
+	CollectionKey *util.ConfigCollectionKey `json:"collection_key"`
+}
+
+// A record written by a version and how its fields changed
+type ConfigLogRecordChange struct {
+	RecordKey           util.ConfigRecordKey      `json:"id"`
+	RecordKind          *ConfigRecordKind         `json:"record_kind"`
+	RecordCollectionKey *util.ConfigCollectionKey `json:"record_collection_key"`
+	RecordItemKey       *util.ConfigItemKey       `json:"record_item_key"`
+	Deleted             bool                      `json:"deleted"`
+
+	Additions int `json:"additions"`
+	Deletions int `json:"deletions"`
+	Changes   int `json:"changes"`
+}
+
+type ConfigLogEntry struct {
+	NodeMetadata *ConfigNodeMetadata      `json:"node_metadata"`
+	Note         *string                  `json:"note"`
+	Trailers     ConfigCommitTrailers     `json:"trailers,omitempty"`
+	RecordKeys   []util.ConfigRecordKey   `json:"record_keys"`
+	Records      []*ConfigLogRecordChange `json:"records"`
+
+	// Totals over the records
+	Additions int `json:"additions"`
+	Deletions int `json:"deletions"`
+	Changes   int `json:"changes"`
+}
+
+type ConfigLog struct {
+	Entries []*ConfigLogEntry `json:"entries"`
+	// Pass as the cursor to get the next page, nil on the last page
+	NextCursor *util.ConfigVersionHash `json:"next_cursor"`
+}
+
+// Returns the versions on the first parent chain ending at $4 (head when NULL), newest
+// first, each with the records it wrote and their previous contents on the chain. The
+// versions written by one batch are a single row.
+const configLogQuery = `
+WITH chain AS (
+	SELECT c.row_number, c.cur_hash, c.node_kind, c.node_metadata, c.record_metadata, c.record_contents
+	FROM get_version_chain_raw($1, $2, $3, NULL, $4::TEXT, NULL) c
+),
+changes AS (
+	SELECT ch.*,
+		LEAD(ch.record_contents) OVER records_by_key previous_contents,
+		LEAD(ch.node_kind) OVER records_by_key previous_node_kind
+	FROM chain ch
+	WINDOW records_by_key AS (
+		PARTITION BY ch.record_metadata->>'record_kind', ch.record_metadata->>'record_collection_key', ch.record_metadata->>'record_item_key'
+		ORDER BY ch.row_number
+	)
+),
+nodes AS (
+	SELECT MIN(c.row_number) row_number, (array_agg(c.cur_hash ORDER BY c.row_number))[1] cur_hash,
+		(array_agg(c.node_metadata ORDER BY c.row_number))[1] node_metadata,
+		COALESCE(jsonb_agg(jsonb_build_object(
+			'record_metadata', c.record_metadata,
+			'record_contents', c.record_contents,
+			'previous_contents', CASE WHEN c.previous_node_kind = 'tombstone' THEN NULL ELSE c.previous_contents END,
+			'deleted', c.node_kind = 'tombstone'
+		) ORDER BY c.row_number) FILTER (WHERE jsonb_typeof(c.record_metadata) = 'object'), '[]'::JSONB) records
+	FROM changes c
+	-- The nodes of a batch are one entry, shown as the last of them
+	GROUP BY COALESCE(c.node_metadata->'version_ref'->>'batch_id', c.cur_hash)
+)
+SELECT COALESCE(jsonb_agg(jsonb_build_object(
+	'node_metadata', n.node_metadata,
+	'records', n.records
+) ORDER BY n.row_number), '[]'::JSONB)
+FROM (
+	SELECT n.*
+	FROM nodes n
+	WHERE ($5::TEXT IS NULL OR n.row_number > (SELECT cn.row_number FROM nodes cn WHERE cn.cur_hash = $5::TEXT))
+	AND ($6::TIMESTAMPTZ IS NULL OR (n.node_metadata->>'committed_at')::TIMESTAMPTZ >= $6::TIMESTAMPTZ)
+	AND ($7::TIMESTAMPTZ IS NULL OR (n.node_metadata->>'committed_at')::TIMESTAMPTZ <= $7::TIMESTAMPTZ)
+	AND ($8::TEXT IS NULL OR n.node_metadata->>'committed_by' = $8::TEXT)
+	AND ($9::TEXT IS NULL OR EXISTS (
+		SELECT 1 FROM jsonb_array_elements(n.records) r
+		WHERE r.value->'record_metadata'->>'record_collection_key' = $9::TEXT
+	))
+	ORDER BY n.row_number
+	LIMIT $10
+) n
+-- No row when the cursor is not on the chain
+HAVING $5::TEXT IS NULL OR EXISTS (SELECT 1 FROM nodes cn WHERE cn.cur_hash = $5::TEXT)
+`
+
+type configLogRow struct {
+	NodeMetadata *ConfigNodeMetadata `json:"node_metadata"`
+	Records      []struct {
+		RecordMetadata   *ConfigRecordMetadata `json:"record_metadata"`
+		RecordContents   *util.Data            `json:"record_contents"`
+		PreviousContents *util.Data            `json:"previous_contents"`
+		Deleted          bool                  `json:"deleted"`
+	} `json:"records"`
+}
+
+// Log lists the versions of a ref (head by default), newest first, following first
+// parents like the version chain. Each entry has the records the version wrote and a
+// count of the fields added, removed and changed in each.
+func (s *ConfigService) Log(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, options *ConfigLogOptions) (*ConfigLog, error) {
+	if options == nil {
+		options = &ConfigLogOptions{}
+	}
+
+	limit := options.Limit
+	if limit <= 0 {
+		limit = ConfigLogDefaultLimit
+	} else if limit > ConfigLogMaxLimit {
+		return nil, NewConfigSettingError(fmt.Errorf("limit cannot be more than %d", ConfigLogMaxLimit))
+	}
+
+	var toHash *string
+	if options.ToVersion != nil {
+		toHash = util.StrPtr(string(options.ToVersion.ConfigVersionHash))
+	}
+
+	// One more than the page to know if there is a next one
+	rows := []*configLogRow{}
+	err := util.RawGetJsonValue(ctx, s.db, tx, &rows, configLogQuery, scope, accountId, userId, toHash,
+		options.Cursor, options.Since, options.Until, options.Author, options.CollectionKey, limit+1)
+	if errors.Is(err, gorm.ErrRecordNotFound) && options.Cursor != nil {
+		return nil, NewVersionNotFound(*options.Cursor)
+	} else if err != nil {
+		s.logger.Printf("Log: Error listing versions: %v\n", err)
+		return nil, fmt.Errorf("error listing versions: %w", err)
+	}
+
+	log := &ConfigLog{
+		Entries: []*ConfigLogEntry{},
+	}
+
+	if len(rows) > limit {
+		rows = rows[:limit]
+		log.NextCursor = &rows[limit-1].NodeMetadata.VersionRef.ConfigVersionHash
+	}
+
+	for _, row := range rows {
+		entry := &ConfigLogEntry{
+			NodeMetadata: row.NodeMetadata,
+			Note:         row.NodeMetadata.VersionRef.Note,
+			Trailers:     row.NodeMetadata.VersionRef.Trailers,
+			RecordKeys:   []util.ConfigRecordKey{},
+			Records:      []*ConfigLogRecordChange{},
+		}
+
+		for _, record := range row.Records {
+			if record.RecordMetadata == nil {
+				continue
+			}
+
+			recordKey := string(record.RecordMetadata.CollectionKey)
+			if record.RecordMetadata.ItemKey != nil {
+				recordKey += "/" + string(*record.RecordMetadata.ItemKey)
+			}
+
+			change := &ConfigLogRecordChange{
+				RecordKey:           util.ConfigRecordKey(recordKey),
+				RecordKind:          record.RecordMetadata.RecordKind,
+				RecordCollectionKey: &record.RecordMetadata.CollectionKey,
+				RecordItemKey:       record.RecordMetadata.ItemKey,
+				Deleted:             record.Deleted,
+			}
+
+			previous, contents := record.PreviousContents, record.RecordContents
+			if previous == nil {
+				previous = &util.Data{}
+			}
+			if contents == nil || record.Deleted {
+				contents = &util.Data{}
+			}
+
+			patch, err := jsondiff.Compare(previous, contents)
+			if err != nil {
+				s.logger.Printf("Log: Error comparing %s at %s: %v\n", recordKey, row.NodeMetadata.VersionRef.ConfigVersionHash, err)
+				return nil, fmt.Errorf("error comparing record contents: %w", err)
+			}
+
+			for _, op := range patch {
+				switch op.Type {
+				case jsondiff.OperationAdd:
+					change.Additions++
+				case jsondiff.OperationRemove:
+					change.Deletions++
+				default:
+					change.Changes++
+				}
+			}
+
+			entry.RecordKeys = append(entry.RecordKeys, change.RecordKey)
+			entry.Records = append(entry.Records, change)
+			entry.Additions += change.Additions
+			entry.Deletions += change.Deletions
+			entry.Changes += change.Changes
+		}
+
+		log.Entries = append(log.Entries, entry)
+	}
+
+	return log, nil
+}
@@ -0,0 +1,406 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+// ConfigMergeConflict is a JSON path changed differently on both sides of a merge
+type ConfigMergeConflict struct {
+	RecordKind          ConfigRecordKind         `json:"record_kind"`
+	RecordCollectionKey util.ConfigCollectionKey `json:"record_collection_key"`
+	RecordItemKey       *util.ConfigItemKey      `json:"record_item_key"`
+	// JSON pointer into record_contents
+	Path string `json:"path"`
+
+	// Missing values are omitted
+	Base   interface{} `json:"base,omitempty"`
+	Ours   interface{} `json:"ours,omitempty"`
+	Theirs interface{} `json:"theirs,omitempty"`
+}
+
+// ConfigMergeResolution supplies the value to use for a conflicting path when retrying a merge
+type ConfigMergeResolution struct {
+	RecordKind          ConfigRecordKind         `json:"record_kind"`
+	RecordCollectionKey util.ConfigCollectionKey `json:"record_collection_key"`
+	RecordItemKey       *util.ConfigItemKey      `json:"record_item_key"`
+	Path                string                   `json:"path"`
+
+	Value interface{} `json:"value"`
+	// Remove the path instead of setting Value
+	Remove bool `json:"remove"`
+}
+
+type ConfigMergeOptions struct {
+	Resolutions []ConfigMergeResolution `json:"resolutions"`
+	// Stored on the versions written by the merge, replaces the default note of a cherry-pick
+	Note     string               `json:"note"`
+	Trailers ConfigCommitTrailers `json:"trailers"`
+}
+
+type ConfigMergeResult struct {
+	// The new version of the target, unchanged if already up to date
+	NodeMetadata *ConfigNodeMetadata `json:"node_metadata"`
+	BaseRef      *ConfigVersionRef   `json:"base_ref"`
+	FastForward  bool                `json:"fast_forward"`
+	UpToDate     bool                `json:"up_to_date"`
+	// Records committed on the target as part of the merge
+	MergedRecords []ConfigRecordMetadata `json:"merged_records"`
+}
+
+// Used in place of values missing on one side of a merge
+type mergeAbsent struct{}
+
+var absent = mergeAbsent{}
+
+func mergeRecordKey(kind ConfigRecordKind, collectionKey util.ConfigCollectionKey, itemKey *util.ConfigItemKey) string {
+	key := string(kind) + ":" + string(collectionKey)
+	if itemKey != nil {
+		key += "/" + string(*itemKey)
+	}
+	return key
+}
+
+func escapeJsonPointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+type threeWayMerge struct {
+	kind          ConfigRecordKind
+	collectionKey util.ConfigCollectionKey
+	itemKey       *util.ConfigItemKey
+
+	resolutions map[string]ConfigMergeResolution
+	conflicts   []ConfigMergeConflict
+}
+
+func (m *threeWayMerge) merge(path string, base, ours, theirs interface{}) interface{} {
+	if reflect.DeepEqual(ours, theirs) {
+		return ours
+	}
+	if reflect.DeepEqual(base, ours) {
+		return theirs
+	}
+	if reflect.DeepEqual(base, theirs) {
+		return ours
+	}
+
+	oursMap, oursOk := ours.(map[string]interface{})
+	theirsMap, theirsOk := theirs.(map[string]interface{})
+	baseMap, baseOk := base.(map[string]interface{})
+	if base == absent {
+		baseMap, baseOk = map[string]interface{}{}, true
+	}
+
+	if oursOk && theirsOk && baseOk {
+		keys := map[string]bool{}
+		for _, obj := range []map[string]interface{}{baseMap, oursMap, theirsMap} {
+			for k := range obj {
+				keys[k] = true
+			}
+		}
+
+		res := map[string]interface{}{}
+		for k := range keys {
+			v := m.merge(path+"/"+escapeJsonPointer(k), valueOrAbsent(baseMap, k), valueOrAbsent(oursMap, k), valueOrAbsent(theirsMap, k))
+			if v != absent {
+				res[k] = v
+			}
+		}
+		return res
+	}
+
+	if resolution, ok := m.resolutions[path]; ok {
+		if resolution.Remove {
+			return absent
+		}
+		return resolution.Value
+	}
+
+	m.conflicts = append(m.conflicts, ConfigMergeConflict{
+		RecordKind:          m.kind,
+		RecordCollectionKey: m.collectionKey,
+		RecordItemKey:       m.itemKey,
+		Path:                path,
+		Base:                absentAsNil(base),
+		Ours:                absentAsNil(ours),
+		Theirs:              absentAsNil(theirs),
+	})
+
+	return ours
+}
+
+func valueOrAbsent(obj map[string]interface{}, key string) interface{} {
+	if v, ok := obj[key]; ok {
+		return v
+	}
+	return absent
+}
+
+func absentAsNil(v interface{}) interface{} {
+	if v == absent {
+		return nil
+	}
+	return v
+}
+
+func entryContents(entry *ConfigListEntry) interface{} {
+	if entry == nil || entry.RecordContents == nil {
+		return absent
+	}
+	return map[string]interface{}(*entry.RecordContents)
+}
+
+func (s *ConfigService) listRecordsByKey(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, version *ConfigVersionRef) (map[string]*ConfigListEntry, error) {
+	res := map[string]*ConfigListEntry{}
+
+	// Only the empty root node is shared
+	if version == nil {
+		return res, nil
+	}
+
+	entries, err := s.ListConfigs(ctx, tx, scope, accountId, userId, version, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.RecordKind == nil || entry.RecordCollectionKey == nil {
+			continue
+		}
+		res[mergeRecordKey(*entry.RecordKind, *entry.RecordCollectionKey, entry.RecordItemKey)] = entry
+	}
+
+	return res, nil
+}
+
+// resolveMergeTarget returns the ref to advance for a merge target, which must be head or a branch
+func (s *ConfigService) resolveMergeTarget(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, target string) (*ConfigRefUpdate, *ConfigVersionRef, error) {
+	if target == "" || target == string(ConfigReferenceKindHead) {
+		head, err := s.refService.ResolveVersion(ctx, tx, scope, accountId, userId, string(ConfigReferenceKindHead))
+		if err != nil {
+			return nil, nil, err
+		}
+		return &ConfigRefUpdate{Kind: ConfigReferenceKindHead}, head, nil
+	}
+
+	branch, err := s.refService.GetBranch(ctx, tx, scope, accountId, userId, target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &ConfigRefUpdate{Kind: ConfigReferenceKindBranch, Name: target}, branch.VersionRef, nil
+}
+
+// Merge merges source (a ref, branch or version hash) into target (head or a branch).
+// Each record is merged three ways against the closest common ancestor, the merged
+// records are committed on the target followed by a merge node with both parents, all
+// with the same batch id.
+// Conflicting paths are returned as ErrConfigObjectSettingConflict, they can be
+// resolved by retrying with options.Resolutions.
+func (s *ConfigService) Merge(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, source string, target string, options *ConfigMergeOptions) (*ConfigMergeResult, error) {
+	if source == "" {
+		return nil, NewMissingRequiredParameter("source")
+	}
+
+	if options == nil {
+		options = &ConfigMergeOptions{}
+	}
+
+	if err := validateCommitTrailers(options.Trailers); err != nil {
+		return nil, err
+	}
+
+	// A merge with no conflicting records only writes the merge node
+	res := &ConfigMergeResult{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		targetRef, targetVersion, err := s.resolveMergeTarget(ctx, tx, scope, accountId, userId, target)
+		if err != nil {
+			return err
+		}
+
+		sourceVersion, err := s.refService.ResolveVersion(ctx, tx, scope, accountId, userId, source)
+		if err != nil {
+			return err
+		} else if sourceVersion == nil {
+			return NewMissingRequiredParameter("source")
+		}
+
+		// Use the full version refs from the nodes, since they are stored as parents
+		sourceMetadata, err := s.refService.GetNodeMetadata(ctx, tx, scope, accountId, userId, sourceVersion.ConfigVersionHash)
+		if err != nil {
+			return err
+		}
+		targetMetadata, err := s.refService.GetNodeMetadata(ctx, tx, scope, accountId, userId, targetVersion.ConfigVersionHash)
+		if err != nil {
+			return err
+		}
+
+		baseRef, err := s.diffService.FindCommonAncestor(ctx, tx, scope, accountId, userId, &sourceMetadata.VersionRef, &targetMetadata.VersionRef)
+		if err != nil {
+			return err
+		}
+		res.BaseRef = baseRef
+
+		if sourceMetadata.VersionRef.ConfigVersionHash == targetMetadata.VersionRef.ConfigVersionHash ||
+			(baseRef != nil && baseRef.ConfigVersionHash == sourceMetadata.VersionRef.ConfigVersionHash) {
+			s.logger.Printf("Merge: %s is already merged into %s\n", source, target)
+			res.UpToDate = true
+			res.NodeMetadata = targetMetadata
+			return nil
+		}
+
+		if baseRef != nil && baseRef.ConfigVersionHash == targetMetadata.VersionRef.ConfigVersionHash {
+			s.logger.Printf("Merge: fast-forwarding %s to %s\n", target, sourceMetadata.VersionRef.ConfigVersionHash)
+			if err := s.refService.SetNamedConfigReference(ctx, tx, scope, accountId, userId, targetRef.Kind, targetRef.Name, &sourceMetadata.VersionRef); err != nil {
+				return err
+			}
+			res.FastForward = true
+			res.NodeMetadata = sourceMetadata
+			return nil
+		}
+
+		baseRecords, err := s.listRecordsByKey(ctx, tx, scope, accountId, userId, baseRef)
+		if err != nil {
+			return err
+		}
+		sourceRecords, err := s.listRecordsByKey(ctx, tx, scope, accountId, userId, &sourceMetadata.VersionRef)
+		if err != nil {
+			return err
+		}
+		targetRecords, err := s.listRecordsByKey(ctx, tx, scope, accountId, userId, &targetMetadata.VersionRef)
+		if err != nil {
+			return err
+		}
+
+		resolutions := map[string]map[string]ConfigMergeResolution{}
+		for _, resolution := range options.Resolutions {
+			key := mergeRecordKey(resolution.RecordKind, resolution.RecordCollectionKey, resolution.RecordItemKey)
+			if resolutions[key] == nil {
+				resolutions[key] = map[string]ConfigMergeResolution{}
+			}
+			resolutions[key][resolution.Path] = resolution
+		}
+
+		keys := []string{}
+		for key := range sourceRecords {
+			keys = append(keys, key)
+		}
+		for key := range targetRecords {
+			if _, ok := sourceRecords[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		type mergedRecord struct {
+			entry    *ConfigListEntry
+			contents map[string]interface{}
+			deleted  bool
+		}
+
+		merged := []mergedRecord{}
+		conflicts := []ConfigMergeConflict{}
+
+		for _, key := range keys {
+			entry := sourceRecords[key]
+			if entry == nil {
+				entry = targetRecords[key]
+			}
+
+			m := &threeWayMerge{
+				kind:          *entry.RecordKind,
+				collectionKey: *entry.RecordCollectionKey,
+				itemKey:       entry.RecordItemKey,
+				resolutions:   resolutions[key],
+			}
+
+			ours := entryContents(targetRecords[key])
+			v := m.merge("", entryContents(baseRecords[key]), ours, entryContents(sourceRecords[key]))
+			conflicts = append(conflicts, m.conflicts...)
+
+			if reflect.DeepEqual(v, ours) {
+				continue
+			}
+
+			// The record was deleted on the source and left unchanged on the target
+			if v == absent {
+				merged = append(merged, mergedRecord{entry: entry, deleted: true})
+				continue
+			}
+
+			contents, ok := v.(map[string]interface{})
+			if !ok {
+				return NewConfigSettingError(fmt.Errorf("cannot merge record %s", key))
+			}
+
+			merged = append(merged, mergedRecord{entry: entry, contents: contents})
+		}
+
+		if len(conflicts) > 0 {
+			s.logger.Printf("Merge: %d conflicts merging %s into %s\n", len(conflicts), source, target)
+			return NewConfigMergeConflict(conflicts)
+		}
+
+		// Commit the merged records on the target, so reads following the
+		// first parent see the merged values. They share a batch id with the
+		// merge node, so reverting the merge starts from the target before it.
+		setOptions := &SetRecordValuesOptions{
+			Note:     options.Note,
+			Trailers: options.Trailers,
+			BatchId:  util.NewUUID(),
+		}
+		if targetRef.Kind == ConfigReferenceKindBranch {
+			setOptions.RefName = targetRef.Name
+		}
+
+		var parentMetadata *ConfigNodeMetadata = targetMetadata
+
+		for _, record := range merged {
+			recordMetadata := &ConfigRecordMetadata{
+				CollectionKey: *record.entry.RecordCollectionKey,
+				ItemKey:       record.entry.RecordItemKey,
+				RecordKind:    record.entry.RecordKind,
+			}
+			if record.entry.RecordId != nil {
+				recordMetadata.RecordId = *record.entry.RecordId
+			}
+
+			if record.deleted {
+				parentMetadata, err = s.DeleteRecord(ctx, tx, scope, accountId, userId, *record.entry.RecordKind, recordMetadata, setOptions)
+			} else {
+				values := util.Data(record.contents)
+				parentMetadata, err = s.SetRecordValuesWithOptions(ctx, tx, scope, accountId, userId, *record.entry.RecordKind, recordMetadata, ValueSettingModeReplace, &values, setOptions)
+			}
+			if err != nil {
+				return err
+			}
+
+			res.MergedRecords = append(res.MergedRecords, *recordMetadata)
+		}
+
+		contents := &util.Data{
+			"merge": util.Data{
+				"source":   source,
+				"target":   target,
+				"base_ref": baseRef,
+			},
+		}
+
+		res.NodeMetadata, err = s.dagService.InsertMergeNode(ctx, tx, scope, accountId, userId, &parentMetadata.VersionRef, []ConfigVersionRef{sourceMetadata.VersionRef}, contents, []ConfigRefUpdate{*targetRef}, setOptions.Note, setOptions.Trailers, setOptions.BatchId)
+		return err
+	})
+	if err != nil {
+		s.logger.Printf("Merge: Error merging %s into %s: %v\n", source, target, err)
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+type ConfigMergeStrategyKind string
+
+const (
+	// The new value replaces the old one, even when both are objects
+	ConfigMergeStrategyReplace ConfigMergeStrategyKind = "replace"
+	// The new array items are added after the old ones
+	ConfigMergeStrategyAppend ConfigMergeStrategyKind = "append"
+	// The new array items are added after the old ones unless an equal item is already there
+	ConfigMergeStrategySetUnion ConfigMergeStrategyKind = "set_union"
+	// Array items (objects) with the same value of the key field are merged, others are appended
+	ConfigMergeStrategyMergeByKey ConfigMergeStrategyKind = "merge_by_key"
+)
+
+// The keyword in the schema contents of a collection that declares its merge strategies
+const mergeStrategiesSchemaKeyword = "x-merge-strategies"
+
+type ConfigMergeStrategy struct {
+	Strategy ConfigMergeStrategyKind `json:"strategy"`
+	// The field identifying the array items, for merge_by_key
+	Key string `json:"key,omitempty"`
+}
+
+// Merge strategies of a deep merge by the JSON pointer of the field (e.g. /tiers). The
+// pointer only has object keys, the fields of items merged by key keep the pointer of
+// the array (/tiers/prices for the prices of each tier). Objects without a strategy are
+// merged key by key and everything else, including arrays, is replaced.
+type ConfigMergeStrategies map[string]*ConfigMergeStrategy
+
+func validateMergeStrategies(strategies ConfigMergeStrategies) error {
+	for path, strategy := range strategies {
+		if !strings.HasPrefix(path, "/") {
+			return NewConfigSettingError(fmt.Errorf("merge strategy path %q must be a JSON pointer starting with /", path))
+		} else if strategy == nil {
+			return NewConfigSettingError(fmt.Errorf("merge strategy for %s is empty", path))
+		}
+
+		switch strategy.Strategy {
+		case ConfigMergeStrategyReplace, ConfigMergeStrategyAppend, ConfigMergeStrategySetUnion:
+			if strategy.Key != "" {
+				return NewConfigSettingError(fmt.Errorf("merge strategy %s for %s does not take a key", strategy.Strategy, path))
+			}
+		case ConfigMergeStrategyMergeByKey:
+			if strategy.Key == "" {
+				return NewConfigSettingError(fmt.Errorf("merge strategy %s for %s requires a key", strategy.Strategy, path))
+			}
+		default:
+			return NewConfigSettingError(fmt.Errorf("unknown merge strategy %q for %s", strategy.Strategy, path))
+		}
+	}
+
+	return nil
+}
+
+// Returns the merge strategies declared by the schema of the collection, nil if there is
+// none. The schema is read at version (head when nil) in the scope of the write, then at
+// head of the account and of the global scope, the first one found wins.
+func (s *ConfigService) schemaMergeStrategies(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, version *ConfigVersionRef, collectionKey util.ConfigCollectionKey) (ConfigMergeStrategies, error) {
+	schemaQuery := &ConfigRecordQuery{
+		RecordKind:    ConfigRecordKindAsPtr(ConfigRecordKindConfigSchema),
+		CollectionKey: &collectionKey,
+	}
+
+	schemaVersion, err := s.GetLatestRecord(ctx, tx, scope, accountId, userId, nil, version, schemaQuery)
+	if err != nil {
+		return nil, err
+	}
+	if schemaVersion == nil && scope == util.ScopeKindUser {
+		schemaVersion, err = s.GetLatestRecord(ctx, tx, util.ScopeKindAccount, accountId, userId, nil, nil, schemaQuery)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if schemaVersion == nil && scope != util.ScopeKindGlobal {
+		schemaVersion, err = s.GetLatestRecord(ctx, tx, util.ScopeKindGlobal, util.GlobalScopeAccountId, userId, nil, nil, schemaQuery)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if schemaVersion == nil || schemaVersion.RecordContents == nil {
+		return nil, nil
+	}
+
+	schema := &ConfigSchemaRecord{}
+	if err := schemaVersion.DecodeRecordContents(schema); err != nil {
+		return nil, err
+	}
+
+	declared, ok := schema.SchemaContents[mergeStrategiesSchemaKeyword]
+	if !ok {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(declared)
+	if err != nil {
+		return nil, err
+	}
+
+	strategies := ConfigMergeStrategies{}
+	if err := json.Unmarshal(b, &strategies); err != nil {
+		return nil, NewConfigSettingError(fmt.Errorf("invalid %s in schema of %s: %w", mergeStrategiesSchemaKeyword, collectionKey, err))
+	}
+	if err := validateMergeStrategies(strategies); err != nil {
+		return nil, NewConfigSettingError(fmt.Errorf("invalid %s in schema of %s: %w", mergeStrategiesSchemaKeyword, collectionKey, errors.Unwrap(err)))
+	}
+
+	return strategies, nil
+}
+
+// Returns the strategies of the schema, read at the version the write goes on top of,
+// with those of the request on top
+func (s *ConfigService) resolveMergeStrategies(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, collectionKey util.ConfigCollectionKey, options *SetRecordValuesOptions) (ConfigMergeStrategies, error) {
+	version := options.ParentVersionRef
+	if version == nil && options.RefName != "" {
+		branch, err := s.refService.GetBranch(ctx, tx, scope, accountId, userId, options.RefName)
+		if err != nil {
+			return nil, err
+		}
+		version = branch.VersionRef
+	}
+
+	strategies, err := s.schemaMergeStrategies(ctx, tx, scope, accountId, userId, version, collectionKey)
+	if err != nil {
+		s.logger.Printf("resolveMergeStrategies: Error reading schema of %s: %v\n", collectionKey, err)
+		return nil, err
+	}
+
+	requested := options.MergeStrategies
+	if len(requested) == 0 {
+		return strategies, nil
+	} else if strategies == nil {
+		return requested, nil
+	}
+
+	for path, strategy := range requested {
+		strategies[path] = strategy
+	}
+
+	return strategies, nil
+}
+
+// Deep merges the values right into the record contents left, the same way as jsonb_merge.
+// Only an object right is merged, anything else leaves left as it is ({} when left is not
+// an object either).
+func mergeRecordValues(left interface{}, right interface{}, strategies ConfigMergeStrategies) interface{} {
+	if _, ok := right.(map[string]interface{}); !ok {
+		if _, ok := left.(map[string]interface{}); ok {
+			return left
+		}
+		return map[string]interface{}{}
+	}
+
+	return mergeValues(left, right, strategies, "")
+}
+
+// Deep merges right into left by the strategies, the same way as jsonb_merge_path.
+// Neither value is modified.
+func mergeValues(left interface{}, right interface{}, strategies ConfigMergeStrategies, path string) interface{} {
+	strategy := strategies[path]
+	if strategy != nil && strategy.Strategy == ConfigMergeStrategyReplace {
+		return right
+	}
+
+	switch r := right.(type) {
+	case map[string]interface{}:
+		l, ok := left.(map[string]interface{})
+		if !ok {
+			return right
+		}
+
+		res := make(map[string]interface{}, len(l)+len(r))
+		for key, value := range l {
+			res[key] = value
+		}
+		for key, value := range r {
+			if existing, ok := l[key]; ok {
+				res[key] = mergeValues(existing, value, strategies, path+"/"+escapeJsonPointer(key))
+			} else {
+				res[key] = value
+			}
+		}
+		return res
+	case []interface{}:
+		l, ok := left.([]interface{})
+		if !ok || strategy == nil {
+			return right
+		}
+
+		res := append([]interface{}{}, l...)
+		switch strategy.Strategy {
+		case ConfigMergeStrategyAppend:
+			return append(res, r...)
+		case ConfigMergeStrategySetUnion:
+			for _, item := range r {
+				if !containsJsonValue(res, item) {
+					res = append(res, item)
+				}
+			}
+			return res
+		case ConfigMergeStrategyMergeByKey:
+			for _, item := range r {
+				idx := indexByKey(res, item, strategy.Key)
+				if idx < 0 {
+					res = append(res, item)
+				} else {
+					res[idx] = mergeValues(res[idx], item, strategies, path)
+				}
+			}
+			return res
+		}
+		return right
+	default:
+		return right
+	}
+}
+
+func containsJsonValue(arr []interface{}, value interface{}) bool {
+	for _, item := range arr {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the index of the object in arr with the same value of key as item, -1 if there
+// is none or item has no such key
+func indexByKey(arr []interface{}, item interface{}, key string) int {
+	obj, ok := item.(map[string]interface{})
+	if !ok {
+		return -1
+	}
+	keyValue, ok := obj[key]
+	if !ok {
+		return -1
+	}
+
+	for i, existing := range arr {
+		if existingObj, ok := existing.(map[string]interface{}); ok {
+			if existingValue, ok := existingObj[key]; ok && reflect.DeepEqual(existingValue, keyValue) {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,251 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// Cases shared by the Go merge and jsonb_merge, an empty left or right is SQL NULL
+var mergeParityTests = []struct {
+	name       string
+	left       string
+	right      string
+	strategies string
+	want       string
+}{
+	{
+		name:  "objects are merged key by key",
+		left:  `{"a": 1, "o": {"x": 1, "y": 2}}`,
+		right: `{"b": 2, "o": {"y": 3}}`,
+		want:  `{"a": 1, "b": 2, "o": {"x": 1, "y": 3}}`,
+	},
+	{
+		name:  "null values are set",
+		left:  `{"a": 1, "o": {"x": 1}}`,
+		right: `{"a": null, "o": null}`,
+		want:  `{"a": null, "o": null}`,
+	},
+	{
+		name:  "arrays are replaced without a strategy",
+		left:  `{"arr": [1, 2]}`,
+		right: `{"arr": [3]}`,
+		want:  `{"arr": [3]}`,
+	},
+	{
+		name:  "an object replaces a scalar",
+		left:  `{"a": 1}`,
+		right: `{"a": {"x": 1}}`,
+		want:  `{"a": {"x": 1}}`,
+	},
+	{
+		name:  "JSON null right keeps left",
+		left:  `{"a": 1}`,
+		right: `null`,
+		want:  `{"a": 1}`,
+	},
+	{
+		name: "SQL NULL right keeps left",
+		left: `{"a": 1}`,
+		want: `{"a": 1}`,
+	},
+	{
+		name:  "a scalar right keeps left",
+		left:  `{"a": 1}`,
+		right: `5`,
+		want:  `{"a": 1}`,
+	},
+	{
+		name:  "non-object right and left",
+		left:  `5`,
+		right: `null`,
+		want:  `{}`,
+	},
+	{
+		name:  "non-object left starts from an empty object",
+		left:  `null`,
+		right: `{"a": {"x": 1}}`,
+		want:  `{"a": {"x": 1}}`,
+	},
+	{
+		name:  "SQL NULL left starts from an empty object",
+		right: `{"a": 1}`,
+		want:  `{"a": 1}`,
+	},
+	{
+		name:       "replace strategy",
+		left:       `{"o": {"x": 1, "y": 2}}`,
+		right:      `{"o": {"y": 3}}`,
+		strategies: `{"/o": {"strategy": "replace"}}`,
+		want:       `{"o": {"y": 3}}`,
+	},
+	{
+		name:       "append strategy",
+		left:       `{"arr": [1, 2]}`,
+		right:      `{"arr": [2, 3]}`,
+		strategies: `{"/arr": {"strategy": "append"}}`,
+		want:       `{"arr": [1, 2, 2, 3]}`,
+	},
+	{
+		name:       "set_union strategy",
+		left:       `{"arr": [1, {"a": 1}]}`,
+		right:      `{"arr": [{"a": 1}, 2, 1]}`,
+		strategies: `{"/arr": {"strategy": "set_union"}}`,
+		want:       `{"arr": [1, {"a": 1}, 2]}`,
+	},
+	{
+		name:       "merge_by_key strategy",
+		left:       `{"tiers": [{"id": "a", "price": 1, "tags": ["x"]}, {"id": "b", "price": 2}]}`,
+		right:      `{"tiers": [{"id": "b", "price": 3}, {"id": "c", "price": 4}, {"price": 5}]}`,
+		strategies: `{"/tiers": {"strategy": "merge_by_key", "key": "id"}}`,
+		want:       `{"tiers": [{"id": "a", "price": 1, "tags": ["x"]}, {"id": "b", "price": 3}, {"id": "c", "price": 4}, {"price": 5}]}`,
+	},
+	{
+		name:       "fields of items merged by key keep the array pointer",
+		left:       `{"tiers": [{"id": "a", "tags": ["x"]}]}`,
+		right:      `{"tiers": [{"id": "a", "tags": ["y"]}]}`,
+		strategies: `{"/tiers": {"strategy": "merge_by_key", "key": "id"}, "/tiers/tags": {"strategy": "append"}}`,
+		want:       `{"tiers": [{"id": "a", "tags": ["x", "y"]}]}`,
+	},
+	{
+		name:       "escaped keys",
+		left:       `{"a/b": [1]}`,
+		right:      `{"a/b": [2]}`,
+		strategies: `{"/a~1b": {"strategy": "append"}}`,
+		want:       `{"a/b": [1, 2]}`,
+	},
+}
+
+func decodeTestJson(t *testing.T, s string) interface{} {
+	t.Helper()
+
+	if s == "" {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", s, err)
+	}
+	return v
+}
+
+func decodeTestStrategies(t *testing.T, s string) ConfigMergeStrategies {
+	t.Helper()
+
+	strategies := ConfigMergeStrategies{}
+	if s == "" {
+		return strategies
+	}
+	if err := json.Unmarshal([]byte(s), &strategies); err != nil {
+		t.Fatalf("invalid test strategies %s: %v", s, err)
+	}
+	if err := validateMergeStrategies(strategies); err != nil {
+		t.Fatalf("invalid test strategies %s: %v", s, err)
+	}
+	return strategies
+}
+
+func TestMergeRecordValues(t *testing.T) {
+	for _, tt := range mergeParityTests {
+		t.Run(tt.name, func(t *testing.T) {
+			left := decodeTestJson(t, tt.left)
+			original := decodeTestJson(t, tt.left)
+
+			got := mergeRecordValues(left, decodeTestJson(t, tt.right), decodeTestStrategies(t, tt.strategies))
+
+			if want := decodeTestJson(t, tt.want); !reflect.DeepEqual(got, want) {
+				b, _ := json.Marshal(got)
+				t.Errorf("got %s, want %s", b, tt.want)
+			}
+			if !reflect.DeepEqual(left, original) {
+				t.Errorf("left was modified")
+			}
+		})
+	}
+}
+
+// Runs the same cases through jsonb_merge, loaded from functions/jsonb_merge.sql in a
+// transaction that is rolled back. Needs POSTGRES_URL.
+func TestJsonbMergeParity(t *testing.T) {
+	postgresUrl := os.Getenv("POSTGRES_URL")
+	if postgresUrl == "" {
+		t.Skip("POSTGRES_URL is not set")
+	}
+
+	functionSql, err := os.ReadFile("../functions/jsonb_merge.sql")
+	if err != nil {
+		t.Fatalf("error reading jsonb_merge.sql: %v", err)
+	}
+
+	db, err := gorm.Open(postgres.Open(postgresUrl), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("error connecting to the database: %v", err)
+	}
+
+	tx := db.Begin()
+	defer tx.Rollback()
+
+	if err := tx.Exec(string(functionSql)).Error; err != nil {
+		t.Fatalf("error creating jsonb_merge: %v", err)
+	}
+
+	nullable := func(s string) *string {
+		if s == "" {
+			return nil
+		}
+		return &s
+	}
+
+	for _, tt := range mergeParityTests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategies := tt.strategies
+			if strategies == "" {
+				strategies = "{}"
+			}
+
+			var got string
+			err := tx.Raw(`SELECT jsonb_merge($1::JSONB, $2::JSONB, $3::JSONB)::TEXT`, nullable(tt.left), nullable(tt.right), strategies).Row().Scan(&got)
+			if err != nil {
+				t.Fatalf("error calling jsonb_merge: %v", err)
+			}
+
+			goMerged := mergeRecordValues(decodeTestJson(t, tt.left), decodeTestJson(t, tt.right), decodeTestStrategies(t, tt.strategies))
+			if sqlMerged := decodeTestJson(t, got); !reflect.DeepEqual(sqlMerged, goMerged) {
+				b, _ := json.Marshal(goMerged)
+				t.Errorf("jsonb_merge gave %s, mergeRecordValues %s", got, b)
+			}
+		})
+	}
+
+	// Numbers are not read as doubles, unlike the plv8 version
+	var got string
+	err = tx.Raw(`SELECT jsonb_merge('{"n": 1}'::JSONB, '{"n": 12345678901234567890}'::JSONB)::TEXT`).Row().Scan(&got)
+	if err != nil {
+		t.Fatalf("error calling jsonb_merge: %v", err)
+	} else if got != `{"n": 12345678901234567890}` {
+		t.Errorf("got %s, want the number unchanged", got)
+	}
+}
+
+func TestMergeDataUsesStrategies(t *testing.T) {
+	s := &ConfigService{}
+
+	existing := util.Data{"tags": []interface{}{"a"}, "o": map[string]interface{}{"x": 1.0}}
+	values := util.Data{"tags": []interface{}{"b"}, "o": map[string]interface{}{"y": 2.0}}
+
+	got, err := s.mergeData(&existing, &values, ValueSettingModeDeepMerge, decodeTestStrategies(t, `{"/tags": {"strategy": "append"}}`))
+	if err != nil {
+		t.Fatalf("mergeData: %v", err)
+	}
+
+	want := util.Data{"tags": []interface{}{"a", "b"}, "o": map[string]interface{}{"x": 1.0, "y": 2.0}}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("got %v, want %v", *got, want)
+	}
+}
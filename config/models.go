@@ -3,6 +3,8 @@ package config
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -57,6 +59,7 @@ type ConfigDagNodeEmbed struct {
 	Note string `json:"note"`
 
 	// AdditionalParents []ParentRef             `json:"additional_parents"`
+	// See ConfigNodeMetadata.AdditionalParentRefs for merge nodes
 	Data *ConfigDataObject `json:"data" gorm:"type:jsonb"`
 }
 
@@ -90,6 +93,25 @@ const (
 	ConfigStageKindDev              ConfigStageKind = "dev"
 )
 
+// Stages in promotion order, versions are promoted from each stage to the next
+var ConfigStageOrder = []ConfigStageKind{
+	ConfigStageKindDev,
+	ConfigStageKindTest,
+	ConfigStageKindClientValidation,
+	ConfigStageKindBeta,
+	ConfigStageKindProd,
+}
+
+// Returns the position of the stage in ConfigStageOrder, or -1 if it is not a valid stage
+func (k ConfigStageKind) Index() int {
+	for i, stage := range ConfigStageOrder {
+		if stage == k {
+			return i
+		}
+	}
+	return -1
+}
+
 type ConfigStageAudienceKind string
 
 const (
@@ -122,26 +144,36 @@ const (
 	ConfigReferenceKindRoot ConfigReferenceKind = "root"
 	ConfigReferenceKindHead ConfigReferenceKind = "head"
 
+	// A named branch, the name is stored in RefName
+	ConfigReferenceKindBranch ConfigReferenceKind = "branch"
+
 	// TODO: Add a scope kind
 	// ConfigReferenceKindAccountCurrentHead ConfigReferenceKind = "account_current_head"
 	// ConfigReferenceKindUserCurrentHead    ConfigReferenceKind = "account_current_head"
 
-	// The earliest version of the config for the given stage
-	ConfigReferenceKindStageRoot   ConfigReferenceKind = "stage_root"
+	// The earliest version of the config for the given stage, the stage is stored in RefName
+	ConfigReferenceKindStageRoot ConfigReferenceKind = "stage_root"
+	// The version currently promoted to the given stage, the stage is stored in RefName
 	ConfigReferenceKindTaggedStage ConfigReferenceKind = "tagged_stage"
 	ConfigReferenceKindTag         ConfigReferenceKind = "tag"
 )
 
 type ConfigTagObject struct {
+	Scope     util.ScopeKind `json:"scope" gorm:"uniqueIndex:config_tag_object_tag;not null;default:'account'"`
 	AccountId util.AccountId `json:"account_id" gorm:"uniqueIndex:config_tag_object_tag;not null"`
 	UserId    *util.UserId   `json:"user_id" gorm:"uniqueIndex:config_tag_object_tag;null"`
 
 	Tag        string            `json:"tag" gorm:"uniqueIndex:config_tag_object_tag;not null"`
-	VersionRef *ConfigVersionRef `json:"version_ref"`
+	VersionRef *ConfigVersionRef `json:"version_ref" gorm:"type:jsonb;not null"`
 
 	ConfigReferenceKind     *ConfigReferenceKind     `json:"config_reference_kind" gorm:"index"`
 	ConfigStageAudienceKind *ConfigStageAudienceKind `json:"config_stage_audience_kind" gorm:"index"`
 	ConfigStageKind         *ConfigStageKind         `json:"config_stage_kind" gorm:"index"`
+
+	CreatedAt time.Time   `json:"created_at"`
+	CreatedBy util.UserId `json:"created_by" gorm:"type:text"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	UpdatedBy util.UserId `json:"updated_by" gorm:"type:text"`
 }
 
 type ConfigTagORM struct {
@@ -152,6 +184,351 @@ func (c *ConfigTagORM) TableName() string {
 	return "config_tags"
 }
 
+// The unique index of the model includes the nullable user_id, which doesn't stop two
+// tags of the same name in the global or account scope. Add one unique index per scope.
+func (c *ConfigTagORM) AddIndexes(ctx context.Context, tx *sql.Tx) error {
+	logger := util.NewLogger("ConfigTagORM.AddIndexes", 0)
+
+	tableName := c.TableName()
+
+	exec := func(query string) error {
+		logger.Printf("Executing query: %s\n", query)
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	}
+
+	// Add a unique index on the account_id and tag, where scope is account.
+	err := exec(fmt.Sprintf(`
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_account_scope_tag_idx
+		ON %s (account_id, tag)
+		WHERE scope = 'account'
+	`, tableName, tableName))
+	if err != nil {
+		logger.Printf("Error creating index (%s_account_scope_tag_idx): %v\n", tableName, err)
+		return err
+	}
+
+	// Add a unique index on the account_id and tag, where scope is global.
+	err = exec(fmt.Sprintf(`
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_global_scope_tag_idx
+		ON %s (account_id, tag)
+		WHERE scope = 'global'
+	`, tableName, tableName))
+	if err != nil {
+		logger.Printf("Error creating index (%s_global_scope_tag_idx): %v\n", tableName, err)
+		return err
+	}
+
+	// Add a unique index on the account_id, user_id and tag, where scope is user.
+	err = exec(fmt.Sprintf(`
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_user_scope_tag_idx
+		ON %s (account_id, user_id, tag)
+		WHERE scope = 'user'
+	`, tableName, tableName))
+	if err != nil {
+		logger.Printf("Error creating index (%s_user_scope_tag_idx): %v\n", tableName, err)
+		return err
+	}
+
+	return nil
+}
+
+// An entry in the promotion history of a stage
+type ConfigStagePromotionORM struct {
+	Id string `json:"id" gorm:"primary_key"`
+
+	Scope     util.ScopeKind `json:"scope" gorm:"index:config_stage_promotion_stage;not null"`
+	AccountId util.AccountId `json:"account_id" gorm:"index:config_stage_promotion_stage;not null"`
+	UserId    *util.UserId   `json:"user_id" gorm:"index:config_stage_promotion_stage;null"`
+
+	ConfigStageKind ConfigStageKind `json:"config_stage_kind" gorm:"index:config_stage_promotion_stage;not null"`
+
+	// The version the stage pointed to before, nil for the first promotion
+	PreviousVersionRef *ConfigVersionRef `json:"previous_version_ref" gorm:"type:jsonb"`
+	VersionRef         *ConfigVersionRef `json:"version_ref" gorm:"type:jsonb;not null"`
+
+	Reason string `json:"reason"`
+	// Set when the stage order or forward only checks were skipped
+	Forced bool `json:"forced" gorm:"not null;default:false"`
+
+	PromotedAt time.Time   `json:"promoted_at" gorm:"autoCreateTime"`
+	PromotedBy util.UserId `json:"promoted_by" gorm:"type:text"`
+}
+
+func (c *ConfigStagePromotionORM) TableName() string {
+	return "config_stage_promotions"
+}
+
+// Retention policy of a scope, applied by config gc. A version of head is kept while it
+// is one of the newest KeepVersions or was committed within KeepDays, versions with a
+// ref or tag (and the versions their history branches from) are always kept.
+type ConfigRetentionPolicyORM struct {
+	Scope     util.ScopeKind `json:"scope" gorm:"uniqueIndex:config_retention_policy_scope;not null"`
+	AccountId util.AccountId `json:"account_id" gorm:"uniqueIndex:config_retention_policy_scope;not null"`
+	UserId    *util.UserId   `json:"user_id" gorm:"uniqueIndex:config_retention_policy_scope;null"`
+
+	// Zero disables the limit, at least one must be set
+	KeepVersions int `json:"keep_versions" gorm:"not null;default:0"`
+	KeepDays     int `json:"keep_days" gorm:"not null;default:0"`
+
+	UpdatedAt time.Time   `json:"updated_at"`
+	UpdatedBy util.UserId `json:"updated_by" gorm:"type:text"`
+}
+
+func (c *ConfigRetentionPolicyORM) TableName() string {
+	return "config_retention_policies"
+}
+
+// As for tags, a single policy per scope needs one unique index per scope since user_id
+// is null outside the user scope.
+func (c *ConfigRetentionPolicyORM) AddIndexes(ctx context.Context, tx *sql.Tx) error {
+	logger := util.NewLogger("ConfigRetentionPolicyORM.AddIndexes", 0)
+
+	tableName := c.TableName()
+
+	exec := func(query string) error {
+		logger.Printf("Executing query: %s\n", query)
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	}
+
+	// Add a unique index on the account_id, where scope is account.
+	err := exec(fmt.Sprintf(`
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_account_scope_idx
+		ON %s (account_id)
+		WHERE scope = 'account'
+	`, tableName, tableName))
+	if err != nil {
+		logger.Printf("Error creating index (%s_account_scope_idx): %v\n", tableName, err)
+		return err
+	}
+
+	// Add a unique index on the account_id, where scope is global.
+	err = exec(fmt.Sprintf(`
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_global_scope_idx
+		ON %s (account_id)
+		WHERE scope = 'global'
+	`, tableName, tableName))
+	if err != nil {
+		logger.Printf("Error creating index (%s_global_scope_idx): %v\n", tableName, err)
+		return err
+	}
+
+	// Add a unique index on the account_id and user_id, where scope is user.
+	err = exec(fmt.Sprintf(`
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_user_scope_idx
+		ON %s (account_id, user_id)
+		WHERE scope = 'user'
+	`, tableName, tableName))
+	if err != nil {
+		logger.Printf("Error creating index (%s_user_scope_idx): %v\n", tableName, err)
+		return err
+	}
+
+	return nil
+}
+
+// Whether an account inherits config from its parent account in effective reads
+type ConfigInheritanceORM struct {
+	AccountId util.AccountId `json:"account_id" gorm:"primaryKey;type:text"`
+
+	InheritFromParent bool `json:"inherit_from_parent" gorm:"not null;default:false"`
+	// Collections that are never inherited
+	ExcludedCollections ConfigCollectionKeyList `json:"excluded_collections" gorm:"type:jsonb;not null;default:'[]'"`
+
+	UpdatedAt time.Time   `json:"updated_at"`
+	UpdatedBy util.UserId `json:"updated_by" gorm:"type:text"`
+}
+
+func (c *ConfigInheritanceORM) TableName() string {
+	return "config_inheritance"
+}
+
+// Returns true if the collection is inherited from the parent account
+func (c *ConfigInheritanceORM) Inherits(collectionKey util.ConfigCollectionKey) bool {
+	if !c.InheritFromParent {
+		return false
+	}
+	for _, excluded := range c.ExcludedCollections {
+		if excluded == collectionKey {
+			return false
+		}
+	}
+	return true
+}
+
+type ConfigCollectionKeyList []util.ConfigCollectionKey
+
+func (l ConfigCollectionKeyList) Value() (driver.Value, error) {
+	return json.Marshal(l)
+}
+
+func (l *ConfigCollectionKeyList) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, l)
+	case string:
+		return json.Unmarshal([]byte(src), l)
+	}
+	return fmt.Errorf("unsupported type: %T", src)
+}
+
+type ConfigVersionHashList []util.ConfigVersionHash
+
+func (l ConfigVersionHashList) Value() (driver.Value, error) {
+	return json.Marshal(l)
+}
+
+func (l *ConfigVersionHashList) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, l)
+	case string:
+		return json.Unmarshal([]byte(src), l)
+	}
+	return fmt.Errorf("unsupported type: %T", src)
+}
+
+// Maps the hashes changed by a gc run to the new versions
+type ConfigVersionRefMap map[util.ConfigVersionHash]*ConfigVersionRef
+
+func (m ConfigVersionRefMap) Value() (driver.Value, error) {
+	return json.Marshal(m)
+}
+
+func (m *ConfigVersionRefMap) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, m)
+	case string:
+		return json.Unmarshal([]byte(src), m)
+	}
+	return fmt.Errorf("unsupported type: %T", src)
+}
+
+// What a gc run squashed in a scope
+type ConfigGcRunORM struct {
+	Id string `json:"id" gorm:"primary_key"`
+
+	Scope     util.ScopeKind `json:"scope" gorm:"index:config_gc_run_scope;not null"`
+	AccountId util.AccountId `json:"account_id" gorm:"index:config_gc_run_scope;not null"`
+	UserId    *util.UserId   `json:"user_id" gorm:"index:config_gc_run_scope;null"`
+
+	// The policy the run applied
+	KeepVersions int `json:"keep_versions"`
+	KeepDays     int `json:"keep_days"`
+
+	// The newest version folded into the baseline
+	SquashedRef *ConfigVersionRef `json:"squashed_ref" gorm:"type:jsonb;not null"`
+	BaselineRef *ConfigVersionRef `json:"baseline_ref" gorm:"type:jsonb"`
+	// The squashed versions and the nodes only reachable through them
+	RemovedHashes ConfigVersionHashList `json:"removed_hashes" gorm:"type:jsonb"`
+	// The kept versions re-linked onto the baseline, by their previous hash
+	RewrittenRefs ConfigVersionRefMap `json:"rewritten_refs" gorm:"type:jsonb"`
+
+	DryRun bool `json:"dry_run" gorm:"-"`
+
+	RanAt time.Time   `json:"ran_at" gorm:"autoCreateTime"`
+	RanBy util.UserId `json:"ran_by" gorm:"type:text"`
+}
+
+func (c *ConfigGcRunORM) TableName() string {
+	return "config_gc_runs"
+}
+
+// The current record of each key at the tip of a ref, kept in step with config_refs by
+// update_latest_records() so reads at a ref don't walk the version chain
+type ConfigLatestRecordORM struct {
+	Scope     util.ScopeKind `json:"scope" gorm:"index:config_latest_record_ref;not null"`
+	AccountId util.AccountId `json:"account_id" gorm:"index:config_latest_record_ref;not null"`
+	UserId    *util.UserId   `json:"user_id" gorm:"index:config_latest_record_ref;null"`
+
+	ConfigReferenceKind ConfigReferenceKind `json:"config_reference_kind" gorm:"index:config_latest_record_ref;not null"`
+	RefName             string              `json:"ref_name" gorm:"index:config_latest_record_ref;not null;default:''"`
+
+	RecordKind          *ConfigRecordKind         `json:"record_kind"`
+	RecordCollectionKey *util.ConfigCollectionKey `json:"record_collection_key"`
+	RecordItemKey       *util.ConfigItemKey       `json:"record_item_key"`
+
+	RecordMetadata *ConfigRecordMetadata `json:"record_metadata" gorm:"type:jsonb"`
+	RecordContents *util.Data            `json:"record_contents" gorm:"type:jsonb"`
+	// The node that last wrote the record
+	NodeMetadata *ConfigNodeMetadata `json:"node_metadata" gorm:"type:jsonb"`
+}
+
+func (c *ConfigLatestRecordORM) TableName() string {
+	return "config_latest_records"
+}
+
+// A ref has a single row per record. The record columns are null for the keys a record
+// kind doesn't have, so they are coalesced, and user_id is only set in the user scope.
+func (c *ConfigLatestRecordORM) AddIndexes(ctx context.Context, tx *sql.Tx) error {
+	logger := util.NewLogger("ConfigLatestRecordORM.AddIndexes", 0)
+
+	tableName := c.TableName()
+
+	exec := func(query string) error {
+		logger.Printf("Executing query: %s\n", query)
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	}
+
+	recordColumns := "COALESCE(record_kind, ''), COALESCE(record_collection_key, ''), COALESCE(record_item_key, '')"
+
+	// Add a unique index on the account_id, ref and record keys, where scope is account.
+	err := exec(fmt.Sprintf(`
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_account_scope_record_idx
+		ON %s (account_id, config_reference_kind, ref_name, %s)
+		WHERE scope = 'account'
+	`, tableName, tableName, recordColumns))
+	if err != nil {
+		logger.Printf("Error creating index (%s_account_scope_record_idx): %v\n", tableName, err)
+		return err
+	}
+
+	// Add a unique index on the account_id, ref and record keys, where scope is global.
+	err = exec(fmt.Sprintf(`
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_global_scope_record_idx
+		ON %s (account_id, config_reference_kind, ref_name, %s)
+		WHERE scope = 'global'
+	`, tableName, tableName, recordColumns))
+	if err != nil {
+		logger.Printf("Error creating index (%s_global_scope_record_idx): %v\n", tableName, err)
+		return err
+	}
+
+	// Add a unique index on the account_id, user_id, ref and record keys, where scope is user.
+	err = exec(fmt.Sprintf(`
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_user_scope_record_idx
+		ON %s (account_id, user_id, config_reference_kind, ref_name, %s)
+		WHERE scope = 'user'
+	`, tableName, tableName, recordColumns))
+	if err != nil {
+		logger.Printf("Error creating index (%s_user_scope_record_idx): %v\n", tableName, err)
+		return err
+	}
+
+	return nil
+}
+
+// The version each ref was materialized at in config_latest_records, the rows are only
+// used while it matches the ref
+type ConfigLatestRecordRefORM struct {
+	Scope     util.ScopeKind `json:"scope" gorm:"uniqueIndex:config_latest_record_ref_unique;not null"`
+	AccountId util.AccountId `json:"account_id" gorm:"uniqueIndex:config_latest_record_ref_unique;not null"`
+	UserId    *util.UserId   `json:"user_id" gorm:"uniqueIndex:config_latest_record_ref_unique;null"`
+
+	ConfigReferenceKind ConfigReferenceKind `json:"config_reference_kind" gorm:"uniqueIndex:config_latest_record_ref_unique;not null"`
+	RefName             string              `json:"ref_name" gorm:"uniqueIndex:config_latest_record_ref_unique;not null;default:''"`
+
+	VersionHash util.ConfigVersionHash `json:"version_hash" gorm:"index;not null"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+}
+
+func (c *ConfigLatestRecordRefORM) TableName() string {
+	return "config_latest_record_refs"
+}
+
 type ConfigReferenceORM struct {
 	Scope     util.ScopeKind `json:"scope" gorm:"uniqueIndex:ref_unique;not null"`
 	AccountId util.AccountId `json:"account_id" gorm:"uniqueIndex:ref_unique;not null"`
@@ -159,6 +536,9 @@ type ConfigReferenceORM struct {
 
 	ConfigReferenceKind ConfigReferenceKind `json:"reference_kind" gorm:"uniqueIndex:ref_unique;not null"`
 
+	// Empty for root and head, set for named refs (branches)
+	RefName string `json:"ref_name" gorm:"uniqueIndex:ref_unique;not null;default:''"`
+
 	VersionRef *ConfigVersionRef `json:"version_ref" gorm:"type:jsonb;not null"`
 }
 
@@ -177,27 +557,48 @@ func (c *ConfigReferenceORM) AddIndexes(ctx context.Context, tx *sql.Tx) error {
 		return err
 	}
 
-	// Add a unique index on the account_id and config_reference_kind,
+	// Drop the indexes from before refs were named, they would only
+	// allow a single branch per scope.
+	for _, idx := range []string{"account_scope_reference_kind_idx", "user_scope_reference_kind_idx"} {
+		if err := exec(fmt.Sprintf(`DROP INDEX IF EXISTS %s_%s`, tableName, idx)); err != nil {
+			logger.Printf("Error dropping index (%s_%s): %v\n", tableName, idx, err)
+			return err
+		}
+	}
+
+	// Add a unique index on the account_id, config_reference_kind and ref_name,
 	// where scope is account.
 	err := exec(fmt.Sprintf(`
-		CREATE UNIQUE INDEX IF NOT EXISTS %s_account_scope_reference_kind_idx
-		ON %s (account_id, config_reference_kind)
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_account_scope_reference_kind_name_idx
+		ON %s (account_id, config_reference_kind, ref_name)
 		WHERE scope = 'account'
 	`, tableName, tableName))
 	if err != nil {
-		logger.Printf("Error creating index (%s_account_scope_reference_kind_idx): %v\n", tableName, err)
+		logger.Printf("Error creating index (%s_account_scope_reference_kind_name_idx): %v\n", tableName, err)
+		return err
+	}
+
+	// Add a unique index on the account_id, config_reference_kind and ref_name,
+	// where scope is global.
+	err = exec(fmt.Sprintf(`
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_global_scope_reference_kind_name_idx
+		ON %s (account_id, config_reference_kind, ref_name)
+		WHERE scope = 'global'
+	`, tableName, tableName))
+	if err != nil {
+		logger.Printf("Error creating index (%s_global_scope_reference_kind_name_idx): %v\n", tableName, err)
 		return err
 	}
 
-	// Add a unique index on the account_id, user_id, and config_reference_kind,
+	// Add a unique index on the account_id, user_id, config_reference_kind and ref_name,
 	// where scope is user.
 	err = exec(fmt.Sprintf(`
-		CREATE UNIQUE INDEX IF NOT EXISTS %s_user_scope_reference_kind_idx
-		ON %s (account_id, user_id, config_reference_kind)
+		CREATE UNIQUE INDEX IF NOT EXISTS %s_user_scope_reference_kind_name_idx
+		ON %s (account_id, user_id, config_reference_kind, ref_name)
 		WHERE scope = 'user'
 	`, tableName, tableName))
 	if err != nil {
-		logger.Printf("Error creating index (%s_user_scope_reference_kind_idx): %v\n", tableName, err)
+		logger.Printf("Error creating index (%s_user_scope_reference_kind_name_idx): %v\n", tableName, err)
 		return err
 	}
 
@@ -215,11 +616,11 @@ func (c *ConfigReferenceORM) AddConstraints(ctx context.Context, tx *sql.Tx) err
 		return err
 	}
 
-	// Scope must be either account or user.
+	// Scope must be global, account or user.
 	err := exec(fmt.Sprintf(`
 		ALTER TABLE %s
 		ADD CONSTRAINT %s_valid_scope
-		CHECK (scope IN ('account', 'user'))
+		CHECK (scope IN ('global', 'account', 'user'))
 	`, tableName, tableName))
 	if err != nil {
 		logger.Printf("Error adding constraint (%s_valid_scope): %v\n", tableName, err)
@@ -256,23 +657,33 @@ func (c *ConfigReferenceORM) RemoveIndexes(ctx context.Context, tx *sql.Tx) erro
 
 	tableName := c.TableName()
 
-	// Remove the unique index on the account_id and config_reference_kind,
+	// Remove the unique index on the account_id, config_reference_kind and ref_name,
 	// where scope is account.
 	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
-		DROP INDEX IF EXISTS %s_account_scope_reference_kind_idx
+		DROP INDEX IF EXISTS %s_account_scope_reference_kind_name_idx
+	`, tableName))
+	if err != nil {
+		logger.Printf("Error dropping index (%s_account_scope_reference_kind_name_idx): %v\n", tableName, err)
+		return err
+	}
+
+	// Remove the unique index on the account_id, config_reference_kind and ref_name,
+	// where scope is global.
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		DROP INDEX IF EXISTS %s_global_scope_reference_kind_name_idx
 	`, tableName))
 	if err != nil {
-		logger.Printf("Error dropping index (%s_account_scope_reference_kind_idx): %v\n", tableName, err)
+		logger.Printf("Error dropping index (%s_global_scope_reference_kind_name_idx): %v\n", tableName, err)
 		return err
 	}
 
-	// Remove the unique index on the account_id, user_id, and config_reference_kind,
+	// Remove the unique index on the account_id, user_id, config_reference_kind and ref_name,
 	// where scope is user.
 	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
-		DROP INDEX IF EXISTS %s_user_scope_reference_kind_idx
+		DROP INDEX IF EXISTS %s_user_scope_reference_kind_name_idx
 	`, tableName))
 	if err != nil {
-		logger.Printf("Error dropping index (%s_user_scope_reference_kind_idx): %v\n", tableName, err)
+		logger.Printf("Error dropping index (%s_user_scope_reference_kind_name_idx): %v\n", tableName, err)
 		return err
 	}
 
@@ -284,7 +695,7 @@ func (c *ConfigReferenceORM) RemoveConstraints(ctx context.Context, tx *sql.Tx)
 
 	tableName := c.TableName()
 
-	// Remove the constraint ensuring that scope is either account or user.
+	// Remove the constraint ensuring that scope is global, account or user.
 	_, err := tx.ExecContext(ctx, fmt.Sprintf(`
 		ALTER TABLE %s
 		DROP CONSTRAINT %s_valid_scope
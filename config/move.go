@@ -0,0 +1,116 @@
+package config
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+type ConfigMoveResult struct {
+	// The last node written by the move, the ref points here once it commits
+	NodeMetadata *ConfigNodeMetadata  `json:"node_metadata"`
+	From         ConfigRecordMetadata `json:"from"`
+	To           ConfigRecordMetadata `json:"to"`
+}
+
+// Returns only the keys of the record metadata, with the kind filled in
+func recordKeyMetadata(recordMetadata *ConfigRecordMetadata) *ConfigRecordMetadata {
+	kind := recordMetadataKind(recordMetadata)
+	return &ConfigRecordMetadata{
+		CollectionKey: recordMetadata.CollectionKey,
+		ItemKey:       recordMetadata.ItemKey,
+		RecordKind:    &kind,
+	}
+}
+
+// MoveRecord renames a record to another collection and item key. The contents are
+// written under the new key on a node pointing back at the old key (moved_from), then
+// the old key gets a tombstone pointing at the new one (moved_to), in one transaction.
+// Record history queries follow moved_from across the rename. The options apply to
+// both writes, the expected version is checked against the old key.
+func (s *ConfigService) MoveRecord(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, from *ConfigRecordMetadata, to *ConfigRecordMetadata, options *SetRecordValuesOptions) (*ConfigMoveResult, error) {
+	if from == nil || from.CollectionKey == "" {
+		return nil, NewMissingRequiredParameter("from")
+	}
+	if to == nil || to.CollectionKey == "" {
+		return nil, NewMissingRequiredParameter("to")
+	}
+
+	if options == nil {
+		options = &SetRecordValuesOptions{}
+	}
+
+	fromKey, toKey := recordKeyMetadata(from), recordKeyMetadata(to)
+
+	if mergeRecordKey(*fromKey.RecordKind, fromKey.CollectionKey, fromKey.ItemKey) == mergeRecordKey(*toKey.RecordKind, toKey.CollectionKey, toKey.ItemKey) {
+		return nil, NewConfigSettingError(fmt.Errorf("cannot move record %s onto itself", fromKey.CollectionKey))
+	}
+
+	res := &ConfigMoveResult{
+		From: *fromKey,
+		To:   *toKey,
+	}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		var version *ConfigVersionRef
+		if options.RefName != "" {
+			branch, err := s.refService.GetBranch(ctx, tx, scope, accountId, userId, options.RefName)
+			if err != nil {
+				return err
+			}
+			version = branch.VersionRef
+		}
+
+		existing, err := s.GetLatestRecord(ctx, tx, scope, accountId, userId, nil, version, &ConfigRecordQuery{
+			RecordKind:    fromKey.RecordKind,
+			CollectionKey: &fromKey.CollectionKey,
+			ItemKey:       fromKey.ItemKey,
+		})
+		if err != nil {
+			return err
+		} else if existing == nil || existing.RecordContents == nil {
+			return NewRecordNotFound(fromKey.CollectionKey, fromKey.ItemKey)
+		}
+
+		target, err := s.GetLatestRecord(ctx, tx, scope, accountId, userId, nil, version, &ConfigRecordQuery{
+			RecordKind:    toKey.RecordKind,
+			CollectionKey: &toKey.CollectionKey,
+			ItemKey:       toKey.ItemKey,
+		})
+		if err != nil {
+			return err
+		} else if target != nil {
+			return NewRecordAlreadyExists(toKey.CollectionKey, toKey.ItemKey)
+		}
+
+		values := *existing.RecordContents
+
+		writeOptions := &SetRecordValuesOptions{
+			RefName:   options.RefName,
+			Note:      options.Note,
+			Trailers:  options.Trailers,
+			MovedFrom: fromKey,
+		}
+		if _, err := s.SetRecordValuesWithOptions(ctx, tx, scope, accountId, userId, *toKey.RecordKind, recordKeyMetadata(toKey), ValueSettingModeReplace, &values, writeOptions); err != nil {
+			return err
+		}
+
+		deleteOptions := &SetRecordValuesOptions{
+			RefName:             options.RefName,
+			Note:                options.Note,
+			Trailers:            options.Trailers,
+			ExpectedVersionHash: options.ExpectedVersionHash,
+			MovedTo:             toKey,
+		}
+		res.NodeMetadata, err = s.DeleteRecord(ctx, tx, scope, accountId, userId, *fromKey.RecordKind, recordKeyMetadata(fromKey), deleteOptions)
+		return err
+	})
+	if err != nil {
+		s.logger.Printf("MoveRecord: Error moving %s to %s: %v\n", from.CollectionKey, to.CollectionKey, err)
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -34,6 +34,9 @@ type ConfigNodeMetadata struct {
 	CommittedBy *util.UserId      `json:"committed_by" gorm:"index;type:text"`
 	VersionRef  ConfigVersionRef  `json:"version_ref" gorm:"type:jsonb;not null"`
 	ParentRef   *ConfigVersionRef `json:"parent_ref" gorm:"type:jsonb"`
+
+	// Set on merge nodes, the parents other than ParentRef
+	AdditionalParentRefs []ConfigVersionRef `json:"additional_parent_refs,omitempty" gorm:"type:jsonb"`
 }
 
 type ConfigNode struct {
@@ -83,7 +86,7 @@ func (c *ConfigNode) ParseNode() (interface{}, error) {
 	logger := util.NewLogger("ConfigNode.ParseNode", 0)
 
 	switch c.NodeMetadata.NodeKind {
-	case ConfigNodeKindEmpty:
+	case ConfigNodeKindEmpty, ConfigNodeKindTombstone:
 		return nil, nil
 	case ConfigNodeKindRecord:
 		record := &ConfigRecordObject{}
@@ -92,6 +95,13 @@ func (c *ConfigNode) ParseNode() (interface{}, error) {
 			return nil, err
 		}
 		return record, nil
+	case ConfigNodeKindBaseline:
+		baseline := &ConfigBaselineContents{}
+		if err := c.DecodeContents(baseline); err != nil {
+			logger.Printf("ParseNode: Error decoding existing node as baseline: %+v\n", err)
+			return nil, err
+		}
+		return baseline, nil
 	default:
 		return nil, fmt.Errorf("unsupported node kind: %v", c.NodeMetadata.NodeKind)
 	}
@@ -13,10 +13,21 @@ const (
 	ConfigNodeKindEmpty  ConfigNodeKind = "empty"
 	ConfigNodeKindData   ConfigNodeKind = "data"
 	ConfigNodeKindRecord ConfigNodeKind = "record"
+	// Joins two or more parents, the merged records are committed before it
+	ConfigNodeKindMerge ConfigNodeKind = "merge"
+	// Marks a record as deleted, the record contents are null
+	ConfigNodeKindTombstone ConfigNodeKind = "tombstone"
+	// Holds every record left when gc squashed the older history, parented on the empty root
+	ConfigNodeKindBaseline ConfigNodeKind = "baseline"
 	// ConfigNodeKindSchema            ConfigNodeKind = "schema"
 	// ConfigNodeKindSchemaAssociation ConfigNodeKind = "schema_association"
 )
 
+// Contents of a baseline node
+type ConfigBaselineContents struct {
+	Records []ConfigRecordObject `json:"records"`
+}
+
 type ConfigRecordNode struct {
 	RecordMetadata ConfigRecordMetadata `json:"record_metadata" gorm:"column:record_metadata;type:jsonb;not null"`
 	RecordContents util.Data            `json:"record_contents" gorm:"column:record_contents;type:jsonb"`
@@ -0,0 +1,371 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/tmzt/config-api/util"
+	"github.com/wI2L/jsondiff"
+	"gorm.io/gorm"
+)
+
+type ConfigPatchFormat string
+
+const (
+	// RFC 6902, a list of operations, the same format as the patches in the record history
+	ConfigPatchFormatJsonPatch ConfigPatchFormat = "json_patch"
+	// RFC 7396, an object merged into the record where null removes a key
+	ConfigPatchFormatMergePatch ConfigPatchFormat = "merge_patch"
+)
+
+// PatchRecordValues applies a JSON Patch or Merge Patch to the current contents of the
+// record (on options.RefName when set) and writes the result as a full replacement,
+// reading and writing in one transaction. The patch is applied to a copy, if any
+// operation fails (including a test operation) nothing is written.
+func (s *ConfigService) PatchRecordValues(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigRecordKind, recordMetadata *ConfigRecordMetadata, format ConfigPatchFormat, patch json.RawMessage, options *SetRecordValuesOptions) (*ConfigNodeMetadata, *util.Data, error) {
+	if recordMetadata == nil || recordMetadata.CollectionKey == "" {
+		return nil, nil, NewMissingRequiredParameter("collectionKey")
+	}
+
+	if options == nil {
+		options = &SetRecordValuesOptions{}
+	}
+
+	var nodeMetadata *ConfigNodeMetadata
+	var values *util.Data
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		var version *ConfigVersionRef
+		if options.RefName != "" {
+			branch, err := s.refService.GetBranch(ctx, tx, scope, accountId, userId, options.RefName)
+			if err != nil {
+				return err
+			}
+			version = branch.VersionRef
+		}
+
+		existing, err := s.GetLatestRecord(ctx, tx, scope, accountId, userId, nil, version, &ConfigRecordQuery{
+			RecordKind:    &kind,
+			CollectionKey: &recordMetadata.CollectionKey,
+			ItemKey:       recordMetadata.ItemKey,
+		})
+		if err != nil {
+			return err
+		} else if existing == nil || existing.RecordContents == nil {
+			return NewRecordNotFound(recordMetadata.CollectionKey, recordMetadata.ItemKey)
+		}
+
+		values, err = applyPatch(existing.RecordContents, format, patch)
+		if err != nil {
+			return err
+		}
+
+		nodeMetadata, err = s.SetRecordValuesWithOptions(ctx, tx, scope, accountId, userId, kind, recordMetadata, ValueSettingModeReplace, values, options)
+		return err
+	})
+	if err != nil {
+		s.logger.Printf("PatchRecordValues: Error patching %s: %v\n", recordMetadata.CollectionKey, err)
+		return nil, nil, err
+	}
+
+	return nodeMetadata, values, nil
+}
+
+// Returns the contents with the patch applied, the contents are not modified
+func applyPatch(contents *util.Data, format ConfigPatchFormat, patch json.RawMessage) (*util.Data, error) {
+	// A copy in the same form as the decoded patch values, so test compares like with like
+	doc, err := copyJsonValue(contents)
+	if err != nil {
+		return nil, fmt.Errorf("error copying record contents: %w", err)
+	}
+
+	switch format {
+	case ConfigPatchFormatJsonPatch:
+		ops := jsondiff.Patch{}
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return nil, NewConfigSettingError(fmt.Errorf("invalid JSON Patch: %w", err))
+		}
+
+		for i, op := range ops {
+			if doc, err = applyPatchOperation(doc, op); err != nil {
+				if _, ok := err.(*ErrConfigPatchTestFailed); ok {
+					return nil, NewConfigPatchTestFailed(i, op.Path)
+				}
+				return nil, NewConfigSettingError(fmt.Errorf("patch operation %d (%s %s): %w", i, op.Type, op.Path, err))
+			}
+		}
+	case ConfigPatchFormatMergePatch:
+		var mergePatch interface{}
+		if err := json.Unmarshal(patch, &mergePatch); err != nil {
+			return nil, NewConfigSettingError(fmt.Errorf("invalid Merge Patch: %w", err))
+		}
+		doc = applyMergePatch(doc, mergePatch)
+	default:
+		return nil, NewConfigSettingError(fmt.Errorf("unsupported patch format: %s", format))
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, NewConfigSettingError(fmt.Errorf("patched record contents must be an object"))
+	}
+
+	res := util.Data(obj)
+	return &res, nil
+}
+
+// RFC 7396, objects are merged key by key and null removes the key, anything else replaces
+func applyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = applyMergePatch(targetObj[key], value)
+		}
+	}
+
+	return targetObj
+}
+
+// Applies one RFC 6902 operation, returns the new document
+func applyPatchOperation(doc interface{}, op jsondiff.Operation) (interface{}, error) {
+	path, err := parseJsonPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Type {
+	case jsondiff.OperationAdd:
+		return addJsonPointer(doc, path, op.Value)
+	case jsondiff.OperationRemove:
+		doc, _, err := removeJsonPointer(doc, path)
+		return doc, err
+	case jsondiff.OperationReplace:
+		if _, err := getJsonPointer(doc, path); err != nil {
+			return nil, err
+		} else if len(path) == 0 {
+			return op.Value, nil
+		}
+		if doc, _, err = removeJsonPointer(doc, path); err != nil {
+			return nil, err
+		}
+		return addJsonPointer(doc, path, op.Value)
+	case jsondiff.OperationMove:
+		from, err := parseJsonPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.From == op.Path {
+			return doc, nil
+		} else if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("cannot move %s into itself", op.From)
+		}
+		doc, value, err := removeJsonPointer(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addJsonPointer(doc, path, value)
+	case jsondiff.OperationCopy:
+		from, err := parseJsonPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := getJsonPointer(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		copied, err := copyJsonValue(value)
+		if err != nil {
+			return nil, err
+		}
+		return addJsonPointer(doc, path, copied)
+	case jsondiff.OperationTest:
+		value, err := getJsonPointer(doc, path)
+		if err != nil || !reflect.DeepEqual(value, op.Value) {
+			return nil, &ErrConfigPatchTestFailed{Path: op.Path}
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op.Type)
+	}
+}
+
+// Returns a deep copy of the value as decoded from JSON
+func copyJsonValue(value interface{}) (interface{}, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var res interface{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Splits an RFC 6901 pointer into its unescaped tokens, "" is the whole document
+func parseJsonPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	} else if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+// Returns the array index of the token, "-" (one past the end) only when allowEnd
+func jsonPointerIndex(arr []interface{}, token string, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return len(arr), nil
+	}
+
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+
+	max := len(arr) - 1
+	if allowEnd {
+		max = len(arr)
+	}
+	if idx > max {
+		return 0, fmt.Errorf("array index %d out of range", idx)
+	}
+
+	return idx, nil
+}
+
+func getJsonPointer(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("no value at %q", token)
+			}
+			doc = value
+		case []interface{}:
+			idx, err := jsonPointerIndex(node, token, false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[idx]
+		default:
+			return nil, fmt.Errorf("no value at %q", token)
+		}
+	}
+
+	return doc, nil
+}
+
+// Calls fn with the parent of the last token and that token, fn returns the new parent.
+// The containers on the way are updated in place, except arrays which may be reallocated.
+func updateJsonPointerParent(doc interface{}, path []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	child, err := getJsonPointer(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+
+	child, err = updateJsonPointerParent(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		idx, _ := jsonPointerIndex(node, path[0], false)
+		node[idx] = child
+	}
+
+	return doc, nil
+}
+
+func addJsonPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateJsonPointerParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			idx, err := jsonPointerIndex(node, token, true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[idx+1:], node[idx:])
+			node[idx] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf("cannot add to a scalar at %q", token)
+		}
+	})
+}
+
+// Returns the new document and the removed value
+func removeJsonPointer(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole document")
+	}
+
+	var removed interface{}
+	doc, err := updateJsonPointerParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("no value at %q", token)
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			idx, err := jsonPointerIndex(node, token, false)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[idx]
+			return append(node[:idx], node[idx+1:]...), nil
+		default:
+			return nil, fmt.Errorf("no value at %q", token)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return doc, removed, nil
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/tmzt/config-api/util"
+)
+
+func mustDecodeData(t *testing.T, s string) *util.Data {
+	t.Helper()
+
+	data := util.Data{}
+	if err := json.Unmarshal([]byte(s), &data); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", s, err)
+	}
+	return &data
+}
+
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		format   ConfigPatchFormat
+		patch    string
+		// Expected contents, empty when the patch fails
+		want string
+		// Expected index of the failing test operation, -1 for none
+		wantTestFailed int
+	}{
+		{
+			name:           "test then replace",
+			contents:       `{"a": 1}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "test", "path": "/a", "value": 1}, {"op": "replace", "path": "/a", "value": 2}]`,
+			want:           `{"a": 2}`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "failing test",
+			contents:       `{"a": 1}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "replace", "path": "/a", "value": 2}, {"op": "test", "path": "/a", "value": 1}]`,
+			wantTestFailed: 1,
+		},
+		{
+			name:           "failing test of a missing path",
+			contents:       `{"a": 1}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "test", "path": "/b", "value": null}]`,
+			wantTestFailed: 0,
+		},
+		{
+			name:           "move to a sibling",
+			contents:       `{"a": {"x": 1}, "b": {}}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "move", "from": "/a", "path": "/b/a"}]`,
+			want:           `{"b": {"a": {"x": 1}}}`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "move into its own child",
+			contents:       `{"a": {"x": 1}}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "move", "from": "/a", "path": "/a/x"}]`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "move to the same path",
+			contents:       `{"a": 1}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "move", "from": "/a", "path": "/a"}]`,
+			want:           `{"a": 1}`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "add to the end of an array",
+			contents:       `{"arr": [1, 2]}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "add", "path": "/arr/-", "value": 3}]`,
+			want:           `{"arr": [1, 2, 3]}`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "insert into an array",
+			contents:       `{"arr": [1, 3]}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "add", "path": "/arr/1", "value": 2}, {"op": "add", "path": "/arr/3", "value": 4}]`,
+			want:           `{"arr": [1, 2, 3, 4]}`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "add past the end of an array",
+			contents:       `{"arr": [1, 2]}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "add", "path": "/arr/3", "value": 3}]`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "remove past the end of an array",
+			contents:       `{"arr": [1, 2]}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "remove", "path": "/arr/2"}]`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "replace the end of an array",
+			contents:       `{"arr": [1, 2]}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "replace", "path": "/arr/-", "value": 3}]`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "array index with a leading zero",
+			contents:       `{"arr": [1, 2]}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "remove", "path": "/arr/01"}]`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "escaped keys",
+			contents:       `{"a/b": 1, "c~d": 2}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "remove", "path": "/a~1b"}, {"op": "copy", "from": "/c~0d", "path": "/e"}]`,
+			want:           `{"c~d": 2, "e": 2}`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "replace the whole document with a scalar",
+			contents:       `{"a": 1}`,
+			format:         ConfigPatchFormatJsonPatch,
+			patch:          `[{"op": "replace", "path": "", "value": 1}]`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "merge patch null removes keys",
+			contents:       `{"a": 1, "o": {"x": 1, "y": 2}}`,
+			format:         ConfigPatchFormatMergePatch,
+			patch:          `{"a": null, "o": {"x": null, "z": 3}, "missing": null}`,
+			want:           `{"o": {"y": 2, "z": 3}}`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "merge patch replaces arrays",
+			contents:       `{"arr": [1, 2], "s": "x"}`,
+			format:         ConfigPatchFormatMergePatch,
+			patch:          `{"arr": [3], "s": {"k": null, "v": 1}}`,
+			want:           `{"arr": [3], "s": {"v": 1}}`,
+			wantTestFailed: -1,
+		},
+		{
+			name:           "merge patch that is not an object",
+			contents:       `{"a": 1}`,
+			format:         ConfigPatchFormatMergePatch,
+			patch:          `[1]`,
+			wantTestFailed: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contents := mustDecodeData(t, tt.contents)
+			original := mustDecodeData(t, tt.contents)
+
+			got, err := applyPatch(contents, tt.format, json.RawMessage(tt.patch))
+
+			if !reflect.DeepEqual(contents, original) {
+				t.Errorf("contents were modified: %v", *contents)
+			}
+
+			var testFailed *ErrConfigPatchTestFailed
+			var settingErr *ErrConfigSettingError
+			switch {
+			case tt.wantTestFailed >= 0:
+				if !errors.As(err, &testFailed) {
+					t.Fatalf("got %v, want a failed test operation", err)
+				} else if testFailed.Index != tt.wantTestFailed {
+					t.Errorf("failed test operation %d, want %d", testFailed.Index, tt.wantTestFailed)
+				}
+			case tt.want == "":
+				if !errors.As(err, &settingErr) {
+					t.Fatalf("got %v, want a setting error", err)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if want := mustDecodeData(t, tt.want); !reflect.DeepEqual(got, want) {
+					t.Errorf("got %s, want %s", util.ToJson(got), tt.want)
+				}
+			}
+		})
+	}
+}
@@ -160,6 +160,10 @@ type ConfigRecordMetadata struct {
 	CollectionKey util.ConfigCollectionKey `json:"record_collection_key"`
 	ItemKey       *util.ConfigItemKey      `json:"record_item_key"`
 	RecordKind    *ConfigRecordKind        `json:"record_kind"`
+
+	// Set on the nodes written when a record is moved to another key
+	MovedFrom *ConfigRecordMetadata `json:"moved_from,omitempty"`
+	MovedTo   *ConfigRecordMetadata `json:"moved_to,omitempty"`
 }
 
 func (m *ConfigRecordMetadata) AsRecordQuery() *ConfigRecordQuery {
@@ -195,11 +199,11 @@ func (q *ConfigRecordQuery) AsMetadata() *ConfigRecordMetadata {
 }
 
 func (q *ConfigRecordQuery) AsMatchFilter() *RecordMatchFilter {
-	// TODO: Support record_kind
 	return &RecordMatchFilter{
 		Scope:               q.Scope,
 		AccountId:           q.AccountId,
 		UserId:              q.UserId,
+		RecordKind:          q.RecordKind,
 		RecordId:            q.RecordId,
 		RecordCollectionKey: q.CollectionKey,
 		RecordItemKey:       q.ItemKey,
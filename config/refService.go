@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -36,23 +38,24 @@ type configRefCache struct {
 	AccountId  util.AccountId      `json:"account_id"`
 	UserId     util.UserId         `json:"user_id"`
 	Kind       ConfigReferenceKind `json:"config_ref_kind"`
+	RefName    string              `json:"ref_name"`
 	VersionRef *ConfigVersionRef   `json:"version_ref"`
 }
 
 func (c configRefCache) CacheKey() string {
-	return configRefCacheKey(c.Scope, c.AccountId, c.UserId, c.Kind)
+	return configRefCacheKey(c.Scope, c.AccountId, c.UserId, c.Kind, c.RefName)
 }
 
 func (c configRefCache) Ttl() time.Duration {
 	return 1 * time.Hour
 }
 
-func configRefCacheKey(scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigReferenceKind) string {
+func configRefCacheKey(scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigReferenceKind, name string) string {
 	userVal := string(userId)
 	if scope != util.ScopeKindUser {
 		userVal = ""
 	}
-	return fmt.Sprintf("config_api:config_ref:scope=%s:account_id=%s:user_id=%s:config_ref_kind=%s", scope, accountId, userVal, kind)
+	return fmt.Sprintf("config_api:config_ref:scope=%s:account_id=%s:user_id=%s:config_ref_kind=%s:ref_name=%s", scope, accountId, userVal, kind, name)
 }
 
 func (s *ConfigReferenceService) GetConfigReference(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigReferenceKind) (*configRefCache, error) {
@@ -171,7 +174,7 @@ JOIN config_nodes n ON (
 	(r.version_ref->>'config_version_hash' = n.node_metadata->'version_ref'->>'config_version_hash')
 	AND (r.scope = n.scope AND r.account_id = n.account_id AND %s)
 )
-WHERE r.scope = ? AND r.account_id = ? AND %s AND r.config_reference_kind = ?
+WHERE r.scope = ? AND r.account_id = ? AND %s AND r.config_reference_kind = ? AND r.ref_name = ''
 `
 
 func (s *ConfigReferenceService) createRecordQuery(scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigReferenceKind) string {
@@ -223,8 +226,8 @@ func (s *ConfigReferenceService) GetRecord(ctx context.Context, tx *gorm.DB, sco
 	return res, nil
 }
 
-func (s *ConfigReferenceService) upsertRecord(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigReferenceKind, ref *ConfigVersionRef) error {
-	s.logger.Printf("Upserting config reference (scope %s, account_id %s, user_id, %s kind: %s) -> %s\n", scope, accountId, userId, kind, ref.ConfigVersionHash)
+func (s *ConfigReferenceService) upsertRecord(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigReferenceKind, name string, ref *ConfigVersionRef) error {
+	s.logger.Printf("Upserting config reference (scope %s, account_id %s, user_id, %s kind: %s name: %s) -> %s\n", scope, accountId, userId, kind, name, ref.ConfigVersionHash)
 
 	ts := time.Now()
 
@@ -248,6 +251,7 @@ func (s *ConfigReferenceService) upsertRecord(ctx context.Context, tx *gorm.DB,
 		Scope:               scope,
 		AccountId:           accountId,
 		ConfigReferenceKind: kind,
+		RefName:             name,
 	}
 
 	if scope == util.ScopeKindUser {
@@ -288,12 +292,17 @@ func (s *ConfigReferenceService) upsertRecord(ctx context.Context, tx *gorm.DB,
 }
 
 func (s *ConfigReferenceService) SetConfigReference(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigReferenceKind, ref *ConfigVersionRef) error {
+	return s.SetNamedConfigReference(ctx, tx, scope, accountId, userId, kind, "", ref)
+}
+
+func (s *ConfigReferenceService) SetNamedConfigReference(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigReferenceKind, name string, ref *ConfigVersionRef) error {
 
 	cacheObj := configRefCache{
 		AccountId:  accountId,
 		Scope:      scope,
 		UserId:     userId,
 		Kind:       kind,
+		RefName:    name,
 		VersionRef: ref,
 	}
 
@@ -301,9 +310,389 @@ func (s *ConfigReferenceService) SetConfigReference(ctx context.Context, tx *gor
 		s.logger.Printf("Error saving cached config reference: %s\n", err)
 	}
 
-	if err := s.upsertRecord(ctx, tx, scope, accountId, userId, kind, ref); err != nil {
+	if err := s.upsertRecord(ctx, tx, scope, accountId, userId, kind, name, ref); err != nil {
 		s.logger.Printf("Error upserting config reference: %s\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// Returns the where clause and params matching refs (alias r) in the given scope
+func refScopeWhere(scope util.ScopeKind, accountId util.AccountId, userId util.UserId) (string, []interface{}) {
+	if scope == util.ScopeKindUser {
+		return "r.scope = ? AND r.account_id = ? AND r.user_id = ?", []interface{}{scope, accountId, userId}
+	}
+	return "r.scope = ? AND r.account_id = ? AND r.user_id IS NULL", []interface{}{scope, accountId}
+}
+
+const nodeMetadataQuery = `
+SELECT n.node_metadata
+FROM config_nodes n
+WHERE n.scope = $1 AND n.account_id = $2 AND (
+	CASE WHEN $1 = 'user' THEN n.user_id = $3 ELSE n.user_id IS NULL END
+)
+AND n.node_metadata->'version_ref'->>'config_version_hash' = $4
+LIMIT 1
+`
+
+// Returns the version gc re-hashed $4 to in the newest run that rewrote it
+const rewrittenVersionQuery = `
+SELECT g.rewritten_refs->$4::TEXT
+FROM config_gc_runs g
+WHERE g.scope = $1 AND g.account_id = $2 AND (
+	CASE WHEN $1 = 'user' THEN g.user_id = $3 ELSE g.user_id IS NULL END
+)
+AND g.rewritten_refs->$4::TEXT IS NOT NULL
+ORDER BY g.ran_at DESC
+LIMIT 1
+`
+
+// RewrittenVersion returns the version a hash was re-linked to by gc, following later
+// runs that re-linked it again, or nil if gc never rewrote it. The records at both
+// versions are the same.
+func (s *ConfigReferenceService) RewrittenVersion(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, hash util.ConfigVersionHash) (*ConfigVersionRef, error) {
+	var res *ConfigVersionRef
+
+	seen := map[util.ConfigVersionHash]bool{}
+	for !seen[hash] {
+		seen[hash] = true
+
+		ref := &ConfigVersionRef{}
+		err := util.RawGetJsonValue(ctx, s.db, tx, ref, rewrittenVersionQuery, scope, accountId, userId, hash)
+		if err == gorm.ErrRecordNotFound || err == sql.ErrNoRows {
+			break
+		} else if err != nil {
+			s.logger.Printf("Error getting rewritten version (hash %s): %s\n", hash, err)
+			return nil, err
+		}
+
+		res = ref
+		hash = ref.ConfigVersionHash
+	}
+
+	return res, nil
+}
+
+// GetNodeMetadata returns the metadata of the node with the given hash, or ErrVersionNotFound.
+// A hash re-linked by gc returns the node it was re-linked to.
+func (s *ConfigReferenceService) GetNodeMetadata(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, hash util.ConfigVersionHash) (*ConfigNodeMetadata, error) {
+	res := &ConfigNodeMetadata{}
+
+	err := util.RawGetJsonValue(ctx, s.db, tx, res, nodeMetadataQuery, scope, accountId, userId, hash)
+	if err == gorm.ErrRecordNotFound || err == sql.ErrNoRows {
+		rewritten, rewrittenErr := s.RewrittenVersion(ctx, tx, scope, accountId, userId, hash)
+		if rewrittenErr != nil {
+			return nil, rewrittenErr
+		} else if rewritten == nil {
+			return nil, NewVersionNotFound(hash)
+		}
+
+		err = util.RawGetJsonValue(ctx, s.db, tx, res, nodeMetadataQuery, scope, accountId, userId, rewritten.ConfigVersionHash)
+		if err == gorm.ErrRecordNotFound || err == sql.ErrNoRows {
+			return nil, NewVersionNotFound(hash)
+		}
+	}
+	if err != nil {
+		s.logger.Printf("Error getting node metadata (hash %s): %s\n", hash, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Walks the first parents from the version at $4 and returns the newest node committed
+// at or before $5, the walk stops at the first such node
+const asOfVersionQuery = `
+WITH RECURSIVE walk AS (
+	SELECT 1 depth, n.node_metadata
+	FROM config_nodes n
+	WHERE n.scope = $1 AND n.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN n.user_id = $3 ELSE n.user_id IS NULL END
+	)
+	AND n.node_metadata->'version_ref'->>'config_version_hash' = $4
+	UNION ALL
+	SELECT w.depth + 1, n.node_metadata
+	FROM walk w
+	JOIN config_nodes n ON n.node_metadata->'version_ref'->>'config_version_hash' = w.node_metadata->'parent_ref'->>'config_version_hash'
+	WHERE n.scope = $1 AND n.account_id = $2 AND (
+		CASE WHEN $1 = 'user' THEN n.user_id = $3 ELSE n.user_id IS NULL END
+	)
+	AND (w.node_metadata->>'committed_at')::TIMESTAMPTZ > $5::TIMESTAMPTZ
+)
+SELECT w.node_metadata
+FROM walk w
+WHERE (w.node_metadata->>'committed_at')::TIMESTAMPTZ <= $5::TIMESTAMPTZ
+ORDER BY w.depth
+LIMIT 1
+`
+
+// ResolveVersionAsOf returns the newest version committed at or before asOf on the
+// history of version (head when nil), following first parents like the version chain
+func (s *ConfigReferenceService) ResolveVersionAsOf(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, version *ConfigVersionRef, asOf time.Time) (*ConfigVersionRef, error) {
+	if version == nil {
+		head, err := s.ResolveVersion(ctx, tx, scope, accountId, userId, string(ConfigReferenceKindHead))
+		if err != nil {
+			return nil, err
+		}
+		version = head
+	}
+
+	res := &ConfigNodeMetadata{}
+
+	err := util.RawGetJsonValue(ctx, s.db, tx, res, asOfVersionQuery, scope, accountId, userId, version.ConfigVersionHash, asOf)
+	if err == gorm.ErrRecordNotFound || err == sql.ErrNoRows {
+		return nil, NewVersionNotFoundAsOf(asOf)
+	} else if err != nil {
+		s.logger.Printf("Error resolving version as of %s (hash %s): %s\n", asOf, version.ConfigVersionHash, err)
+		return nil, err
+	}
+
+	return &res.VersionRef, nil
+}
+
+func (s *ConfigReferenceService) getNamedReference(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigReferenceKind, name string) (*ConfigReferenceORM, error) {
+	where, params := refScopeWhere(scope, accountId, userId)
+	params = append(params, kind, name)
+
+	res := &ConfigReferenceORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		return tx.Table("config_refs r").
+			Where(where+" AND r.config_reference_kind = ? AND r.ref_name = ?", params...).
+			First(res).Error
+	})
+	if err == gorm.ErrRecordNotFound || err == sql.ErrNoRows {
+		return nil, NewNamedReferenceNotFound(scope, accountId, &userId, kind, name)
+	} else if err != nil {
+		s.logger.Printf("Error getting config reference (kind: %s name: %s): %s\n", kind, name, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *ConfigReferenceService) listNamedReferences(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigReferenceKind) ([]*ConfigReferenceORM, error) {
+	where, params := refScopeWhere(scope, accountId, userId)
+	params = append(params, kind)
+
+	res := []*ConfigReferenceORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		return tx.Table("config_refs r").
+			Where(where+" AND r.config_reference_kind = ?", params...).
+			Order("r.ref_name").
+			Find(&res).Error
+	})
+	if err != nil {
+		s.logger.Printf("Error listing config references (kind: %s): %s\n", kind, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *ConfigReferenceService) deleteNamedReference(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigReferenceKind, name string) error {
+	where, params := refScopeWhere(scope, accountId, userId)
+	params = append(params, kind, name)
+
+	var rowsAffected int64
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		rs := tx.Table("config_refs r").
+			Where(where+" AND r.config_reference_kind = ? AND r.ref_name = ?", params...).
+			Delete(&ConfigReferenceORM{})
+		rowsAffected = rs.RowsAffected
+		return rs.Error
+	})
+	if err != nil {
+		s.logger.Printf("Error deleting config reference (kind: %s name: %s): %s\n", kind, name, err)
+		return err
+	} else if rowsAffected == 0 {
+		return NewNamedReferenceNotFound(scope, accountId, &userId, kind, name)
+	}
+
+	cacheObj := configRefCache{
+		Scope:     scope,
+		AccountId: accountId,
+		UserId:    userId,
+		Kind:      kind,
+		RefName:   name,
+	}
+	if err := s.rdb.Del(ctx, cacheObj.CacheKey()).Err(); err != nil {
+		s.logger.Printf("Error removing cached config reference: %s\n", err)
 	}
 
 	return nil
 }
+
+// Drops the cached copies of every ref in the scope, after the refs were changed outside of this service
+func (s *ConfigReferenceService) clearCachedReferences(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId) {
+	where, params := refScopeWhere(scope, accountId, userId)
+
+	refs := []*ConfigReferenceORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		return tx.Table("config_refs r").Where(where, params...).Find(&refs).Error
+	})
+	if err != nil {
+		s.logger.Printf("Error listing config references to clear from the cache: %s\n", err)
+		return
+	}
+
+	keys := []string{}
+	for _, ref := range refs {
+		keys = append(keys, configRefCacheKey(scope, accountId, userId, ref.ConfigReferenceKind, ref.RefName))
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	if err := s.rdb.Del(ctx, keys...).Err(); err != nil {
+		s.logger.Printf("Error removing cached config references: %s\n", err)
+	}
+}
+
+//
+// Branches
+//
+
+var refNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func validateRefName(name string) error {
+	if !refNamePattern.MatchString(name) || len(name) > 128 {
+		return NewInvalidReferenceName(name)
+	}
+	switch ConfigReferenceKind(name) {
+	case ConfigReferenceKindRoot, ConfigReferenceKindHead:
+		return NewInvalidReferenceName(name)
+	}
+	return nil
+}
+
+// Branches and tags share a namespace but live in different tables, so the check that a
+// name is free and the insert are serialized by a lock on the name held until the
+// transaction ends
+func lockRefName(tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, name string) error {
+	if scope != util.ScopeKindUser {
+		userId = ""
+	}
+	return tx.Exec(`SELECT pg_advisory_xact_lock(hashtext(?))`, fmt.Sprintf("config_ref:%s:%s:%s:%s", scope, accountId, userId, name)).Error
+}
+
+// CreateBranch creates a new named branch pointing at the given version
+func (s *ConfigReferenceService) CreateBranch(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, name string, from *ConfigVersionRef) (*ConfigReferenceORM, error) {
+	if err := validateRefName(name); err != nil {
+		return nil, err
+	}
+
+	if from == nil {
+		return nil, NewMissingRequiredParameter("from")
+	}
+
+	var res *ConfigReferenceORM
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		if err := lockRefName(tx, scope, accountId, userId, name); err != nil {
+			return err
+		}
+
+		existing, err := s.getNamedReference(ctx, tx, scope, accountId, userId, ConfigReferenceKindBranch, name)
+		if _, ok := err.(*ErrReferenceNotFound); !ok && err != nil {
+			return err
+		} else if existing != nil {
+			return NewReferenceAlreadyExists(ConfigReferenceKindBranch, name)
+		}
+
+		// Branches and tags share a namespace so names resolve unambiguously
+		tag, err := s.GetTag(ctx, tx, scope, accountId, userId, name)
+		if _, ok := err.(*ErrReferenceNotFound); !ok && err != nil {
+			return err
+		} else if tag != nil {
+			return NewReferenceAlreadyExists(ConfigReferenceKindTag, name)
+		}
+
+		// The branch must start at an existing node in this scope
+		nodeMetadata, err := s.GetNodeMetadata(ctx, tx, scope, accountId, userId, from.ConfigVersionHash)
+		if err != nil {
+			return err
+		}
+
+		versionRef := nodeMetadata.VersionRef
+		if err := s.SetNamedConfigReference(ctx, tx, scope, accountId, userId, ConfigReferenceKindBranch, name, &versionRef); err != nil {
+			return err
+		}
+
+		res, err = s.getNamedReference(ctx, tx, scope, accountId, userId, ConfigReferenceKindBranch, name)
+		return err
+	})
+	if err != nil {
+		s.logger.Printf("Error creating branch %s: %s\n", name, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *ConfigReferenceService) GetBranch(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, name string) (*ConfigReferenceORM, error) {
+	return s.getNamedReference(ctx, tx, scope, accountId, userId, ConfigReferenceKindBranch, name)
+}
+
+func (s *ConfigReferenceService) ListBranches(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId) ([]*ConfigReferenceORM, error) {
+	return s.listNamedReferences(ctx, tx, scope, accountId, userId, ConfigReferenceKindBranch)
+}
+
+func (s *ConfigReferenceService) DeleteBranch(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, name string) error {
+	return s.deleteNamedReference(ctx, tx, scope, accountId, userId, ConfigReferenceKindBranch, name)
+}
+
+// ResolveVersion resolves a ref name (head, root, stage/<stage>, a branch or tag name) or a version hash
+// to a version in the given scope. An empty name resolves to nil, meaning head. A hash re-linked by gc
+// resolves to its new version (see GetNodeMetadata).
+func (s *ConfigReferenceService) ResolveVersion(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, name string) (*ConfigVersionRef, error) {
+	switch ConfigReferenceKind(name) {
+	case "":
+		return nil, nil
+	case ConfigReferenceKindRoot, ConfigReferenceKindHead:
+		kind := ConfigReferenceKind(name)
+		ref, err := s.GetRecord(ctx, tx, scope, accountId, userId, kind)
+		if err != nil {
+			return nil, err
+		} else if ref == nil || ref.CurrentRef == nil {
+			return nil, NewReferenceNotFound(scope, accountId, &userId, kind)
+		}
+		return ref.CurrentRef, nil
+	}
+
+	if stage, ok := strings.CutPrefix(name, stageRefPrefix); ok {
+		ref, err := s.GetStage(ctx, tx, scope, accountId, userId, ConfigStageKind(stage))
+		if err != nil {
+			return nil, err
+		}
+		return ref.VersionRef, nil
+	}
+
+	branch, err := s.GetBranch(ctx, tx, scope, accountId, userId, name)
+	if _, ok := err.(*ErrReferenceNotFound); !ok && err != nil {
+		return nil, err
+	} else if branch != nil {
+		return branch.VersionRef, nil
+	}
+
+	tag, err := s.GetTag(ctx, tx, scope, accountId, userId, name)
+	if _, ok := err.(*ErrReferenceNotFound); !ok && err != nil {
+		return nil, err
+	} else if tag != nil {
+		return tag.VersionRef, nil
+	}
+
+	// Fall back to treating the name as a version hash
+	nodeMetadata, err := s.GetNodeMetadata(ctx, tx, scope, accountId, userId, util.ConfigVersionHash(name))
+	if _, ok := err.(*ErrVersionNotFound); ok {
+		return nil, NewNamedReferenceNotFound(scope, accountId, &userId, ConfigReferenceKindBranch, name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &nodeMetadata.VersionRef, nil
+}
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+type ConfigRevertOptions struct {
+	// Only revert this record, otherwise every record changed in the version is reverted
+	Record *ConfigRecordMetadata `json:"record"`
+	// Commit to the named branch instead of head
+	RefName string `json:"ref_name"`
+	// Resolve paths changed on the target since the version, as for a cherry-pick
+	Resolutions []ConfigMergeResolution `json:"resolutions"`
+	// Replaces the default "Revert <hash>" note
+	Note     string               `json:"note"`
+	Trailers ConfigCommitTrailers `json:"trailers"`
+}
+
+type ConfigRevertResult struct {
+	// The last node written by the revert
+	NodeMetadata    *ConfigNodeMetadata    `json:"node_metadata"`
+	RevertedRef     *ConfigVersionRef      `json:"reverted_ref"`
+	RevertedRecords []ConfigRecordMetadata `json:"reverted_records"`
+}
+
+// A record changed by a version, with its entries before and after the version
+type configRecordChange struct {
+	key    string
+	before *ConfigListEntry
+	after  *ConfigListEntry
+}
+
+// Returns the version the changes of a version are taken from: its parent, or for a
+// version written by a batch the parent of the first node of the batch, the same as
+// ConfigBatchResult.ParentRef
+func changeParentRef(nodeMetadata *ConfigNodeMetadata, getNodeMetadata func(hash util.ConfigVersionHash) (*ConfigNodeMetadata, error)) (*ConfigVersionRef, error) {
+	parentRef := nodeMetadata.ParentRef
+
+	batchId := nodeMetadata.VersionRef.BatchId
+	if batchId == nil {
+		return parentRef, nil
+	}
+
+	for parentRef != nil {
+		parent, err := getNodeMetadata(parentRef.ConfigVersionHash)
+		if err != nil {
+			return nil, err
+		}
+		if parent.VersionRef.BatchId == nil || *parent.VersionRef.BatchId != *batchId {
+			break
+		}
+		parentRef = parent.ParentRef
+	}
+
+	return parentRef, nil
+}
+
+// Returns the records that differ between before and after, sorted by key
+func diffRecordsByKey(beforeRecords, afterRecords map[string]*ConfigListEntry) []configRecordChange {
+	keys := []string{}
+	for key := range afterRecords {
+		keys = append(keys, key)
+	}
+	for key := range beforeRecords {
+		if _, ok := afterRecords[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []configRecordChange{}
+	for _, key := range keys {
+		before, after := beforeRecords[key], afterRecords[key]
+		if reflect.DeepEqual(entryContents(before), entryContents(after)) {
+			continue
+		}
+		changes = append(changes, configRecordChange{key: key, before: before, after: after})
+	}
+
+	return changes
+}
+
+// Returns the records changed by the version, against its parent or the parent of its
+// batch (see changeParentRef), sorted by key. A merge is diffed against the target from
+// before the merge, since the records it merged share its batch id.
+func (s *ConfigService) listRecordChanges(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, nodeMetadata *ConfigNodeMetadata) ([]configRecordChange, error) {
+	// Merges from before merged records shared a batch id with the merge node changed
+	// nothing against their first parent
+	if nodeMetadata.NodeKind == ConfigNodeKindMerge && nodeMetadata.VersionRef.BatchId == nil {
+		return nil, NewConfigSettingError(fmt.Errorf("merge %s does not record the records it merged, revert or cherry-pick the merged versions instead", nodeMetadata.VersionRef.ConfigVersionHash))
+	}
+
+	parentRef, err := changeParentRef(nodeMetadata, func(hash util.ConfigVersionHash) (*ConfigNodeMetadata, error) {
+		return s.refService.GetNodeMetadata(ctx, tx, scope, accountId, userId, hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	beforeRecords, err := s.listRecordsByKey(ctx, tx, scope, accountId, userId, parentRef)
+	if err != nil {
+		return nil, err
+	}
+	afterRecords, err := s.listRecordsByKey(ctx, tx, scope, accountId, userId, &nodeMetadata.VersionRef)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffRecordsByKey(beforeRecords, afterRecords), nil
+}
+
+// Applies the inverse of each change on top of the target records, three ways with the
+// version as the base, the record from before the version as theirs and the target as
+// ours, so paths changed on the target since the version are conflicts
+func revertRecordChanges(changes []configRecordChange, targetRecords map[string]*ConfigListEntry, resolutions map[string]map[string]ConfigMergeResolution) ([]*pickedRecordChange, []ConfigMergeConflict, error) {
+	reverted := []*pickedRecordChange{}
+	conflicts := []ConfigMergeConflict{}
+
+	for _, change := range changes {
+		record, recordConflicts, err := applyRecordChange(change.key, change.after, change.before, entryContents(targetRecords[change.key]), resolutions[change.key])
+		if err != nil {
+			return nil, nil, err
+		}
+		conflicts = append(conflicts, recordConflicts...)
+		reverted = append(reverted, record)
+	}
+
+	return reverted, conflicts, nil
+}
+
+// Revert writes new nodes restoring the record contents from before the version,
+// either for a single record or for every record the version changed. A version
+// written by a batch reverts the batch up to that version, a merge reverts the
+// records it merged. Paths changed on the target since the version are returned
+// as ErrConfigObjectSettingConflict unless resolved in options. History is never
+// rewritten, each node notes the reverted hash.
+func (s *ConfigService) Revert(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, version *ConfigVersionRef, options *ConfigRevertOptions) (*ConfigRevertResult, error) {
+	if version == nil {
+		return nil, NewMissingRequiredParameter("version")
+	}
+
+	if options == nil {
+		options = &ConfigRevertOptions{}
+	}
+
+	res := &ConfigRevertResult{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		nodeMetadata, err := s.refService.GetNodeMetadata(ctx, tx, scope, accountId, userId, version.ConfigVersionHash)
+		if err != nil {
+			return err
+		}
+		res.RevertedRef = &nodeMetadata.VersionRef
+
+		if nodeMetadata.ParentRef == nil {
+			return NewConfigSettingError(fmt.Errorf("cannot revert the root version %s", version.ConfigVersionHash))
+		}
+
+		target := options.RefName
+		if target == "" {
+			target = string(ConfigReferenceKindHead)
+		}
+		_, targetVersion, err := s.resolveMergeTarget(ctx, tx, scope, accountId, userId, target)
+		if err != nil {
+			return err
+		}
+
+		changes, err := s.listRecordChanges(ctx, tx, scope, accountId, userId, nodeMetadata)
+		if err != nil {
+			return err
+		}
+
+		if record := options.Record; record != nil {
+			kind := ConfigRecordKindKeyed
+			if record.RecordKind != nil {
+				kind = *record.RecordKind
+			} else if record.ItemKey != nil {
+				kind = ConfigRecordKindDocument
+			}
+			key := mergeRecordKey(kind, record.CollectionKey, record.ItemKey)
+
+			filtered := []configRecordChange{}
+			for _, change := range changes {
+				if change.key == key {
+					filtered = append(filtered, change)
+				}
+			}
+			if len(filtered) == 0 {
+				return NewConfigSettingError(fmt.Errorf("record %s was not changed in version %s", key, version.ConfigVersionHash))
+			}
+			changes = filtered
+		} else if len(changes) == 0 {
+			return NewConfigSettingError(fmt.Errorf("version %s does not change any records", version.ConfigVersionHash))
+		}
+
+		targetRecords, err := s.listRecordsByKey(ctx, tx, scope, accountId, userId, targetVersion)
+		if err != nil {
+			return err
+		}
+
+		resolutions := map[string]map[string]ConfigMergeResolution{}
+		for _, resolution := range options.Resolutions {
+			key := mergeRecordKey(resolution.RecordKind, resolution.RecordCollectionKey, resolution.RecordItemKey)
+			if resolutions[key] == nil {
+				resolutions[key] = map[string]ConfigMergeResolution{}
+			}
+			resolutions[key][resolution.Path] = resolution
+		}
+
+		reverted, conflicts, err := revertRecordChanges(changes, targetRecords, resolutions)
+		if err != nil {
+			return err
+		} else if len(conflicts) > 0 {
+			s.logger.Printf("Revert: %d conflicts reverting %s on %s\n", len(conflicts), version.ConfigVersionHash, target)
+			return NewConfigMergeConflict(conflicts)
+		}
+
+		setOptions := &SetRecordValuesOptions{
+			RefName:  options.RefName,
+			Note:     fmt.Sprintf("Revert %s", nodeMetadata.VersionRef.ConfigVersionHash),
+			Trailers: options.Trailers,
+		}
+		if options.Note != "" {
+			setOptions.Note = options.Note
+		}
+
+		for _, record := range reverted {
+			recordMetadata := &ConfigRecordMetadata{
+				CollectionKey: *record.entry.RecordCollectionKey,
+				ItemKey:       record.entry.RecordItemKey,
+				RecordKind:    record.entry.RecordKind,
+			}
+			if record.entry.RecordId != nil {
+				recordMetadata.RecordId = *record.entry.RecordId
+			}
+
+			// Reverting the creation of a record deletes it, reverting a deletion brings it back
+			if record.changed && record.deleted {
+				res.NodeMetadata, err = s.DeleteRecord(ctx, tx, scope, accountId, userId, *record.entry.RecordKind, recordMetadata, setOptions)
+			} else if record.changed {
+				values := util.Data(record.contents)
+				res.NodeMetadata, err = s.SetRecordValuesWithOptions(ctx, tx, scope, accountId, userId, *record.entry.RecordKind, recordMetadata, ValueSettingModeReplace, &values, setOptions)
+			}
+			if err != nil {
+				return err
+			}
+
+			res.RevertedRecords = append(res.RevertedRecords, *recordMetadata)
+		}
+
+		if res.NodeMetadata == nil {
+			res.NodeMetadata, err = s.refService.GetNodeMetadata(ctx, tx, scope, accountId, userId, targetVersion.ConfigVersionHash)
+		}
+		return err
+	})
+	if err != nil {
+		s.logger.Printf("Revert: Error reverting %s: %v\n", version.ConfigVersionHash, err)
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tmzt/config-api/util"
+)
+
+func testListEntry(t *testing.T, kind ConfigRecordKind, collectionKey string, contents string) *ConfigListEntry {
+	t.Helper()
+
+	key := util.ConfigCollectionKey(collectionKey)
+	return &ConfigListEntry{
+		RecordKind:          &kind,
+		RecordCollectionKey: &key,
+		RecordContents:      mustDecodeData(t, contents),
+	}
+}
+
+func TestChangeParentRef(t *testing.T) {
+	batchId := "batch-1"
+	otherBatchId := "batch-0"
+
+	nodes := map[util.ConfigVersionHash]*ConfigNodeMetadata{
+		"root": {VersionRef: ConfigVersionRef{ConfigVersionHash: "root"}},
+		"p":    {VersionRef: ConfigVersionRef{ConfigVersionHash: "p", BatchId: &otherBatchId}, ParentRef: &ConfigVersionRef{ConfigVersionHash: "root"}},
+		"b1":   {VersionRef: ConfigVersionRef{ConfigVersionHash: "b1", BatchId: &batchId}, ParentRef: &ConfigVersionRef{ConfigVersionHash: "p"}},
+		"b2":   {VersionRef: ConfigVersionRef{ConfigVersionHash: "b2", BatchId: &batchId}, ParentRef: &ConfigVersionRef{ConfigVersionHash: "b1"}},
+		"c":    {VersionRef: ConfigVersionRef{ConfigVersionHash: "c"}, ParentRef: &ConfigVersionRef{ConfigVersionHash: "b2"}},
+	}
+	getNodeMetadata := func(hash util.ConfigVersionHash) (*ConfigNodeMetadata, error) {
+		node, ok := nodes[hash]
+		if !ok {
+			t.Fatalf("unexpected lookup of %s", hash)
+		}
+		return node, nil
+	}
+
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{version: "c", want: "b2"},
+		{version: "b2", want: "p"},
+		{version: "b1", want: "p"},
+		{version: "p", want: "root"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := changeParentRef(nodes[util.ConfigVersionHash(tt.version)], getNodeMetadata)
+			if err != nil {
+				t.Fatalf("changeParentRef: %v", err)
+			} else if got == nil || string(got.ConfigVersionHash) != tt.want {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// A batch writing two records, diffed from the parent of the batch, reverts both
+func TestRevertBatchRestoresBothRecords(t *testing.T) {
+	before := map[string]*ConfigListEntry{
+		"keyed:a": testListEntry(t, ConfigRecordKindKeyed, "a", `{"v": 1}`),
+		"keyed:b": testListEntry(t, ConfigRecordKindKeyed, "b", `{"v": 1}`),
+		"keyed:c": testListEntry(t, ConfigRecordKindKeyed, "c", `{"v": 1}`),
+	}
+	after := map[string]*ConfigListEntry{
+		"keyed:a": testListEntry(t, ConfigRecordKindKeyed, "a", `{"v": 2}`),
+		"keyed:b": testListEntry(t, ConfigRecordKindKeyed, "b", `{"v": 2}`),
+		"keyed:c": testListEntry(t, ConfigRecordKindKeyed, "c", `{"v": 1}`),
+	}
+
+	changes := diffRecordsByKey(before, after)
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes, want 2", len(changes))
+	}
+
+	reverted, conflicts, err := revertRecordChanges(changes, after, nil)
+	if err != nil {
+		t.Fatalf("revertRecordChanges: %v", err)
+	} else if len(conflicts) > 0 {
+		t.Fatalf("unexpected conflicts: %+v", conflicts)
+	}
+
+	for i, key := range []string{"keyed:a", "keyed:b"} {
+		if changes[i].key != key {
+			t.Errorf("change %d is %s, want %s", i, changes[i].key, key)
+		} else if !reverted[i].changed {
+			t.Errorf("%s is not restored", key)
+		} else if got, want := interface{}(reverted[i].contents), entryContents(before[key]); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s would be restored to %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestRevertRecordChanges(t *testing.T) {
+	tests := []struct {
+		name      string
+		before    string
+		after     string
+		target    string
+		want      string
+		deleted   bool
+		conflicts int
+	}{
+		{
+			name:   "unchanged since the version",
+			before: `{"a": 1, "b": 1}`,
+			after:  `{"a": 2, "b": 1}`,
+			target: `{"a": 2, "b": 1}`,
+			want:   `{"a": 1, "b": 1}`,
+		},
+		{
+			name:   "other paths changed since the version are kept",
+			before: `{"a": 1, "b": 1}`,
+			after:  `{"a": 2, "b": 1}`,
+			target: `{"a": 2, "b": 3}`,
+			want:   `{"a": 1, "b": 3}`,
+		},
+		{
+			name:      "the reverted path changed since the version",
+			before:    `{"a": 1}`,
+			after:     `{"a": 2}`,
+			target:    `{"a": 3}`,
+			conflicts: 1,
+		},
+		{
+			name:    "reverting a creation deletes the record",
+			after:   `{"a": 1}`,
+			target:  `{"a": 1}`,
+			deleted: true,
+		},
+		{
+			name:   "reverting a deletion brings the record back",
+			before: `{"a": 1}`,
+			want:   `{"a": 1}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := func(contents string) *ConfigListEntry {
+				if contents == "" {
+					return nil
+				}
+				return testListEntry(t, ConfigRecordKindKeyed, "a", contents)
+			}
+
+			changes := []configRecordChange{{key: "keyed:a", before: entry(tt.before), after: entry(tt.after)}}
+			target := map[string]*ConfigListEntry{}
+			if tt.target != "" {
+				target["keyed:a"] = entry(tt.target)
+			}
+
+			reverted, conflicts, err := revertRecordChanges(changes, target, nil)
+			if err != nil {
+				t.Fatalf("revertRecordChanges: %v", err)
+			} else if len(conflicts) != tt.conflicts {
+				t.Fatalf("got %d conflicts, want %d: %+v", len(conflicts), tt.conflicts, conflicts)
+			} else if tt.conflicts > 0 {
+				return
+			}
+
+			got := reverted[0]
+			if got.deleted != tt.deleted {
+				t.Errorf("got deleted %v, want %v", got.deleted, tt.deleted)
+			}
+			if !tt.deleted {
+				if want := map[string]interface{}(*mustDecodeData(t, tt.want)); !reflect.DeepEqual(got.contents, want) {
+					t.Errorf("got %v, want %v", got.contents, want)
+				}
+			}
+		})
+	}
+}
@@ -75,17 +75,30 @@ func (s *ConfigSchemaService) GetSchema(ctx context.Context, tx *gorm.DB, schema
 		return nil, err
 	}
 
-	dagService := s.configService.GetConfigDagService()
-	node, err := dagService.GetExistingNode(ctx, nil, version.Scope, version.AccountId, version.UserId, ConfigRefQueryFunc(*version))
+	scope, accountId, userId, err := s.getSchemaQueryScope(schemaQuery)
 	if err != nil {
 		return nil, err
 	}
 
+	// Read the latest schema record as of the requested version
+	diffVersion, err := s.configService.GetLatestRecord(ctx, tx, scope, *accountId, *userId, nil, version, schemaQuery)
+	if err != nil {
+		return nil, err
+	} else if diffVersion == nil {
+		s.logger.Printf("GetSchema: No schema found for query: %s\n", util.ToJsonPretty(schemaQuery))
+		return nil, nil
+	}
+
 	schema := &ConfigSchemaRecord{}
-	if err := node.DecodeContents(schema); err != nil {
+	if err := diffVersion.DecodeRecordContents(schema); err != nil {
+		s.logger.Printf("Error decoding record contents: %v\n", err)
 		return nil, err
 	}
 
+	if diffVersion.ToVersion != nil {
+		schema.SchemaHash = &diffVersion.ToVersion.ConfigVersionHash
+	}
+
 	return schema, nil
 }
 
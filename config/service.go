@@ -2,9 +2,11 @@ package config
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/tmzt/config-api/util"
 	"gorm.io/gorm"
 )
@@ -15,6 +17,7 @@ type ConfigService struct {
 	rdb    *redis.Client
 
 	dagService *ConfigDagService
+	refService *ConfigReferenceService
 	// handleService        *configSettingHandleService
 	diffService          *ConfigDiffService
 	configContextService *ConfigContextService
@@ -42,6 +45,7 @@ func NewConfigService(db *gorm.DB, rdb *redis.Client, cacheService *util.CacheSe
 		rdb:    rdb,
 
 		dagService: dagService,
+		refService: refService,
 		// handleService:        handleService,
 		diffService:          diffService,
 		configContextService: configContextService,
@@ -69,6 +73,10 @@ func (s *ConfigService) GetConfigSchemaService() *ConfigSchemaService {
 	return s.configSchemaService
 }
 
+func (s *ConfigService) GetConfigReferenceService() *ConfigReferenceService {
+	return s.refService
+}
+
 func (s *ConfigService) CreateNode(scope util.ScopeKind, accountId util.AccountId, userId util.UserId, nodeKind ConfigNodeKind, data *util.Data, prevNode *ConfigNode) (*ConfigNode, error) {
 	return s.dagService.CreateNode(scope, accountId, userId, nodeKind, data, prevNode)
 }
@@ -84,8 +92,11 @@ type ConfigModelFunc func() ConfigRecordModel
 type ValueSettingMode string
 
 const (
-	ValueSettingModeReplace   ValueSettingMode = "replace_all"
+	ValueSettingModeReplace ValueSettingMode = "replace_all"
+	// Objects are merged key by key, arrays are replaced unless a merge strategy is given for them
 	ValueSettingModeDeepMerge ValueSettingMode = "deep_merge"
+	// Writes a tombstone node deleting the record, the values are ignored
+	ValueSettingModeTombstone ValueSettingMode = "tombstone"
 )
 
 // jsonb_build_object(
@@ -111,7 +122,28 @@ func (e *ConfigListEntry) String() string {
 	return fmt.Sprintf("[ConfigListEntry: %s/%s %+v]", e.RecordCollectionKey, e.RecordItemKey, e.NodeMetadata)
 }
 
-func (s *ConfigService) ListConfigs(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, recordQuery *ConfigRecordQuery) ([]*ConfigListEntry, error) {
+// ListConfigs returns the records at toVersion (head when nil). When a ref is at that
+// version the records are read from config_latest_records without their history,
+// otherwise the version chain is walked as in ListConfigsWithHistory.
+func (s *ConfigService) ListConfigs(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, toVersion *ConfigVersionRef, recordQuery *ConfigRecordQuery) ([]*ConfigListEntry, error) {
+	latest, ok, err := s.getLatestRecords(ctx, tx, scope, accountId, userId, toVersion, recordQuery)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return s.ListConfigsWithHistory(ctx, tx, scope, accountId, userId, toVersion, recordQuery)
+	}
+
+	entries := make([]*ConfigListEntry, 0, len(latest))
+	for _, entry := range latest {
+		entries = append(entries, &entry.ConfigListEntry)
+	}
+
+	return entries, nil
+}
+
+// ListConfigsWithHistory returns the records at toVersion (head when nil) with the
+// history of each record, walking the version chain
+func (s *ConfigService) ListConfigsWithHistory(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, toVersion *ConfigVersionRef, recordQuery *ConfigRecordQuery) ([]*ConfigListEntry, error) {
 	// return s.dagService.ListConfigs(ctx, tx, scope, accountId, userId, query)
 
 	query := `SELECT * FROM get_record_list($1, $2, $3, $4, $5, $6)`
@@ -121,8 +153,13 @@ func (s *ConfigService) ListConfigs(ctx context.Context, tx *gorm.DB, scope util
 		matchFilter = recordQuery.AsMatchFilter()
 	}
 
+	var toHash *string = nil
+	if toVersion != nil {
+		toHash = util.StrPtr(string(toVersion.ConfigVersionHash))
+	}
+
 	entries := []*ConfigListEntry{}
-	err := util.RawGetJsonValue(ctx, s.db, tx, &entries, query, scope, accountId, userId, nil, nil, matchFilter)
+	err := util.RawGetJsonValue(ctx, s.db, tx, &entries, query, scope, accountId, userId, nil, toHash, matchFilter)
 	if err != nil {
 		s.logger.Printf("ListConfigs: Error listing configs: %+v\n", err)
 		return nil, fmt.Errorf("error listing configs: %w", err)
@@ -194,22 +231,69 @@ func (s *ConfigService) ListConfigs(ctx context.Context, tx *gorm.DB, scope util
 // 	'refs', c.refs
 // ))
 
+// GetLatestRecord returns the newest record matching the query at toVersion (head when
+// nil), or nil if there is none. Like ListConfigs it reads config_latest_records when a
+// ref is at that version, without the history of the record.
 func (s *ConfigService) GetLatestRecord(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, fromVersion *ConfigVersionRef, toVersion *ConfigVersionRef, recordQuery *ConfigRecordQuery) (*ConfigDiffVersion, error) {
+	// Records older than fromVersion must not match, only the chain knows where they are
+	if fromVersion != nil {
+		return s.GetLatestRecordWithHistory(ctx, tx, scope, accountId, userId, fromVersion, toVersion, recordQuery)
+	}
+
+	latest, ok, err := s.getLatestRecords(ctx, tx, scope, accountId, userId, toVersion, recordQuery)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return s.GetLatestRecordWithHistory(ctx, tx, scope, accountId, userId, fromVersion, toVersion, recordQuery)
+	}
+
+	// The chain would return the most recently committed match
+	var newest *latestRecordEntry
+	for _, entry := range latest {
+		if entry.NodeMetadata == nil || entry.RecordMetadata == nil {
+			continue
+		}
+		if newest == nil || (entry.NodeMetadata.CommittedAt != nil && newest.NodeMetadata.CommittedAt != nil && entry.NodeMetadata.CommittedAt.After(*newest.NodeMetadata.CommittedAt)) {
+			newest = entry
+		}
+	}
+	if newest == nil {
+		return nil, nil
+	}
+
+	return &ConfigDiffVersion{
+		ToVersion: &ConfigVersionRef{
+			ConfigVersionHash: newest.NodeMetadata.VersionRef.ConfigVersionHash,
+		},
+		RecordMetadata: newest.RecordMetadata,
+		RecordContents: newest.RecordContents,
+	}, nil
+}
+
+// GetLatestRecordWithHistory is GetLatestRecord walking the version chain, the result
+// includes the history of the record
+func (s *ConfigService) GetLatestRecordWithHistory(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, fromVersion *ConfigVersionRef, toVersion *ConfigVersionRef, recordQuery *ConfigRecordQuery) (*ConfigDiffVersion, error) {
 	return s.diffService.GetLatestRecord(ctx, tx, scope, accountId, userId, fromVersion, toVersion, recordQuery)
 }
 
-func (s *ConfigService) mergeData(existingValues *util.Data, newValues *util.Data, mode ValueSettingMode) (*util.Data, error) {
+// Merges newValues into existingValues by the mode, a deep merge follows the strategies
+// the same way as jsonb_merge (see mergeRecordValues)
+func (s *ConfigService) mergeData(existingValues *util.Data, newValues *util.Data, mode ValueSettingMode, strategies ConfigMergeStrategies) (*util.Data, error) {
 	if existingValues == nil || mode == ValueSettingModeReplace {
 		return newValues, nil
 	}
 
 	switch mode {
 	case ValueSettingModeDeepMerge:
-		oldValues := *existingValues
-		mergedValues := oldValues
-		if err := util.MergeDataInto(&mergedValues, newValues); err != nil {
-			return nil, err
+		var right interface{}
+		if newValues != nil {
+			right = map[string]interface{}(*newValues)
+		}
+		merged, ok := mergeRecordValues(map[string]interface{}(*existingValues), right, strategies).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("merged values are not an object")
 		}
+		mergedValues := util.Data(merged)
 		return &mergedValues, nil
 	default:
 		return nil, fmt.Errorf("invalid merge mode: %s", mode)
@@ -290,7 +374,7 @@ func (s *ConfigService) mergeData(existingValues *util.Data, newValues *util.Dat
 // 	return newNode, nil
 // }
 
-// CREATE OR REPLACE FUNCTION set_record_values(param_scope TEXT, param_account_id TEXT, param_user_id TEXT, param_record_kind TEXT, param_collection_key TEXT, param_item_key TEXT, param_values JSONB, param_merge_mode TEXT DEFAULT 'deepmerge')
+// CREATE OR REPLACE FUNCTION set_record_values(param_scope TEXT, param_account_id TEXT, param_user_id TEXT, param_record_kind TEXT, param_collection_key TEXT, param_item_key TEXT, param_values JSONB, param_merge_mode TEXT DEFAULT 'deepmerge', param_options JSONB DEFAULT NULL)
 // RETURNS JSONB AS $func$
 
 type SetRecordValuesResult struct {
@@ -298,7 +382,43 @@ type SetRecordValuesResult struct {
 	NodeContents *util.Data         `json:"node_contents"`
 }
 
+// Passed to set_record_values as param_options
+type SetRecordValuesOptions struct {
+	// Commit to the named branch instead of head
+	RefName string `json:"ref_name,omitempty"`
+	// Stored as the note of the new version
+	Note     string               `json:"note,omitempty"`
+	Trailers ConfigCommitTrailers `json:"trailers,omitempty"`
+	// Fail with a conflict unless the record is still at this version, "*" matches any existing version
+	ExpectedVersionHash util.ConfigVersionHash `json:"expected_version_hash,omitempty"`
+	// The other key of a moved record, see MoveRecord
+	MovedFrom *ConfigRecordMetadata `json:"moved_from,omitempty"`
+	MovedTo   *ConfigRecordMetadata `json:"moved_to,omitempty"`
+	// Merge strategies of a deep_merge, on top of those declared by the collection's schema
+	MergeStrategies ConfigMergeStrategies `json:"merge_strategies,omitempty"`
+	// Leave the ref where it is, the caller moves it in the same transaction
+	DeferRefUpdate bool `json:"defer_ref_update,omitempty"`
+	// Write on top of this version instead of the tip of the ref, see CommitBatch
+	ParentVersionRef *ConfigVersionRef `json:"parent_version_ref,omitempty"`
+	// Stored as the batch_id of the new version
+	BatchId string `json:"batch_id,omitempty"`
+}
+
+// SQLSTATEs raised by set_record_values
+const (
+	// The expected version does not match
+	recordVersionConflictSqlState = "CV409"
+	// A tombstone was written for a record that does not exist
+	recordNotFoundSqlState = "CV404"
+	// The branch of ref_name does not exist
+	branchNotFoundSqlState = "CR404"
+)
+
 func (s *ConfigService) SetRecordValues(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigRecordKind, recordMetadata *ConfigRecordMetadata, mode ValueSettingMode, values *util.Data) (*ConfigNodeMetadata, error) {
+	return s.SetRecordValuesWithOptions(ctx, tx, scope, accountId, userId, kind, recordMetadata, mode, values, nil)
+}
+
+func (s *ConfigService) SetRecordValuesWithOptions(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigRecordKind, recordMetadata *ConfigRecordMetadata, mode ValueSettingMode, values *util.Data, options *SetRecordValuesOptions) (*ConfigNodeMetadata, error) {
 	if values == nil {
 		s.logger.Printf("SetRecordValues: Values cannot be nil\n")
 		return nil, fmt.Errorf("values cannot be nil")
@@ -318,12 +438,69 @@ func (s *ConfigService) SetRecordValues(ctx context.Context, tx *gorm.DB, scope
 		recordMetadata.RecordId = util.ConfigRecordId(util.NewUUID())
 	}
 
-	query := `SELECT * FROM set_record_values($1, $2, $3, $4, $5, $6, $7, $8)`
+	if options != nil && options.RefName != "" {
+		if err := validateRefName(options.RefName); err != nil {
+			return nil, err
+		}
+	}
+
+	if options != nil {
+		if err := validateCommitTrailers(options.Trailers); err != nil {
+			return nil, err
+		}
+		if err := validateMergeStrategies(options.MergeStrategies); err != nil {
+			return nil, err
+		}
+	}
+
+	if mode == ValueSettingModeDeepMerge {
+		// The caller's options are not modified
+		resolved := SetRecordValuesOptions{}
+		if options != nil {
+			resolved = *options
+		}
+
+		strategies, err := s.resolveMergeStrategies(ctx, tx, scope, accountId, userId, recordMetadata.CollectionKey, &resolved)
+		if err != nil {
+			return nil, err
+		}
+		resolved.MergeStrategies = strategies
+		options = &resolved
+	}
+
+	var expectedVersionHash util.ConfigVersionHash
+	if options != nil && options.ExpectedVersionHash != "" {
+		expectedVersionHash = options.ExpectedVersionHash
+
+		// A version re-linked by gc is the same version of the record under its new hash
+		rewritten, err := s.refService.RewrittenVersion(ctx, tx, scope, accountId, userId, expectedVersionHash)
+		if err != nil {
+			return nil, err
+		} else if rewritten != nil {
+			resolved := *options
+			resolved.ExpectedVersionHash = rewritten.ConfigVersionHash
+			options = &resolved
+		}
+	}
+
+	query := `SELECT * FROM set_record_values($1, $2, $3, $4, $5, $6, $7, $8, $9)`
 
 	result := &SetRecordValuesResult{}
 
-	err := util.RawGetJsonValue(ctx, s.db, tx, &result, query, scope, accountId, userId, kind, recordMetadata.CollectionKey, recordMetadata.ItemKey, values, mode)
-	if err != nil {
+	err := util.RawGetJsonValue(ctx, s.db, tx, &result, query, scope, accountId, userId, kind, recordMetadata.CollectionKey, recordMetadata.ItemKey, values, mode, options)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == recordVersionConflictSqlState && options != nil {
+		s.logger.Printf("SetRecordValues: Version conflict: %s\n", pgErr.Message)
+		var current *util.ConfigVersionHash
+		if pgErr.Detail != "" {
+			current = util.ConfigVersionHashPtr(util.ConfigVersionHash(pgErr.Detail))
+		}
+		return nil, NewConfigVersionConflict(expectedVersionHash, current)
+	} else if errors.As(err, &pgErr) && pgErr.Code == recordNotFoundSqlState {
+		return nil, NewRecordNotFound(recordMetadata.CollectionKey, recordMetadata.ItemKey)
+	} else if errors.As(err, &pgErr) && pgErr.Code == branchNotFoundSqlState {
+		return nil, NewNamedReferenceNotFound(scope, accountId, &userId, ConfigReferenceKindBranch, options.RefName)
+	} else if err != nil {
 		s.logger.Printf("SetRecordValues: Error setting record values: %+v\n", err)
 		return nil, fmt.Errorf("error setting record values: %w", err)
 	}
@@ -331,7 +508,13 @@ func (s *ConfigService) SetRecordValues(ctx context.Context, tx *gorm.DB, scope
 	return &result.NodeMetadata, nil
 }
 
-func (s *ConfigService) InsertRecord(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, recordMetadata *ConfigRecordMetadata, recordObject interface{}) (*ConfigNodeMetadata, error) {
+// DeleteRecord writes a tombstone node for the record, earlier versions stay readable
+// and a later write to the same keys brings the record back
+func (s *ConfigService) DeleteRecord(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, kind ConfigRecordKind, recordMetadata *ConfigRecordMetadata, options *SetRecordValuesOptions) (*ConfigNodeMetadata, error) {
+	return s.SetRecordValuesWithOptions(ctx, tx, scope, accountId, userId, kind, recordMetadata, ValueSettingModeTombstone, &util.Data{}, options)
+}
+
+func (s *ConfigService) InsertRecord(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, recordMetadata *ConfigRecordMetadata, recordObject interface{}, options *SetRecordValuesOptions) (*ConfigNodeMetadata, error) {
 
 	if recordMetadata == nil {
 		s.logger.Printf("InsertRecord: Record metadata cannot be nil\n")
@@ -354,7 +537,7 @@ func (s *ConfigService) InsertRecord(ctx context.Context, tx *gorm.DB, scope uti
 	k := ConfigRecordKindConfigSchema
 	v.RecordKind = &k
 
-	node, err := s.SetRecordValues(ctx, tx, scope, accountId, userId, ConfigRecordKindConfigSchema, &v, ValueSettingModeReplace, &dataMap)
+	node, err := s.SetRecordValuesWithOptions(ctx, tx, scope, accountId, userId, ConfigRecordKindConfigSchema, &v, ValueSettingModeReplace, &dataMap, options)
 	if err != nil {
 		s.logger.Printf("InsertRecord: Error setting record values: %+v\n", err)
 		return nil, fmt.Errorf("error inserting record: error inserting record values: %w", err)
@@ -0,0 +1,176 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+// Prefix accepted by ResolveVersion to read the version promoted to a stage, eg. stage/prod
+const stageRefPrefix = "stage/"
+
+type ConfigStagePromotionOptions struct {
+	Reason string `json:"reason"`
+	// Skip the stage order and forward only checks
+	Force bool `json:"force"`
+}
+
+func validateStage(stage ConfigStageKind) error {
+	if stage.Index() < 0 {
+		return NewInvalidReferenceName(string(stage))
+	}
+	return nil
+}
+
+// GetStage returns the ref for the version currently promoted to the stage
+func (s *ConfigReferenceService) GetStage(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, stage ConfigStageKind) (*ConfigReferenceORM, error) {
+	if err := validateStage(stage); err != nil {
+		return nil, err
+	}
+	return s.getNamedReference(ctx, tx, scope, accountId, userId, ConfigReferenceKindTaggedStage, string(stage))
+}
+
+// ListStages returns the refs of the stages that have been promoted to
+func (s *ConfigReferenceService) ListStages(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId) ([]*ConfigReferenceORM, error) {
+	return s.listNamedReferences(ctx, tx, scope, accountId, userId, ConfigReferenceKindTaggedStage)
+}
+
+// ListStagePromotions returns the promotion history of a stage, newest first
+func (s *ConfigReferenceService) ListStagePromotions(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, stage ConfigStageKind) ([]*ConfigStagePromotionORM, error) {
+	if err := validateStage(stage); err != nil {
+		return nil, err
+	}
+
+	where, params := tagScopeWhere(scope, accountId, userId)
+	params = append(params, stage)
+
+	res := []*ConfigStagePromotionORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		return tx.Table("config_stage_promotions t").
+			Where(where+" AND t.config_stage_kind = ?", params...).
+			Order("t.promoted_at DESC").
+			Find(&res).Error
+	})
+	if err != nil {
+		s.logger.Printf("Error listing promotions for stage %s: %s\n", stage, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// PromoteStage moves the stage ref to the given version. Unless forced, the version
+// must already be in the previous stage and must not move the stage backwards.
+func (s *ConfigService) PromoteStage(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, stage ConfigStageKind, version *ConfigVersionRef, options *ConfigStagePromotionOptions) (*ConfigStagePromotionORM, error) {
+	if err := validateStage(stage); err != nil {
+		return nil, err
+	}
+
+	if version == nil {
+		return nil, NewMissingRequiredParameter("version")
+	}
+
+	if options == nil {
+		options = &ConfigStagePromotionOptions{}
+	}
+
+	var res *ConfigStagePromotionORM
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		nodeMetadata, err := s.refService.GetNodeMetadata(ctx, tx, scope, accountId, userId, version.ConfigVersionHash)
+		if err != nil {
+			return err
+		}
+		versionRef := nodeMetadata.VersionRef
+
+		current, err := s.refService.GetStage(ctx, tx, scope, accountId, userId, stage)
+		if _, ok := err.(*ErrReferenceNotFound); !ok && err != nil {
+			return err
+		}
+
+		if !options.Force {
+			if err := s.checkPromotion(ctx, tx, scope, accountId, userId, stage, current, &versionRef); err != nil {
+				return err
+			}
+		}
+
+		if err := s.refService.SetNamedConfigReference(ctx, tx, scope, accountId, userId, ConfigReferenceKindTaggedStage, string(stage), &versionRef); err != nil {
+			return err
+		}
+
+		// The first version promoted to a stage becomes its root
+		if current == nil {
+			if err := s.refService.SetNamedConfigReference(ctx, tx, scope, accountId, userId, ConfigReferenceKindStageRoot, string(stage), &versionRef); err != nil {
+				return err
+			}
+		}
+
+		promotion := &ConfigStagePromotionORM{
+			Id:              util.NewUUID(),
+			Scope:           scope,
+			AccountId:       accountId,
+			ConfigStageKind: stage,
+			VersionRef:      &versionRef,
+			Reason:          options.Reason,
+			Forced:          options.Force,
+			PromotedBy:      userId,
+		}
+		if scope == util.ScopeKindUser {
+			promotion.UserId = &userId
+		}
+		if current != nil {
+			promotion.PreviousVersionRef = current.VersionRef
+		}
+
+		if err := tx.Create(promotion).Error; err != nil {
+			return err
+		}
+
+		res = promotion
+		return nil
+	})
+	if err != nil {
+		s.logger.Printf("Error promoting %s to stage %s: %s\n", version.ConfigVersionHash, stage, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Checks the version has been through the previous stage and is not behind the current version of the stage
+func (s *ConfigService) checkPromotion(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, stage ConfigStageKind, current *ConfigReferenceORM, version *ConfigVersionRef) error {
+	if idx := stage.Index(); idx > 0 {
+		previousStage := ConfigStageOrder[idx-1]
+
+		previous, err := s.refService.GetStage(ctx, tx, scope, accountId, userId, previousStage)
+		if _, ok := err.(*ErrReferenceNotFound); ok {
+			return NewStagePromotionNotAllowed(stage, fmt.Sprintf("nothing has been promoted to %s", previousStage))
+		} else if err != nil {
+			return err
+		}
+
+		ancestors, err := s.diffService.GetAncestorHashes(ctx, tx, scope, accountId, userId, previous.VersionRef)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(ancestors, version.ConfigVersionHash) {
+			return NewStagePromotionNotAllowed(stage, fmt.Sprintf("version %s has not been promoted to %s", version.ConfigVersionHash, previousStage))
+		}
+	}
+
+	if current != nil && current.VersionRef != nil {
+		ancestors, err := s.diffService.GetAncestorHashes(ctx, tx, scope, accountId, userId, version)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(ancestors, current.VersionRef.ConfigVersionHash) {
+			return NewStagePromotionNotAllowed(stage, fmt.Sprintf("version %s does not follow the current version %s", version.ConfigVersionHash, current.VersionRef.ConfigVersionHash))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/tmzt/config-api/util"
+	"gorm.io/gorm"
+)
+
+// Returns the where clause and params matching tags (alias t) in the given scope
+func tagScopeWhere(scope util.ScopeKind, accountId util.AccountId, userId util.UserId) (string, []interface{}) {
+	if scope == util.ScopeKindUser {
+		return "t.scope = ? AND t.account_id = ? AND t.user_id = ?", []interface{}{scope, accountId, userId}
+	}
+	return "t.scope = ? AND t.account_id = ? AND t.user_id IS NULL", []interface{}{scope, accountId}
+}
+
+func (s *ConfigReferenceService) GetTag(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, name string) (*ConfigTagORM, error) {
+	where, params := tagScopeWhere(scope, accountId, userId)
+	params = append(params, name)
+
+	res := &ConfigTagORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		return tx.Table("config_tags t").
+			Where(where+" AND t.tag = ?", params...).
+			First(res).Error
+	})
+	if err == gorm.ErrRecordNotFound || err == sql.ErrNoRows {
+		return nil, NewNamedReferenceNotFound(scope, accountId, &userId, ConfigReferenceKindTag, name)
+	} else if err != nil {
+		s.logger.Printf("Error getting tag %s: %s\n", name, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *ConfigReferenceService) ListTags(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId) ([]*ConfigTagORM, error) {
+	where, params := tagScopeWhere(scope, accountId, userId)
+	params = append(params, ConfigReferenceKindTag)
+
+	res := []*ConfigTagORM{}
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		return tx.Table("config_tags t").
+			Where(where+" AND (t.config_reference_kind = ? OR t.config_reference_kind IS NULL)", params...).
+			Order("t.tag").
+			Find(&res).Error
+	})
+	if err != nil {
+		s.logger.Printf("Error listing tags: %s\n", err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// CreateTag creates a tag pointing at an existing version, tag names share a namespace with branches
+func (s *ConfigReferenceService) CreateTag(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, name string, version *ConfigVersionRef) (*ConfigTagORM, error) {
+	if err := validateRefName(name); err != nil {
+		return nil, err
+	}
+
+	if version == nil {
+		return nil, NewMissingRequiredParameter("version")
+	}
+
+	var res *ConfigTagORM
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		if err := lockRefName(tx, scope, accountId, userId, name); err != nil {
+			return err
+		}
+
+		existing, err := s.GetTag(ctx, tx, scope, accountId, userId, name)
+		if _, ok := err.(*ErrReferenceNotFound); !ok && err != nil {
+			return err
+		} else if existing != nil {
+			return NewReferenceAlreadyExists(ConfigReferenceKindTag, name)
+		}
+
+		branch, err := s.GetBranch(ctx, tx, scope, accountId, userId, name)
+		if _, ok := err.(*ErrReferenceNotFound); !ok && err != nil {
+			return err
+		} else if branch != nil {
+			return NewReferenceAlreadyExists(ConfigReferenceKindBranch, name)
+		}
+
+		nodeMetadata, err := s.GetNodeMetadata(ctx, tx, scope, accountId, userId, version.ConfigVersionHash)
+		if err != nil {
+			return err
+		}
+
+		kind := ConfigReferenceKindTag
+
+		tag := &ConfigTagORM{
+			ConfigTagObject: ConfigTagObject{
+				Scope:               scope,
+				AccountId:           accountId,
+				Tag:                 name,
+				VersionRef:          &nodeMetadata.VersionRef,
+				ConfigReferenceKind: &kind,
+				CreatedBy:           userId,
+				UpdatedBy:           userId,
+			},
+		}
+		if scope == util.ScopeKindUser {
+			tag.UserId = &userId
+		}
+
+		if err := tx.Create(tag).Error; err != nil {
+			return err
+		}
+
+		res = tag
+		return nil
+	})
+	if err != nil {
+		s.logger.Printf("Error creating tag %s: %s\n", name, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// MoveTag points an existing tag at another version
+func (s *ConfigReferenceService) MoveTag(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, name string, version *ConfigVersionRef) (*ConfigTagORM, error) {
+	if version == nil {
+		return nil, NewMissingRequiredParameter("version")
+	}
+
+	var res *ConfigTagORM
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		tag, err := s.GetTag(ctx, tx, scope, accountId, userId, name)
+		if err != nil {
+			return err
+		}
+
+		nodeMetadata, err := s.GetNodeMetadata(ctx, tx, scope, accountId, userId, version.ConfigVersionHash)
+		if err != nil {
+			return err
+		}
+
+		where, params := tagScopeWhere(scope, accountId, userId)
+		params = append(params, name)
+
+		err = tx.Table("config_tags t").
+			Where(where+" AND t.tag = ?", params...).
+			Updates(map[string]interface{}{
+				"version_ref": nodeMetadata.VersionRef,
+				"updated_by":  userId,
+				"updated_at":  gorm.Expr("now()"),
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		tag.VersionRef = &nodeMetadata.VersionRef
+		tag.UpdatedBy = userId
+
+		res = tag
+		return nil
+	})
+	if err != nil {
+		s.logger.Printf("Error moving tag %s: %s\n", name, err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *ConfigReferenceService) DeleteTag(ctx context.Context, tx *gorm.DB, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, name string) error {
+	where, params := tagScopeWhere(scope, accountId, userId)
+	params = append(params, name)
+
+	var rowsAffected int64
+
+	err := util.WithTransaction(s.db, tx, func(tx *gorm.DB) error {
+		rs := tx.Table("config_tags t").
+			Where(where+" AND t.tag = ?", params...).
+			Delete(&ConfigTagORM{})
+		rowsAffected = rs.RowsAffected
+		return rs.Error
+	})
+	if err != nil {
+		s.logger.Printf("Error deleting tag %s: %s\n", name, err)
+		return err
+	} else if rowsAffected == 0 {
+		return NewNamedReferenceNotFound(scope, accountId, &userId, ConfigReferenceKindTag, name)
+	}
+
+	return nil
+}
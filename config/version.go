@@ -4,6 +4,8 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/tmzt/config-api/util"
@@ -20,6 +22,27 @@ type ConfigVersionRef struct {
 	CommittedAt       *time.Time             `json:"committed_at"`
 	CommittedBy       *util.UserId           `json:"committed_by" gorm:"index;null"`
 	Note              *string                `json:"note"`
+	// Structured lines attached to the note, like a change ticket or reason
+	Trailers ConfigCommitTrailers `json:"trailers,omitempty"`
+	// Shared by the versions written by one batch, the log shows them as one entry
+	BatchId *string `json:"batch_id,omitempty"`
+}
+
+// Commit trailers keyed by name, e.g. {"Ticket": "CHG-1234", "Reason": "rollout"}
+type ConfigCommitTrailers map[string]string
+
+var commitTrailerKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+func validateCommitTrailers(trailers ConfigCommitTrailers) error {
+	for key, value := range trailers {
+		if !commitTrailerKeyPattern.MatchString(key) || len(key) > 64 {
+			return NewConfigSettingError(fmt.Errorf("invalid trailer name %q", key))
+		}
+		if strings.ContainsAny(value, "\r\n") || len(value) > 1024 {
+			return NewConfigSettingError(fmt.Errorf("invalid value for trailer %s", key))
+		}
+	}
+	return nil
 }
 
 func (v ConfigVersionRef) String() string {
@@ -58,6 +58,12 @@ func AutoMigrate(db *gorm.DB) {
 		&config.ConfigVersionORM{},
 		&config.ConfigReferenceORM{},
 		&config.ConfigTagORM{},
+		&config.ConfigStagePromotionORM{},
+		&config.ConfigRetentionPolicyORM{},
+		&config.ConfigGcRunORM{},
+		&config.ConfigLatestRecordORM{},
+		&config.ConfigLatestRecordRefORM{},
+		&config.ConfigInheritanceORM{},
 
 		// &config.ConfigRecordORM{},
 		&config.ConfigNodeORM{},
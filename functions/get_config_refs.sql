@@ -15,7 +15,8 @@ BEGIN
         WITH refs AS (
             SELECT
                 r.version_ref,
-                r.config_reference_kind
+                r.config_reference_kind,
+                r.ref_name
             FROM config_refs r
             WHERE (
                 -- Scope and account match
@@ -29,11 +30,13 @@ BEGIN
                 r.version_ref->>'config_version_hash',
                 jsonb_build_object(
                     'version_ref', r.version_ref,
-                    'config_reference_kind', r.config_reference_kind
+                    'config_reference_kind', r.config_reference_kind,
+                    'ref_name', r.ref_name
                 )
             ),
+            -- Named refs (branches) are keyed as kind/name, eg. branch/feature
             'by_ref', jsonb_object_agg(
-                r.config_reference_kind,
+                CASE WHEN r.ref_name = '' THEN r.config_reference_kind ELSE r.config_reference_kind || '/' || r.ref_name END,
                 jsonb_build_object(
                     'version_ref', r.version_ref,
                     'config_version_hash', r.version_ref->>'config_version_hash'
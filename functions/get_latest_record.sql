@@ -21,7 +21,7 @@ DECLARE
 
 BEGIN
 
-    IF scope = 'user' THEN
+    IF param_scope = 'user' THEN
         match_filter := jsonb_set(match_filter, '{user_id}', to_jsonb(param_user_id));
     END IF;
 
@@ -66,8 +66,8 @@ BEGIN
         LIMIT 1
     );
 
-    -- If the result is NULL, return an empty record set
-    IF result IS NULL THEN
+    -- If the result is NULL or the record was deleted, return an empty record set
+    IF result IS NULL OR result->>'node_kind' = 'tombstone' THEN
         result := 'null'::JSONB;
     END IF;
 
@@ -17,6 +17,7 @@ CREATE TYPE repo_ref_result AS (
     account_id TEXT,
     user_id TEXT,
     config_reference_kind TEXT,
+    ref_name TEXT,
     version_ref JSONB
 );
 
@@ -42,10 +43,15 @@ BEGIN
     -- Create the pgcrypto extension if it doesn't exist
     CREATE EXTENSION IF NOT EXISTS pgcrypto;
 
-    IF param_scope NOT IN ('account', 'user') THEN
+    IF param_scope NOT IN ('global', 'account', 'user') THEN
         RAISE EXCEPTION 'Unsupported scope %', param_scope;
     END IF;
 
+    -- The global repository is kept under the platform account
+    IF param_scope = 'global' AND param_account_id IS DISTINCT FROM '00000000-0000-0000-0000-000000000000' THEN
+        RAISE EXCEPTION 'Global scope must use the platform account ID';
+    END IF;
+
     IF param_account_id IS NULL THEN
         RAISE EXCEPTION 'Account ID must be provided';
     END IF;
@@ -68,7 +74,7 @@ BEGIN
                 -- And user matches if it's a user scope
                 AND (CASE WHEN param_scope = 'user' THEN r.user_id = param_user_id ELSE r.user_id IS NULL END)
                 -- And it's the root
-                AND r.config_reference_kind = 'root'
+                AND r.config_reference_kind = 'root' AND r.ref_name = ''
             )
             LIMIT 1
     );
@@ -97,9 +103,9 @@ BEGIN
         RAISE NOTICE 'Inserted empty node into config_nodes: %', node_metadata;
 
         RETURN QUERY
-            SELECT param_scope scope, param_account_id account_id, record_user_id user_id, 'root' config_reference_kind, node_metadata->'version_ref'
+            SELECT param_scope scope, param_account_id account_id, record_user_id user_id, 'root' config_reference_kind, '' ref_name, node_metadata->'version_ref'
             UNION
-            SELECT param_scope scope, param_account_id account_id, record_user_id user_id, 'head' config_reference_kind, node_metadata->'version_ref';
+            SELECT param_scope scope, param_account_id account_id, record_user_id user_id, 'head' config_reference_kind, '' ref_name, node_metadata->'version_ref';
 
         -- RETURN QUERY
         --     SELECT 'root' config_reference_kind, version_ref->>'config_version_hash' version_hash
@@ -123,7 +129,7 @@ BEGIN
                 -- And user matches if it's a user scope
                 AND (CASE WHEN param_scope = 'user' THEN r.user_id = param_user_id ELSE r.user_id IS NULL END)
                 -- And it's the head
-                AND r.config_reference_kind = 'head'
+                AND r.config_reference_kind = 'head' AND r.ref_name = ''
             )
             LIMIT 1
     );
@@ -140,7 +146,7 @@ BEGIN
         RETURNING version_ref->>'config_version_hash' INTO head_hash;
     END IF;
 
-    RETURN QUERY SELECT r.scope, r.account_id, r.user_id, r.config_reference_kind, r.version_ref FROM config_refs r
+    RETURN QUERY SELECT r.scope, r.account_id, r.user_id, r.config_reference_kind, r.ref_name, r.version_ref FROM config_refs r
         WHERE r.scope = param_scope AND r.account_id = param_account_id AND
             (CASE WHEN param_scope = 'user' THEN r.user_id = param_user_id ELSE r.user_id IS NULL END);
 
@@ -24,17 +24,23 @@ BEGIN
         SELECT value entry FROM jsonb_array_elements(versions)
       ),
       records AS (
+        -- Keep the newest entry for each record, the chain starts at to_version
         SELECT DISTINCT ON(record_kind, record_collection_key, record_item_key)
           -- entry->'row_number' row_number,
           entry->'record_metadata'->'record_kind' record_kind,
           -- entry->'record_metadata'->'record_id' record_id,
           entry->'record_metadata'->'record_collection_key' record_collection_key,
           entry->'record_metadata'->'record_item_key' record_item_key,
-          -- entry->'node_metadata' node_metadata,
+          entry->'record_metadata' record_metadata,
+          entry->'node_metadata' node_metadata,
           entry->'record_contents' record_contents,
           entry->'record_history' record_history
         FROM entries
-        GROUP BY record_kind, record_collection_key, record_item_key, record_contents, record_history
+        -- Skip nodes without a record (empty and merge nodes)
+        WHERE jsonb_typeof(entry->'record_metadata') = 'object'
+          -- Entries matched under the previous key of a moved record belong to that key
+          AND record_matches_filter(entry->'record_metadata', param_match_filter)
+        ORDER BY record_kind, record_collection_key, record_item_key, (entry->>'row_number')::BIGINT
       )
       -- objects AS (
       -- SELECT DISTINCT ON(record_kind, record_collection_key, record_item_key)
@@ -46,12 +52,15 @@ BEGIN
             -- 'record_id', record_id,
             'record_collection_key', record_collection_key,
             'record_item_key', record_item_key,
-            -- 'node_metadata', node_metadata,
+            'record_metadata', record_metadata,
+            'node_metadata', node_metadata,
             'record_contents', record_contents,
             'record_history', record_history
           )
         ) record
       FROM records
+      -- Deleted records are hidden, their history is still in the chain
+      WHERE node_metadata->>'node_kind' IS DISTINCT FROM 'tombstone'
       -- GROUP BY record_kind, record_collection_key, record_item_key, record_contents, record_history
   );
 
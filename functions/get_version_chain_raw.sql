@@ -1,4 +1,58 @@
 
+-- Returns true if the record metadata matches the filter, a NULL filter matches everything
+CREATE OR REPLACE FUNCTION record_matches_filter(param_record_metadata JSONB, param_record_match_filter JSONB)
+RETURNS BOOL
+LANGUAGE sql
+IMMUTABLE
+AS $$
+	SELECT CASE
+		WHEN (param_record_match_filter IS NULL) THEN true ELSE (
+			CASE WHEN (param_record_match_filter->>'record_kind' IS NULL) THEN true ELSE (param_record_metadata->>'record_kind' = param_record_match_filter->>'record_kind') END
+			AND
+			CASE WHEN (param_record_match_filter->>'record_id' IS NULL) THEN true ELSE (param_record_metadata->>'record_id' = param_record_match_filter->>'record_id') END
+			AND
+			CASE
+				WHEN param_record_metadata->>'record_kind' = 'keyed' THEN (
+					CASE WHEN (param_record_match_filter->>'record_collection_key' IS NULL) THEN true ELSE (param_record_metadata->>'record_collection_key' = param_record_match_filter->>'record_collection_key') END
+				)
+				WHEN param_record_metadata->>'record_kind' IN ('document', 'config_schema') THEN (
+					CASE
+						WHEN (param_record_match_filter->>'record_collection_key' IS NULL) THEN true ELSE (param_record_metadata->>'record_collection_key' = param_record_match_filter->>'record_collection_key')
+					END
+					AND
+					CASE
+						WHEN (param_record_match_filter->>'record_item_key' IS NULL) THEN true ELSE (param_record_metadata->>'record_item_key' = param_record_match_filter->>'record_item_key')
+					END
+				)
+				ELSE false
+			END
+		)
+	END
+$$;
+
+-- Returns the filter to use for the nodes before a matching node. When the node moved
+-- the record from another key, older nodes are matched against the previous key so the
+-- history follows the record across the rename. Filters not naming a collection key
+-- already match both keys and are returned unchanged.
+CREATE OR REPLACE FUNCTION follow_record_move(param_record_match_filter JSONB, param_record_metadata JSONB, param_record_match BOOL)
+RETURNS JSONB
+LANGUAGE sql
+IMMUTABLE
+AS $$
+	SELECT CASE
+		WHEN param_record_match
+			AND param_record_match_filter->>'record_collection_key' IS NOT NULL
+			AND jsonb_typeof(param_record_metadata->'moved_from') = 'object'
+		THEN (param_record_match_filter - 'record_kind' - 'record_item_key' - 'record_id')
+			|| jsonb_strip_nulls(jsonb_build_object(
+				'record_kind', param_record_metadata->'moved_from'->'record_kind',
+				'record_collection_key', param_record_metadata->'moved_from'->'record_collection_key',
+				'record_item_key', param_record_metadata->'moved_from'->'record_item_key'
+			))
+		ELSE param_record_match_filter
+	END
+$$;
+
 CREATE OR REPLACE FUNCTION get_version_chain_raw(param_scope TEXT, param_account_id TEXT, param_user_id TEXT, param_from_version TEXT, param_to_version TEXT, param_record_match_filter JSONB) --  DEFAULT '{}'::record_match_filter
 RETURNS TABLE (row_number BIGINT, cur_hash TEXT, parent_hash TEXT, node_kind TEXT, node_metadata JSONB, node_contents JSONB, record_metadata JSONB, record_contents JSONB, record_match BOOL, is_matching BOOL, refs JSONB)
 -- RETURNS SETOF version_chain_entry
@@ -59,7 +113,9 @@ BEGIN
 	RETURN QUERY
 		WITH RECURSIVE version_chain AS (
 			-- Base case, starting with ToVersion
-			SELECT NULL rn, tn.node_metadata->'version_ref'->>'config_version_hash' cur_hash, NULL parent_hash, (tn.node_metadata->>'node_kind') node_kind, tn.node_metadata, (tn.node_contents) node_contents, (tn.node_contents->'record_metadata') record_metadata, (tn.node_contents->'record_contents') record_contents, FALSE record_match
+			SELECT NULL rn, tn.node_metadata->'version_ref'->>'config_version_hash' cur_hash, NULL parent_hash, (tn.node_metadata->>'node_kind') node_kind, tn.node_metadata, (tn.node_contents) node_contents, (tn.node_contents->'record_metadata') record_metadata, (tn.node_contents->'record_contents') record_contents,
+					record_matches_filter(tn.node_contents->'record_metadata', param_record_match_filter) record_match,
+					param_record_match_filter track_filter
 				FROM config_nodes tn
 				WHERE (
 					-- Scope and account match
@@ -71,12 +127,24 @@ BEGIN
 					AND tn.node_metadata->'version_ref'->>'config_version_hash' = to_version
 				)
 			UNION
-			-- Recursive case, going up the chain
-			SELECT NULL rn, n.node_metadata->'version_ref'->>'config_version_hash' cur_hash, n.node_metadata->'parent_ref'->>'config_version_hash' parent_hash, (n.node_metadata->>'node_kind') node_kind, n.node_metadata, n.node_contents, (n.node_contents->'record_metadata') record_metadata, (n.node_contents->'record_contents') record_contents, FALSE record_match
+			-- Recursive case, going up the chain. The filter is carried down so it can
+			-- switch to the previous key of a moved record.
+			SELECT NULL rn, n.node_metadata->'version_ref'->>'config_version_hash' cur_hash, n.node_metadata->'parent_ref'->>'config_version_hash' parent_hash, (n.node_metadata->>'node_kind') node_kind, n.node_metadata, n.node_contents, (n.node_contents->'record_metadata') record_metadata, (n.node_contents->'record_contents') record_contents,
+					record_matches_filter(n.node_contents->'record_metadata', follow_record_move(vc.track_filter, vc.record_metadata, vc.record_match)) record_match,
+					follow_record_move(vc.track_filter, vc.record_metadata, vc.record_match) track_filter
 				FROM config_nodes n
 				JOIN version_chain vc ON (
 					-- Join on the parent of the previous node
-					(n.node_metadata->'version_ref'->>'config_version_hash' = vc.node_metadata->'parent_ref'->>'config_version_hash')
+					(
+						n.node_metadata->'version_ref'->>'config_version_hash' = vc.node_metadata->'parent_ref'->>'config_version_hash'
+						-- Follow the other parents of merge nodes when all_parents is set, reads
+						-- only follow the first parent since merged records are committed on it
+						OR (
+							COALESCE(param_record_match_filter->'all_parents', 'false'::JSONB) = 'true'::JSONB
+							AND jsonb_typeof(vc.node_metadata->'additional_parent_refs') = 'array'
+							AND vc.node_metadata->'additional_parent_refs' @> jsonb_build_array(jsonb_build_object('config_version_hash', n.node_metadata->'version_ref'->>'config_version_hash'))
+						)
+					)
 					AND (
 						-- Scope and account match
 						(n.scope = param_scope AND n.account_id = param_account_id)
@@ -84,62 +152,33 @@ BEGIN
 						-- User matches if it's a user scope
 						(CASE WHEN param_scope = 'user' THEN n.user_id = param_user_id ELSE n.user_id IS NULL END)
 					)
-					-- And we haven't reached the root (FromVersion) yet
-					-- AND n.node_metadata->'current_ref'->>'config_version_hash' != from_version
+					-- And we haven't reached the root (FromVersion) yet, the FromVersion itself is excluded
+					AND n.node_metadata->'version_ref'->>'config_version_hash' IS DISTINCT FROM from_version
 					AND (n.node_metadata->>'node_kind' != 'empty' AND n.node_metadata->'parent_ref' IS NOT NULL)
 				)
 		),
 
 		row_numbers AS (
-			SELECT ROW_NUMBER() OVER() rn, vc.cur_hash, vc.parent_hash, vc.node_kind, vc.node_metadata, vc.node_contents, vc.record_metadata, vc.record_contents, vc.record_match
+			-- Each record of a baseline node (left by gc) becomes its own row, shaped like a record node
+			SELECT ROW_NUMBER() OVER() rn, vc.cur_hash, vc.parent_hash, vc.node_kind, vc.node_metadata,
+					COALESCE(br.value, vc.node_contents) node_contents,
+					COALESCE(br.value->'record_metadata', vc.record_metadata) record_metadata,
+					COALESCE(br.value->'record_contents', vc.record_contents) record_contents,
+					(CASE WHEN br.value IS NULL THEN vc.record_match ELSE record_matches_filter(br.value->'record_metadata', vc.track_filter) END) record_match
 			FROM version_chain vc
+			LEFT JOIN LATERAL jsonb_array_elements(CASE WHEN vc.node_kind = 'baseline' THEN vc.node_contents->'records' END) br ON true
 		),
 
 		match_filter AS (
 
-			SELECT
-					fvc.rn, fvc.cur_hash, fvc.parent_hash, fvc.node_kind, fvc.node_metadata, fvc.node_contents, fvc.record_metadata, fvc.record_contents,
-
-					-- If we have a filter, we'll check if the current node matches
-					CASE
-						WHEN (param_record_match_filter IS NULL) THEN true ELSE (
-							CASE WHEN (param_record_match_filter->>'record_kind' IS NULL) THEN true ELSE (fvc.node_contents->'record_metadata'->>'record_kind' = param_record_match_filter->>'record_kind') END
-							AND
-							CASE WHEN (param_record_match_filter->>'record_id' IS NULL) THEN true ELSE (fvc.record_metadata->>'record_id' = param_record_match_filter->>'record_id') END
-							AND
-							CASE
-								WHEN fvc.node_contents->'record_metadata'->>'record_kind' = 'keyed' THEN (
-									CASE WHEN (param_record_match_filter->>'record_collection_key' IS NULL) THEN true ELSE (fvc.node_contents->'record_metadata'->>'record_collection_key' = param_record_match_filter->>'record_collection_key') END
-								)
-								WHEN fvc.node_contents->'record_metadata'->>'record_kind' = 'document' THEN (
-									CASE
-										WHEN (param_record_match_filter->>'record_collection_key' IS NULL) THEN true ELSE (fvc.node_contents->'record_metadata'->>'record_collection_key' = param_record_match_filter->>'record_collection_key')
-									END
-									AND
-									CASE
-										WHEN (param_record_match_filter->>'record_item_key' IS NULL) THEN true ELSE (fvc.node_contents->'record_metadata'->>'record_item_key' = param_record_match_filter->>'record_item_key')
-									END
-								)
-								WHEN fvc.node_contents->'record_metadata'->>'record_kind' = 'config_schema' THEN (
-									CASE
-										WHEN (param_record_match_filter->>'record_collection_key' IS NULL) THEN true ELSE (fvc.node_contents->'record_metadata'->>'record_collection_key' = param_record_match_filter->>'record_collection_key')
-									END
-									AND
-									CASE
-										WHEN (param_record_match_filter->>'record_item_index' IS NULL) THEN true ELSE (fvc.node_contents->'record_metadata'->>'record_item_key' = param_record_match_filter->>'record_item_key')
-									END
-								)
-								ELSE false
-							END
-						)
-					END record_match
+			-- record_match was computed while walking the chain
+			SELECT fvc.rn, fvc.cur_hash, fvc.parent_hash, fvc.node_kind, fvc.node_metadata, fvc.node_contents, fvc.record_metadata, fvc.record_contents, fvc.record_match
 				FROM row_numbers fvc
-				-- WHERE (CASE (param_record_match_filter IS NULL OR param_record_match_filter->'only_matching' IS NULL OR param_record_match_filter->'only_matching' = 'false'::JSONB) WHEN TRUE THEN TRUE ELSE fvc.record_match END)
 		), -- End match_filter cte
 		add_refs AS (
 			SELECT *,
 				(CASE WHEN (COALESCE(param_record_match_filter->'only_matching', 'false'::JSONB) = 'true'::JSONB) THEN fmf.record_match ELSE TRUE END) is_matching,
-				(SELECT jsonb_agg(cr.config_reference_kind)
+				(SELECT jsonb_agg(CASE WHEN cr.ref_name = '' THEN cr.config_reference_kind ELSE cr.config_reference_kind || '/' || cr.ref_name END)
 					FROM config_refs cr WHERE
 						(cr.scope = param_scope AND cr.account_id = param_account_id AND CASE WHEN param_scope = 'user' THEN cr.user_id = param_user_id ELSE cr.user_id IS NULL END)
 						AND
@@ -15,10 +15,15 @@ BEGIN
 
     -- Validate the parameters
 
-    IF param_scope NOT IN ('account', 'user') THEN
+    IF param_scope NOT IN ('global', 'account', 'user') THEN
         RAISE EXCEPTION 'Unsupported scope %', param_scope;
     END IF;
 
+    -- The global repository is kept under the platform account
+    IF param_scope = 'global' AND param_account_id IS DISTINCT FROM '00000000-0000-0000-0000-000000000000' THEN
+        RAISE EXCEPTION 'Global scope must use the platform account ID';
+    END IF;
+
     IF param_account_id IS NULL THEN
         RAISE EXCEPTION 'Account ID must be provided';
     END IF;
@@ -31,7 +36,7 @@ BEGIN
         record_user_id = NULL;
     END IF;
 
-    IF node_metadata->>'node_kind' NOT IN ('empty', 'data', 'record') THEN
+    IF node_metadata->>'node_kind' NOT IN ('empty', 'data', 'record', 'merge', 'tombstone', 'baseline') THEN
         RAISE EXCEPTION 'Unsupported node kind %', node_metadata->>'node_kind';
     END IF;
 
@@ -14,6 +14,7 @@ DECLARE
     version_hash TEXT;
 
     ref_kind TEXT;
+    update_ref_name TEXT;
 
     -- Constants
     EMPTY_HASH JSONB = '"44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"';
@@ -34,10 +35,15 @@ BEGIN
     RAISE NOTICE 'Node metadata -> version_ref: %', node_metadata->'version_ref';
     RAISE NOTICE 'Node metadata -> parent_ref: %', node_metadata->'parent_ref';
 
-    IF param_scope NOT IN ('account', 'user') THEN
+    IF param_scope NOT IN ('global', 'account', 'user') THEN
         RAISE EXCEPTION 'Unsupported scope %', param_scope;
     END IF;
 
+    -- The global repository is kept under the platform account
+    IF param_scope = 'global' AND param_account_id IS DISTINCT FROM '00000000-0000-0000-0000-000000000000' THEN
+        RAISE EXCEPTION 'Global scope must use the platform account ID';
+    END IF;
+
     IF param_account_id IS NULL THEN
         RAISE EXCEPTION 'Account ID must be provided';
     END IF;
@@ -66,7 +72,7 @@ BEGIN
     END IF;
 
     -- Node kind must be valid
-    IF node_metadata->>'node_kind' NOT IN ('empty', 'data', 'record') THEN
+    IF node_metadata->>'node_kind' NOT IN ('empty', 'data', 'record', 'merge', 'tombstone', 'baseline') THEN
         RAISE EXCEPTION 'Unsupported node kind %', node_metadata->>'node_kind';
     END IF;
 
@@ -100,6 +106,14 @@ BEGIN
             RAISE EXCEPTION 'Parent ref config_node_version must be provided for non-empty node kind';
         END IF;
 
+        -- Merge nodes must have at least one additional parent
+        IF node_metadata->>'node_kind' = 'merge' AND (
+            jsonb_typeof(node_metadata->'additional_parent_refs') IS DISTINCT FROM 'array'
+            OR jsonb_array_length(node_metadata->'additional_parent_refs') = 0
+        ) THEN
+            RAISE EXCEPTION 'Additional parent refs must be provided for merge node kind';
+        END IF;
+
     END IF;
 
     -- Build the version object if not provided
@@ -124,9 +138,22 @@ BEGIN
             node_version_ref = jsonb_set(node_version_ref, '{user_id}', 'null');
         END IF;
 
+        -- Callers pass the note, trailers and batch_id alongside the node metadata since they don't build the version_ref
+        IF node_metadata ? 'note' THEN
+            node_version_ref = jsonb_set(node_version_ref, '{note}', node_metadata->'note');
+        END IF;
+        IF jsonb_typeof(node_metadata->'trailers') = 'object' THEN
+            node_version_ref = jsonb_set(node_version_ref, '{trailers}', node_metadata->'trailers');
+        END IF;
+        IF node_metadata ? 'batch_id' THEN
+            node_version_ref = jsonb_set(node_version_ref, '{batch_id}', node_metadata->'batch_id');
+        END IF;
+
         node_metadata = jsonb_set(node_metadata, '{version_ref}', node_version_ref);
     END IF;
 
+    node_metadata = node_metadata - 'note' - 'trailers' - 'batch_id';
+
     -- Fill in the node metadata object
 
     -- Set the committed at/by fields
@@ -203,27 +230,43 @@ BEGIN
 
     -- Loop through the array
     FOR i IN 0..jsonb_array_length(param_update_refs) - 1 LOOP
-        -- Get the element
-        ref_kind = param_update_refs->>i;
+        -- Get the element, either a kind ("head") or a named ref ({"kind": "branch", "name": "feature"})
+        IF jsonb_typeof(param_update_refs->i) = 'object' THEN
+            ref_kind = param_update_refs->i->>'kind';
+            update_ref_name = COALESCE(param_update_refs->i->>'name', '');
+        ELSE
+            ref_kind = param_update_refs->>i;
+            update_ref_name = '';
+        END IF;
 
         -- Check if the element is a valid config_reference_kind
-        IF ref_kind NOT IN ('root', 'head') THEN
+        IF ref_kind NOT IN ('root', 'head', 'branch') THEN
             RAISE EXCEPTION 'Invalid config_reference_kind %', ref_kind;
         END IF;
 
-        RAISE NOTICE 'Updating ref_kind % -> %s', ref_kind, node_metadata->'version_ref'->>'config_version_hash';
+        -- Only branches are named
+        IF (ref_kind = 'branch') <> (update_ref_name <> '') THEN
+            RAISE EXCEPTION 'Invalid ref name % for config_reference_kind %', update_ref_name, ref_kind;
+        END IF;
+
+        RAISE NOTICE 'Updating ref_kind % (name %) -> %s', ref_kind, update_ref_name, node_metadata->'version_ref'->>'config_version_hash';
 
         -- Upsert the corresponding row in config_refs
 
         IF param_scope = 'user' THEN
-            INSERT INTO config_refs (scope, account_id, user_id, config_reference_kind, version_ref)
-            VALUES (param_scope, param_account_id, record_user_id, ref_kind, node_metadata->'version_ref')
-            ON CONFLICT (account_id, user_id, config_reference_kind) WHERE scope = 'user'
+            INSERT INTO config_refs (scope, account_id, user_id, config_reference_kind, ref_name, version_ref)
+            VALUES (param_scope, param_account_id, record_user_id, ref_kind, update_ref_name, node_metadata->'version_ref')
+            ON CONFLICT (account_id, user_id, config_reference_kind, ref_name) WHERE scope = 'user'
+            DO UPDATE SET version_ref = node_metadata->'version_ref';
+        ELSIF param_scope = 'global' THEN
+            INSERT INTO config_refs (scope, account_id, config_reference_kind, ref_name, version_ref)
+            VALUES (param_scope, param_account_id, ref_kind, update_ref_name, node_metadata->'version_ref')
+            ON CONFLICT (account_id, config_reference_kind, ref_name) WHERE scope = 'global'
             DO UPDATE SET version_ref = node_metadata->'version_ref';
         ELSE
-            INSERT INTO config_refs (scope, account_id, config_reference_kind, version_ref)
-            VALUES (param_scope, param_account_id, ref_kind, node_metadata->'version_ref')
-            ON CONFLICT (account_id, config_reference_kind) WHERE scope = 'account'
+            INSERT INTO config_refs (scope, account_id, config_reference_kind, ref_name, version_ref)
+            VALUES (param_scope, param_account_id, ref_kind, update_ref_name, node_metadata->'version_ref')
+            ON CONFLICT (account_id, config_reference_kind, ref_name) WHERE scope = 'account'
             DO UPDATE SET version_ref = node_metadata->'version_ref';
         END IF;
 
@@ -0,0 +1,122 @@
+--  Inspired by https://gist.github.com/phillip-haydon/54871b746201793990a18717af8d70dc#file-jsonb_merge-sql
+--
+--  Deep merges right into left, used by set_record_values for deep_merge writes and by
+--  effective reads. Plain plpgsql so it runs on a stock Postgres without plv8. mergeValues
+--  and mergeRecordValues in config/mergeStrategy.go do the same merge in Go.
+--
+--  At the top level only an object right is merged. Any other right (JSON null, SQL NULL,
+--  an array or a scalar) returns left, or {} when left is not an object, and an object
+--  right is merged into {} when left is not an object, as the plv8 version did. The
+--  deliberate differences from the plv8 version:
+--    - Numbers keep their full precision, plv8 read them as doubles (12345678901234567890
+--      came back as 12345678901234567000).
+--    - A right array or string is ignored at the top level, plv8 copied its items in as
+--      keys "0", "1", ...
+--    - A left array or string counts as not an object, plv8 started from its items as
+--      keys "0", "1", ...
+--
+--  strategies: object of merge strategies by the JSON pointer of the field (see
+--  ConfigMergeStrategies), e.g. {"/tiers": {"strategy": "merge_by_key", "key": "id"}}
+--    replace: the right value replaces the left one, even objects
+--    append: the right array items are added after the left ones
+--    set_union: as append, skipping items equal to one already in the array
+--    merge_by_key: items (objects) with the same value of the key field are merged,
+--      the fields of the items keep the pointer of the array
+--  Objects without a strategy are merged key by key, anything else is replaced.
+
+-- Replaces the plv8 versions
+DROP FUNCTION IF EXISTS jsonb_merge(JSONB, JSONB);
+DROP FUNCTION IF EXISTS jsonb_merge(JSONB, JSONB, JSONB);
+
+-- jsonb_merge_path(): merges the values at param_path
+CREATE OR REPLACE FUNCTION jsonb_merge_path(param_left JSONB, param_right JSONB, param_strategies JSONB, param_path TEXT)
+RETURNS JSONB
+
+LANGUAGE plpgsql IMMUTABLE
+AS $func$
+DECLARE
+    strategy_name TEXT = param_strategies->param_path->>'strategy';
+    merge_key TEXT = param_strategies->param_path->>'key';
+
+    result JSONB;
+    entry RECORD;
+    item JSONB;
+    item_index INT;
+BEGIN
+
+    IF strategy_name = 'replace' THEN
+        RETURN param_right;
+    END IF;
+
+    IF jsonb_typeof(param_right) = 'object' THEN
+        IF jsonb_typeof(param_left) IS DISTINCT FROM 'object' THEN
+            RETURN param_right;
+        END IF;
+
+        result = param_left;
+        FOR entry IN SELECT e.key, e.value FROM jsonb_each(param_right) e LOOP
+            IF param_left ? entry.key THEN
+                result = result || jsonb_build_object(entry.key, jsonb_merge_path(param_left->entry.key, entry.value, param_strategies,
+                    param_path || '/' || replace(replace(entry.key, '~', '~0'), '/', '~1')));
+            ELSE
+                result = result || jsonb_build_object(entry.key, entry.value);
+            END IF;
+        END LOOP;
+
+        RETURN result;
+    END IF;
+
+    IF jsonb_typeof(param_right) = 'array' AND jsonb_typeof(param_left) = 'array' THEN
+        IF strategy_name = 'append' THEN
+            RETURN param_left || param_right;
+
+        ELSIF strategy_name = 'set_union' THEN
+            result = param_left;
+            FOR item IN SELECT e.value FROM jsonb_array_elements(param_right) e LOOP
+                IF NOT EXISTS (SELECT 1 FROM jsonb_array_elements(result) r WHERE r.value = item) THEN
+                    result = result || jsonb_build_array(item);
+                END IF;
+            END LOOP;
+
+            RETURN result;
+
+        ELSIF strategy_name = 'merge_by_key' THEN
+            result = param_left;
+            FOR item IN SELECT e.value FROM jsonb_array_elements(param_right) e LOOP
+                item_index = NULL;
+                IF jsonb_typeof(item) = 'object' AND item ? merge_key THEN
+                    SELECT r.ordinality - 1 INTO item_index
+                    FROM jsonb_array_elements(result) WITH ORDINALITY r(value, ordinality)
+                    WHERE jsonb_typeof(r.value) = 'object' AND r.value ? merge_key AND r.value->merge_key = item->merge_key
+                    ORDER BY r.ordinality
+                    LIMIT 1;
+                END IF;
+
+                IF item_index IS NULL THEN
+                    result = result || jsonb_build_array(item);
+                ELSE
+                    result = jsonb_set(result, ARRAY[item_index::TEXT], jsonb_merge_path(result->item_index, item, param_strategies, param_path));
+                END IF;
+            END LOOP;
+
+            RETURN result;
+        END IF;
+    END IF;
+
+    RETURN param_right;
+
+END;
+$func$;
+
+-- jsonb_merge()
+CREATE OR REPLACE FUNCTION jsonb_merge(param_left JSONB, param_right JSONB, param_strategies JSONB DEFAULT '{}')
+RETURNS JSONB
+
+LANGUAGE sql IMMUTABLE
+AS $func$
+    SELECT CASE
+        WHEN jsonb_typeof(param_right) IS DISTINCT FROM 'object' THEN
+            CASE WHEN jsonb_typeof(param_left) = 'object' THEN param_left ELSE '{}'::JSONB END
+        ELSE jsonb_merge_path(param_left, param_right, COALESCE(param_strategies, '{}'::JSONB), '')
+    END;
+$func$;
@@ -0,0 +1,192 @@
+
+-- Materialized records at the tip of each ref (config_latest_records), so reads at a ref
+-- don't walk the version chain. config_latest_record_refs holds the version each ref
+-- was materialized at, readers fall back to the chain when it isn't the ref's version.
+--
+-- Refs are moved by insert_dag_node_internal() and also directly (merges, promotions,
+-- branch resets, gc), so the rows are kept in step by a trigger on config_refs.
+
+-- Replaces the rows of a ref with the records at param_version_hash, a NULL version only
+-- removes them
+CREATE OR REPLACE FUNCTION rebuild_latest_records(param_scope TEXT, param_account_id TEXT, param_user_id TEXT, param_ref_kind TEXT, param_ref_name TEXT, param_version_hash TEXT)
+RETURNS INTEGER
+LANGUAGE plpgsql
+AS $func$
+DECLARE
+    record_user_id TEXT = param_user_id;
+    records JSONB;
+BEGIN
+
+    IF param_scope <> 'user' THEN
+        record_user_id = NULL;
+    END IF;
+
+    DELETE FROM config_latest_records l
+    WHERE l.scope = param_scope AND l.account_id = param_account_id AND (
+        CASE WHEN param_scope = 'user' THEN l.user_id = param_user_id ELSE l.user_id IS NULL END
+    )
+    AND l.config_reference_kind = param_ref_kind AND l.ref_name = param_ref_name;
+
+    DELETE FROM config_latest_record_refs s
+    WHERE s.scope = param_scope AND s.account_id = param_account_id AND (
+        CASE WHEN param_scope = 'user' THEN s.user_id = param_user_id ELSE s.user_id IS NULL END
+    )
+    AND s.config_reference_kind = param_ref_kind AND s.ref_name = param_ref_name;
+
+    IF param_version_hash IS NULL THEN
+        RETURN 0;
+    END IF;
+
+    -- get_record_list() already hides deleted records and expands baselines
+    records := COALESCE(get_record_list(param_scope, param_account_id, COALESCE(param_user_id, ''), NULL, param_version_hash, NULL), '[]'::JSONB);
+
+    INSERT INTO config_latest_records (scope, account_id, user_id, config_reference_kind, ref_name, record_kind, record_collection_key, record_item_key, record_metadata, record_contents, node_metadata)
+    SELECT param_scope, param_account_id, record_user_id, param_ref_kind, param_ref_name,
+        e.value->>'record_kind', e.value->>'record_collection_key', e.value->>'record_item_key',
+        e.value->'record_metadata', e.value->'record_contents', e.value->'node_metadata'
+    FROM jsonb_array_elements(records) e;
+
+    INSERT INTO config_latest_record_refs (scope, account_id, user_id, config_reference_kind, ref_name, version_hash, updated_at)
+    VALUES (param_scope, param_account_id, record_user_id, param_ref_kind, param_ref_name, param_version_hash, now());
+
+    RETURN jsonb_array_length(records);
+END;
+$func$;
+
+-- Brings the rows of a ref to param_version_hash. When the ref moved forward by a single
+-- record or tombstone node only that record is replaced, anything else (merges, baselines,
+-- resets, new refs) rebuilds the ref.
+CREATE OR REPLACE FUNCTION update_latest_records(param_scope TEXT, param_account_id TEXT, param_user_id TEXT, param_ref_kind TEXT, param_ref_name TEXT, param_version_hash TEXT)
+RETURNS VOID
+LANGUAGE plpgsql
+AS $func$
+DECLARE
+    record_user_id TEXT = param_user_id;
+    materialized_hash TEXT;
+    new_node_metadata JSONB;
+    new_node_contents JSONB;
+    new_record_metadata JSONB;
+BEGIN
+
+    IF param_scope <> 'user' THEN
+        record_user_id = NULL;
+    END IF;
+
+    SELECT s.version_hash INTO materialized_hash
+    FROM config_latest_record_refs s
+    WHERE s.scope = param_scope AND s.account_id = param_account_id AND (
+        CASE WHEN param_scope = 'user' THEN s.user_id = param_user_id ELSE s.user_id IS NULL END
+    )
+    AND s.config_reference_kind = param_ref_kind AND s.ref_name = param_ref_name
+    FOR UPDATE;
+
+    IF materialized_hash IS NOT DISTINCT FROM param_version_hash THEN
+        RETURN;
+    END IF;
+
+    SELECT n.node_metadata, n.node_contents INTO new_node_metadata, new_node_contents
+    FROM config_nodes n
+    WHERE n.scope = param_scope AND n.account_id = param_account_id AND (
+        CASE WHEN param_scope = 'user' THEN n.user_id = param_user_id ELSE n.user_id IS NULL END
+    )
+    AND n.node_metadata->'version_ref'->>'config_version_hash' = param_version_hash
+    LIMIT 1;
+
+    IF materialized_hash IS NULL
+        OR new_node_metadata IS NULL
+        OR new_node_metadata->>'node_kind' NOT IN ('record', 'tombstone')
+        OR new_node_metadata->'parent_ref'->>'config_version_hash' IS DISTINCT FROM materialized_hash
+    THEN
+        PERFORM rebuild_latest_records(param_scope, param_account_id, param_user_id, param_ref_kind, param_ref_name, param_version_hash);
+        RETURN;
+    END IF;
+
+    new_record_metadata = new_node_contents->'record_metadata';
+
+    -- Records are keyed the same way as get_record_list()
+    DELETE FROM config_latest_records l
+    WHERE l.scope = param_scope AND l.account_id = param_account_id AND (
+        CASE WHEN param_scope = 'user' THEN l.user_id = param_user_id ELSE l.user_id IS NULL END
+    )
+    AND l.config_reference_kind = param_ref_kind AND l.ref_name = param_ref_name
+    AND l.record_kind IS NOT DISTINCT FROM new_record_metadata->>'record_kind'
+    AND l.record_collection_key IS NOT DISTINCT FROM new_record_metadata->>'record_collection_key'
+    AND l.record_item_key IS NOT DISTINCT FROM new_record_metadata->>'record_item_key';
+
+    IF new_node_metadata->>'node_kind' = 'record' THEN
+        INSERT INTO config_latest_records (scope, account_id, user_id, config_reference_kind, ref_name, record_kind, record_collection_key, record_item_key, record_metadata, record_contents, node_metadata)
+        VALUES (param_scope, param_account_id, record_user_id, param_ref_kind, param_ref_name,
+            new_record_metadata->>'record_kind', new_record_metadata->>'record_collection_key', new_record_metadata->>'record_item_key',
+            new_record_metadata, new_node_contents->'record_contents', new_node_metadata);
+    END IF;
+
+    UPDATE config_latest_record_refs s SET version_hash = param_version_hash, updated_at = now()
+    WHERE s.scope = param_scope AND s.account_id = param_account_id AND (
+        CASE WHEN param_scope = 'user' THEN s.user_id = param_user_id ELSE s.user_id IS NULL END
+    )
+    AND s.config_reference_kind = param_ref_kind AND s.ref_name = param_ref_name;
+END;
+$func$;
+
+-- Rebuilds every ref, or the refs of one account, and drops the rows of refs that no
+-- longer exist. Used by `config rebuild-latest` when the table has drifted.
+CREATE OR REPLACE FUNCTION rebuild_all_latest_records(param_account_id TEXT)
+RETURNS INTEGER
+LANGUAGE plpgsql
+AS $func$
+DECLARE
+    ref RECORD;
+    rebuilt INTEGER = 0;
+BEGIN
+
+    DELETE FROM config_latest_records l
+    WHERE (param_account_id IS NULL OR l.account_id = param_account_id)
+    AND NOT EXISTS (
+        SELECT 1 FROM config_refs r
+        WHERE r.scope = l.scope AND r.account_id = l.account_id AND r.user_id IS NOT DISTINCT FROM l.user_id
+        AND r.config_reference_kind = l.config_reference_kind AND r.ref_name = l.ref_name
+    );
+
+    DELETE FROM config_latest_record_refs s
+    WHERE (param_account_id IS NULL OR s.account_id = param_account_id)
+    AND NOT EXISTS (
+        SELECT 1 FROM config_refs r
+        WHERE r.scope = s.scope AND r.account_id = s.account_id AND r.user_id IS NOT DISTINCT FROM s.user_id
+        AND r.config_reference_kind = s.config_reference_kind AND r.ref_name = s.ref_name
+    );
+
+    FOR ref IN
+        SELECT r.scope, r.account_id, r.user_id, r.config_reference_kind, r.ref_name, r.version_ref->>'config_version_hash' version_hash
+        FROM config_refs r
+        WHERE param_account_id IS NULL OR r.account_id = param_account_id
+        ORDER BY r.scope, r.account_id, r.user_id, r.config_reference_kind, r.ref_name
+    LOOP
+        PERFORM rebuild_latest_records(ref.scope, ref.account_id, ref.user_id, ref.config_reference_kind, ref.ref_name, ref.version_hash);
+        rebuilt = rebuilt + 1;
+    END LOOP;
+
+    RETURN rebuilt;
+END;
+$func$;
+
+CREATE OR REPLACE FUNCTION config_refs_update_latest_records()
+RETURNS TRIGGER
+LANGUAGE plpgsql
+AS $func$
+BEGIN
+
+    IF TG_OP = 'DELETE' THEN
+        PERFORM rebuild_latest_records(OLD.scope, OLD.account_id, OLD.user_id, OLD.config_reference_kind, OLD.ref_name, NULL);
+        RETURN OLD;
+    END IF;
+
+    PERFORM update_latest_records(NEW.scope, NEW.account_id, NEW.user_id, NEW.config_reference_kind, NEW.ref_name, NEW.version_ref->>'config_version_hash');
+    RETURN NEW;
+END;
+$func$;
+
+DROP TRIGGER IF EXISTS config_refs_latest_records ON config_refs;
+
+CREATE TRIGGER config_refs_latest_records
+AFTER INSERT OR DELETE OR UPDATE OF version_ref ON config_refs
+FOR EACH ROW EXECUTE FUNCTION config_refs_update_latest_records();
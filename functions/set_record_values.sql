@@ -1,9 +1,36 @@
-CREATE OR REPLACE FUNCTION set_record_values(param_scope TEXT, param_account_id TEXT, param_user_id TEXT, param_record_kind TEXT, param_collection_key TEXT, param_item_key TEXT, param_values JSONB, param_merge_mode TEXT DEFAULT 'deepmerge')
+-- The signature changed, drop the previous version
+DROP FUNCTION IF EXISTS set_record_values(TEXT, TEXT, TEXT, TEXT, TEXT, TEXT, JSONB, TEXT);
+
+-- param_merge_mode:
+--   replace_all, deep_merge, or tombstone to delete the record. The tombstone
+--   node keeps the history readable, a later write starts again from empty values.
+--   Raises SQLSTATE CV404 when the record does not exist.
+--
+-- param_options:
+--   ref_name: commit to the named branch instead of head, raises SQLSTATE CR404 when
+--     the branch does not exist
+--   defer_ref_update: leave the ref where it is, the caller moves it before the
+--     transaction ends. The ref is still locked.
+--   parent_version_ref: write on top of this version instead of the tip of the ref, with
+--     defer_ref_update batches chain their writes this way and move the ref once
+--   batch_id: shared by the versions written by one batch, stored as version_ref.batch_id
+--   note: stored as version_ref.note on the new node
+--   trailers: object of string values (ticket, reason, ...), stored as version_ref.trailers
+--   moved_from, moved_to: the other key of a moved record, stored in the record_metadata
+--   merge_strategies: merge strategies of a deep_merge by JSON pointer, see jsonb_merge
+--   expected_version_hash: the version of the record the caller last saw, '*' for
+--     any existing version. Raises SQLSTATE CV409 with the current version hash as
+--     the detail when it does not match the logical parent.
+CREATE OR REPLACE FUNCTION set_record_values(param_scope TEXT, param_account_id TEXT, param_user_id TEXT, param_record_kind TEXT, param_collection_key TEXT, param_item_key TEXT, param_values JSONB, param_merge_mode TEXT DEFAULT 'deepmerge', param_options JSONB DEFAULT NULL)
 RETURNS JSONB AS $func$
 DECLARE
     -- refs config_refs[];
     refs JSONB;
 
+    branch_name TEXT = COALESCE(param_options->>'ref_name', '');
+    expected_hash TEXT = COALESCE(param_options->>'expected_version_hash', '');
+    update_refs JSONB = '["head"]';
+
     match_filter JSONB;
     versions JSONB;
 
@@ -11,6 +38,7 @@ DECLARE
     parent_node JSONB;
 
     logical_parent_hash TEXT;
+    logical_parent_kind TEXT;
 
     starting_values JSONB = '{}';
 
@@ -26,10 +54,15 @@ DECLARE
 BEGIN
 
     -- Validate the parameters
-    IF param_scope NOT IN ('account', 'user') THEN
+    IF param_scope NOT IN ('global', 'account', 'user') THEN
         RAISE EXCEPTION 'Unsupported scope %', param_scope;
     END IF;
 
+    -- The global repository is kept under the platform account
+    IF param_scope = 'global' AND param_account_id IS DISTINCT FROM '00000000-0000-0000-0000-000000000000' THEN
+        RAISE EXCEPTION 'Global scope must use the platform account ID';
+    END IF;
+
     IF param_account_id IS NULL THEN
         RAISE EXCEPTION 'Account ID must be provided';
     END IF;
@@ -52,7 +85,7 @@ BEGIN
         END IF;
     END IF;
 
-    IF param_merge_mode NOT IN ('replace_all', 'deepmerge') THEN
+    IF param_merge_mode NOT IN ('replace_all', 'deepmerge', 'deep_merge', 'tombstone') THEN
         RAISE EXCEPTION 'Unsupported merge mode %', param_merge_mode;
     END IF;
 
@@ -71,13 +104,54 @@ BEGIN
     --         FROM get_or_init_repo(param_scope, param_account_id, param_user_id) r
     -- );
 
+    -- Hold the ref we are about to move until the transaction ends, so concurrent
+    -- writers queue behind us instead of committing on a stale parent, and the
+    -- expected version can't change under us. Batches keep the lock across all
+    -- of their writes.
+    PERFORM 1
+        FROM config_refs r
+        WHERE r.scope = param_scope AND r.account_id = param_account_id
+            AND (CASE WHEN param_scope = 'user' THEN r.user_id = param_user_id ELSE r.user_id IS NULL END)
+            AND r.config_reference_kind = (CASE WHEN branch_name <> '' THEN 'branch' ELSE 'head' END)
+            AND r.ref_name = branch_name
+        FOR UPDATE;
+
     refs = (SELECT jsonb_object_agg(r.config_reference_kind, r.version_ref)
-        FROM get_or_init_repo(param_scope, param_account_id, param_user_id) r);
+        FROM get_or_init_repo(param_scope, param_account_id, param_user_id) r
+        WHERE r.ref_name = '');
 
     RAISE NOTICE 'Refs: %', refs;
 
     -- head_version_ref = (SELECT version_ref FROM refs WHERE config_reference_kind = 'head');
     head_version_ref = refs->'head';
+
+    -- When committing to a branch, the branch tip takes the place of head
+    IF branch_name <> '' THEN
+        head_version_ref = (
+            SELECT r.version_ref
+            FROM config_refs r
+            WHERE r.scope = param_scope AND r.account_id = param_account_id
+                AND (CASE WHEN param_scope = 'user' THEN r.user_id = param_user_id ELSE r.user_id IS NULL END)
+                AND r.config_reference_kind = 'branch' AND r.ref_name = branch_name
+            LIMIT 1
+        );
+
+        IF head_version_ref IS NULL THEN
+            RAISE EXCEPTION 'Branch % not found', branch_name
+                USING ERRCODE = 'CR404';
+        END IF;
+
+        update_refs = jsonb_build_array(jsonb_build_object('kind', 'branch', 'name', branch_name));
+    END IF;
+
+    IF jsonb_typeof(param_options->'parent_version_ref') = 'object' THEN
+        head_version_ref = param_options->'parent_version_ref';
+    END IF;
+
+    IF COALESCE((param_options->>'defer_ref_update')::BOOLEAN, false) THEN
+        update_refs = NULL;
+    END IF;
+
     RAISE NOTICE 'Head version ref: %', head_version_ref;
 
     -- SELECT * INTO parent_node FROM config_nodes n WHERE n.node_metadata->'version_ref'->>'config_version_hash' = head_version_ref->>'config_version_hash' LIMIT 1;
@@ -98,19 +172,37 @@ BEGIN
         match_filter := jsonb_set(match_filter, '{record_item_key}', to_jsonb(param_item_key));
     END IF;
 
-    versions = get_version_chain(param_scope, param_account_id, param_user_id, NULL::TEXT, NULL::TEXT, match_filter);
+    versions = get_version_chain(param_scope, param_account_id, param_user_id, NULL::TEXT, head_version_ref->>'config_version_hash', match_filter);
 
-    logical_parent_hash = (
-        SELECT value->'version_ref'->>'config_version_hash'
+    -- The contents come from the chain entry since a baseline node holds several records
+    SELECT value->'node_metadata'->'version_ref'->>'config_version_hash', value->>'node_kind', value->'record_contents'
+        INTO logical_parent_hash, logical_parent_kind, starting_values
         FROM jsonb_array_elements(versions)
         WHERE value->'record_match' = 'true'::JSONB
-        LIMIT 1
-    );
+        LIMIT 1;
 
-    RAISE NOTICE 'Logical parent hash: %', logical_parent_hash;
+    RAISE NOTICE 'Logical parent hash: % (%)', logical_parent_hash, logical_parent_kind;
 
-    IF logical_parent_hash IS NOT NULL THEN
-        starting_values = (SELECT n.node_contents->'record_contents' FROM config_nodes n WHERE n.node_metadata->'version_ref'->>'config_version_hash' = logical_parent_hash LIMIT 1);
+    -- A deleted record has no current version
+    IF logical_parent_kind = 'tombstone' THEN
+        logical_parent_hash = NULL;
+    END IF;
+
+    IF logical_parent_hash IS NULL THEN
+        starting_values = '{}';
+    END IF;
+
+    IF param_merge_mode = 'tombstone' AND logical_parent_hash IS NULL THEN
+        RAISE EXCEPTION 'Record % % not found', param_collection_key, COALESCE(param_item_key, '')
+            USING ERRCODE = 'CV404';
+    END IF;
+
+    IF expected_hash <> '' THEN
+        IF (expected_hash = '*' AND logical_parent_hash IS NULL)
+            OR (expected_hash <> '*' AND expected_hash IS DISTINCT FROM logical_parent_hash) THEN
+            RAISE EXCEPTION 'Record version conflict: expected %, current %', expected_hash, logical_parent_hash
+                USING ERRCODE = 'CV409', DETAIL = COALESCE(logical_parent_hash, '');
+        END IF;
     END IF;
 
     RAISE NOTICE 'Starting values: %', starting_values;
@@ -157,11 +249,13 @@ BEGIN
         
     -- END IF;
 
-    IF param_merge_mode = 'replace_all' THEN
+    IF param_merge_mode = 'tombstone' THEN
+        record_contents = NULL;
+    ELSIF param_merge_mode = 'replace_all' THEN
         record_contents = param_values;
-    ELSIF param_merge_mode = 'deepmerge' THEN
-        -- Use the v8 engine to merge the JSON objects
-        record_contents = jsonb_merge(starting_values, param_values);
+    ELSIF param_merge_mode IN ('deepmerge', 'deep_merge') THEN
+        -- Arrays are replaced unless merge_strategies has a strategy for their path
+        record_contents = jsonb_merge(starting_values, param_values, COALESCE(param_options->'merge_strategies', '{}'::JSONB));
     END IF;
 
     RAISE NOTICE 'Final record contents: %', record_contents;
@@ -169,9 +263,20 @@ BEGIN
     -- Construct the new node
 
     node_metadata = jsonb_build_object(
-        'node_kind', 'record',
+        'node_kind', (CASE WHEN param_merge_mode = 'tombstone' THEN 'tombstone' ELSE 'record' END),
         'parent_ref', parent_node->'node_metadata'->'version_ref'
     );
+    -- Moved into the version_ref by insert_dag_node_internal
+    IF COALESCE(param_options->>'note', '') <> '' THEN
+        node_metadata = jsonb_set(node_metadata, '{note}', param_options->'note');
+    END IF;
+    IF jsonb_typeof(param_options->'trailers') = 'object' THEN
+        node_metadata = jsonb_set(node_metadata, '{trailers}', param_options->'trailers');
+    END IF;
+    IF COALESCE(param_options->>'batch_id', '') <> '' THEN
+        node_metadata = jsonb_set(node_metadata, '{batch_id}', param_options->'batch_id');
+    END IF;
+
     RAISE NOTICE 'Node metadata: %', node_metadata;
 
     node_record_metadata = jsonb_build_object(
@@ -179,6 +284,12 @@ BEGIN
         'record_collection_key', param_collection_key,
         'record_item_key', param_item_key
     );
+    IF jsonb_typeof(param_options->'moved_from') = 'object' THEN
+        node_record_metadata = jsonb_set(node_record_metadata, '{moved_from}', param_options->'moved_from');
+    END IF;
+    IF jsonb_typeof(param_options->'moved_to') = 'object' THEN
+        node_record_metadata = jsonb_set(node_record_metadata, '{moved_to}', param_options->'moved_to');
+    END IF;
     RAISE NOTICE 'Node record metadata: %', node_record_metadata;
 
     node_contents = jsonb_build_object(
@@ -189,7 +300,7 @@ BEGIN
 
     -- Insert the new node
 
-    inserted_node_metadata = (SELECT r.node_metadata FROM insert_dag_node(param_scope, param_account_id, param_user_id, node_metadata, node_contents, '["head"]') r LIMIT 1);
+    inserted_node_metadata = (SELECT r.node_metadata FROM insert_dag_node(param_scope, param_account_id, param_user_id, node_metadata, node_contents, update_refs) r LIMIT 1);
     RAISE NOTICE 'Inserted node metadata: %', inserted_node_metadata;
 
     result = jsonb_build_object(
@@ -0,0 +1,344 @@
+
+-- Returns the node metadata with its parents re-linked through param_rewritten (old hash to
+-- new version_ref) and the removed additional parents dropped, or NULL when the first parent
+-- was removed. The hash is recomputed the same way as insert_dag_node_internal.
+CREATE OR REPLACE FUNCTION relink_dag_node(param_node_metadata JSONB, param_rewritten JSONB, param_removed JSONB)
+RETURNS JSONB
+LANGUAGE plpgsql
+AS $$
+DECLARE
+    relinked JSONB = param_node_metadata;
+    parent_hash TEXT = param_node_metadata->'parent_ref'->>'config_version_hash';
+    version_hash TEXT;
+
+    -- Constants
+    EMPTY_HASH JSONB = '"44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"';
+BEGIN
+
+    IF param_rewritten ? parent_hash THEN
+        relinked = jsonb_set(relinked, '{parent_ref}', param_rewritten->parent_hash);
+    ELSIF param_removed ? parent_hash THEN
+        RETURN NULL;
+    END IF;
+
+    IF jsonb_typeof(relinked->'additional_parent_refs') = 'array' THEN
+        relinked = jsonb_set(relinked, '{additional_parent_refs}', COALESCE((
+            SELECT jsonb_agg(COALESCE(param_rewritten->(a.p->>'config_version_hash'), a.p) ORDER BY a.ordinality)
+            FROM jsonb_array_elements(relinked->'additional_parent_refs') WITH ORDINALITY a(p, ordinality)
+            WHERE param_rewritten ? (a.p->>'config_version_hash') OR NOT param_removed ? (a.p->>'config_version_hash')
+        ), '[]'::JSONB));
+    END IF;
+
+    relinked = jsonb_set(relinked, '{version_ref, config_version_hash}', EMPTY_HASH);
+
+    -- Remove the \x prefix from the resulting hash
+    version_hash = substr(digest(relinked::TEXT, 'sha256')::TEXT, 3);
+
+    RETURN jsonb_set(relinked, '{version_ref, config_version_hash}', to_jsonb(version_hash));
+END;
+$$;
+
+-- Squashes param_squash_hash and everything before it on the first parent chain of head
+-- into a single baseline node holding the records as they were at param_squash_hash. The
+-- baseline is parented on the empty root, the newer nodes are re-linked onto it (which
+-- changes their hashes) and refs, tags and stage promotions follow the new hashes. Nodes
+-- only reachable through a squashed node are removed with it, refs and tags must not
+-- point at any of them.
+--
+-- Returns {baseline: node metadata, removed: [hashes], rewritten: {old hash: version_ref}}
+CREATE OR REPLACE FUNCTION squash_dag_history(param_scope TEXT, param_account_id TEXT, param_user_id TEXT, param_squash_hash TEXT)
+RETURNS JSONB
+LANGUAGE plpgsql
+AS $func$
+DECLARE
+    record_user_id TEXT = param_user_id;
+
+    root_ref JSONB;
+    head_hash TEXT;
+
+    -- The first parent chain of head, newest first, without the empty root
+    chain JSONB;
+    squash_depth INT;
+
+    baseline_records JSONB;
+    baseline_metadata JSONB;
+
+    -- Both are objects keyed by hash so they can be checked with ?
+    removed JSONB;
+    rewritten JSONB;
+    -- Hashes of nodes re-linked twice, they never existed before the squash
+    intermediate TEXT[] = '{}';
+
+    node_row RECORD;
+    old_hash TEXT;
+    relinked JSONB;
+    changed BOOL;
+BEGIN
+
+    -- Validate the parameters
+    IF param_scope NOT IN ('global', 'account', 'user') THEN
+        RAISE EXCEPTION 'Unsupported scope %', param_scope;
+    END IF;
+
+    -- The global repository is kept under the platform account
+    IF param_scope = 'global' AND param_account_id IS DISTINCT FROM '00000000-0000-0000-0000-000000000000' THEN
+        RAISE EXCEPTION 'Global scope must use the platform account ID';
+    END IF;
+
+    IF param_account_id IS NULL THEN
+        RAISE EXCEPTION 'Account ID must be provided';
+    END IF;
+
+    IF param_user_id IS NULL THEN
+        RAISE EXCEPTION 'User ID must be provided';
+    END IF;
+
+    IF param_squash_hash IS NULL THEN
+        RAISE EXCEPTION 'Squash hash must be provided';
+    END IF;
+
+    IF param_scope <> 'user' THEN
+        record_user_id = NULL;
+    END IF;
+
+    -- Hold every ref of the scope until the transaction ends, writers queue behind the squash
+    PERFORM 1
+        FROM config_refs r
+        WHERE r.scope = param_scope AND r.account_id = param_account_id
+            AND (CASE WHEN param_scope = 'user' THEN r.user_id = param_user_id ELSE r.user_id IS NULL END)
+        FOR UPDATE;
+
+    root_ref = (
+        SELECT r.version_ref
+            FROM config_refs r
+            WHERE r.scope = param_scope AND r.account_id = param_account_id
+                AND (CASE WHEN param_scope = 'user' THEN r.user_id = param_user_id ELSE r.user_id IS NULL END)
+                AND r.config_reference_kind = 'root' AND r.ref_name = ''
+            LIMIT 1
+    );
+
+    head_hash = (
+        SELECT r.version_ref->>'config_version_hash'
+            FROM config_refs r
+            WHERE r.scope = param_scope AND r.account_id = param_account_id
+                AND (CASE WHEN param_scope = 'user' THEN r.user_id = param_user_id ELSE r.user_id IS NULL END)
+                AND r.config_reference_kind = 'head' AND r.ref_name = ''
+            LIMIT 1
+    );
+
+    IF root_ref IS NULL OR head_hash IS NULL THEN
+        RAISE EXCEPTION 'No root or head found for scope % account % and user %', param_scope, param_account_id, param_user_id;
+    END IF;
+
+    chain = (
+        WITH RECURSIVE walk AS (
+            SELECT 1 depth, n.node_metadata, n.node_contents
+                FROM config_nodes n
+                WHERE n.scope = param_scope AND n.account_id = param_account_id
+                    AND (CASE WHEN param_scope = 'user' THEN n.user_id = param_user_id ELSE n.user_id IS NULL END)
+                    AND n.node_metadata->'version_ref'->>'config_version_hash' = head_hash
+            UNION ALL
+            SELECT w.depth + 1, n.node_metadata, n.node_contents
+                FROM walk w
+                JOIN config_nodes n ON n.node_metadata->'version_ref'->>'config_version_hash' = w.node_metadata->'parent_ref'->>'config_version_hash'
+                WHERE n.scope = param_scope AND n.account_id = param_account_id
+                    AND (CASE WHEN param_scope = 'user' THEN n.user_id = param_user_id ELSE n.user_id IS NULL END)
+        )
+        SELECT jsonb_agg(jsonb_build_object('depth', w.depth, 'node_metadata', w.node_metadata, 'node_contents', w.node_contents) ORDER BY w.depth)
+            FROM walk w
+            WHERE w.node_metadata->>'node_kind' <> 'empty'
+    );
+
+    squash_depth = (
+        SELECT (c->>'depth')::INT
+            FROM jsonb_array_elements(chain) c
+            WHERE c->'node_metadata'->'version_ref'->>'config_version_hash' = param_squash_hash
+    );
+
+    IF squash_depth IS NULL THEN
+        RAISE EXCEPTION 'Version % is not on the first parent chain of head', param_squash_hash;
+    END IF;
+
+    RAISE NOTICE 'Squashing % versions from %', jsonb_array_length(chain) - squash_depth + 1, param_squash_hash;
+
+    --
+    -- Build the baseline from the newest entry of each record, the records of an earlier
+    -- baseline are expanded and deleted records are left out
+    --
+
+    baseline_records = (
+        WITH entries AS (
+            SELECT (c->>'depth')::INT depth, c->'node_metadata'->>'node_kind' node_kind, e.value entry
+                FROM jsonb_array_elements(chain) c,
+                    jsonb_array_elements(CASE
+                        WHEN c->'node_metadata'->>'node_kind' = 'baseline' THEN c->'node_contents'->'records'
+                        ELSE jsonb_build_array(c->'node_contents')
+                    END) e
+                WHERE (c->>'depth')::INT >= squash_depth
+                    AND jsonb_typeof(e.value->'record_metadata') = 'object'
+        ),
+        latest AS (
+            SELECT DISTINCT ON (entry->'record_metadata'->>'record_kind', entry->'record_metadata'->>'record_collection_key', entry->'record_metadata'->>'record_item_key')
+                node_kind, entry
+                FROM entries
+                ORDER BY entry->'record_metadata'->>'record_kind', entry->'record_metadata'->>'record_collection_key', entry->'record_metadata'->>'record_item_key', depth
+        )
+        SELECT COALESCE(jsonb_agg(jsonb_build_object(
+            -- The older keys of moved records are gone
+            'record_metadata', (l.entry->'record_metadata') - 'moved_from' - 'moved_to',
+            'record_contents', l.entry->'record_contents'
+        ) ORDER BY l.entry->'record_metadata'->>'record_kind', l.entry->'record_metadata'->>'record_collection_key', l.entry->'record_metadata'->>'record_item_key'), '[]'::JSONB)
+            FROM latest l
+            WHERE l.node_kind <> 'tombstone'
+    );
+
+    baseline_metadata = jsonb_build_object(
+        'scope', param_scope,
+        'account_id', param_account_id,
+        'user_id', record_user_id,
+        'node_kind', 'baseline',
+        'parent_ref', root_ref,
+        'note', format('Squashed %s versions up to %s', jsonb_array_length(chain) - squash_depth + 1, param_squash_hash)
+    );
+
+    baseline_metadata = (
+        SELECT r.node_metadata
+            FROM insert_dag_node_internal(param_scope, param_account_id, param_user_id, baseline_metadata, jsonb_build_object('records', baseline_records), NULL) r
+            LIMIT 1
+    );
+
+    RAISE NOTICE 'Inserted baseline: %', baseline_metadata;
+
+    removed = (
+        SELECT jsonb_object_agg(c->'node_metadata'->'version_ref'->>'config_version_hash', true)
+            FROM jsonb_array_elements(chain) c
+            WHERE (c->>'depth')::INT >= squash_depth
+    );
+
+    -- The squashed version is replaced by the baseline, the rest of the squashed chain is just removed
+    rewritten = jsonb_build_object(param_squash_hash, baseline_metadata->'version_ref');
+
+    --
+    -- Re-link the kept part of the chain onto the baseline, oldest first
+    --
+
+    FOR i IN REVERSE squash_depth - 1 .. 1 LOOP
+        old_hash = chain->(i - 1)->'node_metadata'->'version_ref'->>'config_version_hash';
+        relinked = relink_dag_node(chain->(i - 1)->'node_metadata', rewritten, removed);
+
+        UPDATE config_nodes n SET node_metadata = relinked
+            WHERE n.scope = param_scope AND n.account_id = param_account_id
+                AND (CASE WHEN param_scope = 'user' THEN n.user_id = param_user_id ELSE n.user_id IS NULL END)
+                AND n.node_metadata->'version_ref'->>'config_version_hash' = old_hash;
+
+        rewritten = rewritten || jsonb_build_object(old_hash, relinked->'version_ref');
+    END LOOP;
+
+    --
+    -- Re-link the nodes built on a rewritten node (branches, merged parents), nodes only
+    -- reachable through a removed node are removed with it. Each pass only sees the
+    -- hashes known when it started, so repeat until nothing changes.
+    --
+
+    LOOP
+        changed = false;
+
+        FOR node_row IN
+            SELECT n.node_metadata
+                FROM config_nodes n
+                WHERE n.scope = param_scope AND n.account_id = param_account_id
+                    AND (CASE WHEN param_scope = 'user' THEN n.user_id = param_user_id ELSE n.user_id IS NULL END)
+                    AND NOT removed ? (n.node_metadata->'version_ref'->>'config_version_hash')
+                    AND EXISTS (
+                        SELECT 1
+                            FROM jsonb_array_elements(jsonb_build_array(n.node_metadata->'parent_ref') || (CASE
+                                WHEN jsonb_typeof(n.node_metadata->'additional_parent_refs') = 'array' THEN n.node_metadata->'additional_parent_refs'
+                                ELSE '[]'::JSONB
+                            END)) p
+                            WHERE rewritten ? (p->>'config_version_hash') OR removed ? (p->>'config_version_hash')
+                    )
+                ORDER BY n.created_at
+        LOOP
+            old_hash = node_row.node_metadata->'version_ref'->>'config_version_hash';
+            relinked = relink_dag_node(node_row.node_metadata, rewritten, removed);
+
+            IF relinked IS NULL THEN
+                removed = removed || jsonb_build_object(old_hash, true);
+            ELSE
+                UPDATE config_nodes n SET node_metadata = relinked
+                    WHERE n.scope = param_scope AND n.account_id = param_account_id
+                        AND (CASE WHEN param_scope = 'user' THEN n.user_id = param_user_id ELSE n.user_id IS NULL END)
+                        AND n.node_metadata->'version_ref'->>'config_version_hash' = old_hash;
+
+                -- Already re-linked once (a merge of two rewritten parents), point the original hash at the final one
+                IF EXISTS (SELECT 1 FROM jsonb_each(rewritten) e WHERE e.value->>'config_version_hash' = old_hash) THEN
+                    intermediate = intermediate || old_hash;
+                    rewritten = rewritten || (
+                        SELECT jsonb_object_agg(e.key, relinked->'version_ref')
+                            FROM jsonb_each(rewritten) e
+                            WHERE e.value->>'config_version_hash' = old_hash
+                    );
+                END IF;
+
+                rewritten = rewritten || jsonb_build_object(old_hash, relinked->'version_ref');
+            END IF;
+
+            changed = true;
+        END LOOP;
+
+        EXIT WHEN NOT changed;
+    END LOOP;
+
+    rewritten = rewritten - intermediate;
+
+    --
+    -- Move the refs, refs left on a removed node would dangle
+    --
+
+    IF EXISTS (
+        SELECT 1 FROM config_refs r
+            WHERE r.scope = param_scope AND r.account_id = param_account_id
+                AND (CASE WHEN param_scope = 'user' THEN r.user_id = param_user_id ELSE r.user_id IS NULL END)
+                AND removed ? (r.version_ref->>'config_version_hash') AND NOT rewritten ? (r.version_ref->>'config_version_hash')
+        UNION ALL
+        SELECT 1 FROM config_tags t
+            WHERE t.scope = param_scope AND t.account_id = param_account_id
+                AND (CASE WHEN param_scope = 'user' THEN t.user_id = param_user_id ELSE t.user_id IS NULL END)
+                AND removed ? (t.version_ref->>'config_version_hash') AND NOT rewritten ? (t.version_ref->>'config_version_hash')
+    ) THEN
+        RAISE EXCEPTION 'A ref or tag points at a version removed by the squash of %', param_squash_hash;
+    END IF;
+
+    UPDATE config_refs r SET version_ref = rewritten->(r.version_ref->>'config_version_hash')
+        WHERE r.scope = param_scope AND r.account_id = param_account_id
+            AND (CASE WHEN param_scope = 'user' THEN r.user_id = param_user_id ELSE r.user_id IS NULL END)
+            AND rewritten ? (r.version_ref->>'config_version_hash');
+
+    UPDATE config_tags t SET version_ref = rewritten->(t.version_ref->>'config_version_hash')
+        WHERE t.scope = param_scope AND t.account_id = param_account_id
+            AND (CASE WHEN param_scope = 'user' THEN t.user_id = param_user_id ELSE t.user_id IS NULL END)
+            AND rewritten ? (t.version_ref->>'config_version_hash');
+
+    UPDATE config_stage_promotions p SET version_ref = rewritten->(p.version_ref->>'config_version_hash')
+        WHERE p.scope = param_scope AND p.account_id = param_account_id
+            AND (CASE WHEN param_scope = 'user' THEN p.user_id = param_user_id ELSE p.user_id IS NULL END)
+            AND rewritten ? (p.version_ref->>'config_version_hash');
+
+    UPDATE config_stage_promotions p SET previous_version_ref = rewritten->(p.previous_version_ref->>'config_version_hash')
+        WHERE p.scope = param_scope AND p.account_id = param_account_id
+            AND (CASE WHEN param_scope = 'user' THEN p.user_id = param_user_id ELSE p.user_id IS NULL END)
+            AND rewritten ? (p.previous_version_ref->>'config_version_hash');
+
+    DELETE FROM config_nodes n
+        WHERE n.scope = param_scope AND n.account_id = param_account_id
+            AND (CASE WHEN param_scope = 'user' THEN n.user_id = param_user_id ELSE n.user_id IS NULL END)
+            AND removed ? (n.node_metadata->'version_ref'->>'config_version_hash');
+
+    RETURN jsonb_build_object(
+        'baseline', baseline_metadata,
+        'removed', (SELECT jsonb_agg(k ORDER BY k) FROM jsonb_object_keys(removed) k),
+        'rewritten', rewritten
+    );
+
+END;
+$func$;
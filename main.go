@@ -34,7 +34,7 @@ func main() {
 		Commands: []*cli.Command{
 			connections.CreateAutoMigrateCommand(db),
 			// migrations.CreateSchemaCommand(db),
-			config.CreateConfigCommand(db),
+			config.CreateConfigCommand(db, rdb),
 			commands.MakeServerCommand(apiAddr, db, rdb),
 		},
 	}
@@ -1,7 +1,10 @@
 package routes
 
 import (
+	"net/http"
+
 	"github.com/tmzt/config-api/config"
+	"github.com/tmzt/config-api/resources"
 	"github.com/tmzt/config-api/util"
 
 	restful "github.com/emicklei/go-restful/v3"
@@ -13,7 +16,8 @@ type AccountRoute struct {
 }
 
 type NewAccountProps struct {
-	ConfigService *config.ConfigService
+	ConfigService      *config.ConfigService
+	AccountPermissions *resources.AccountPermissionsResource
 }
 
 func NewAccountRoute(
@@ -33,11 +37,54 @@ func (r *AccountRoute) RegisterAccountRoute(path string, subAccount bool, contai
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON)
 
+	r.registerConfigRoutes(ws)
+
+	container.Add(ws)
+}
+
+// RegisterGlobalRoute serves the config routes for the platform-wide global repository,
+// shared schemas and platform defaults. Any user can read it, only platform admins can write.
+func (r *AccountRoute) RegisterGlobalRoute(path string, container *restful.Container) {
+	ws := new(restful.WebService)
+	ws.Path(path).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON).
+		Filter(r.globalScopeFilter)
+
+	r.registerConfigRoutes(ws)
+
+	container.Add(ws)
+}
+
+func (r *AccountRoute) registerConfigRoutes(ws *restful.WebService) {
 	configService := r.props.ConfigService
 
 	NewConfigRoute(configService).Prefixed(ws, "/")
 	NewConfigDiffRoute(configService).Prefixed(ws, "/")
 	NewConfigSchemaRoute(configService).Prefixed(ws, "/")
+	NewConfigRefRoute(configService).Prefixed(ws, "/")
+	NewConfigFsckRoute(configService).Prefixed(ws, "/")
+	NewConfigRetentionRoute(configService).Prefixed(ws, "/")
+	NewConfigBlameRoute(configService).Prefixed(ws, "/")
+	NewConfigLogRoute(configService).Prefixed(ws, "/")
+	NewConfigEffectiveRoute(configService).Prefixed(ws, "/")
+	NewConfigInheritanceRoute(configService, r.props.AccountPermissions).Prefixed(ws, "/")
+}
 
-	container.Add(ws)
+// Marks the request as global scope for util.GetRequestScopeAndIds, anything other
+// than a read requires a platform admin
+func (r *AccountRoute) globalScopeFilter(req *restful.Request, res *restful.Response, chain *restful.FilterChain) {
+	req.SetAttribute("globalScope", true)
+
+	switch req.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if !util.RequestBoolAttribute(req, "isPlatformAdmin") {
+			r.logger.Printf("Rejecting %s %s to the global repository (not a platform admin)\n", req.Request.Method, req.Request.URL.Path)
+			res.WriteErrorString(http.StatusForbidden, "Only platform admins can change the global config")
+			return
+		}
+	}
+
+	chain.ProcessFilter(req, res)
 }
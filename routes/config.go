@@ -3,7 +3,10 @@ package routes
 import (
 	"context"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strings"
 
 	"github.com/emicklei/go-restful/v3"
 	"github.com/tmzt/config-api/config"
@@ -56,8 +59,14 @@ func getRecordQuery(req *restful.Request, res *restful.Response, requireCollecti
 		}
 	}
 
+	// Taken from the path or the query, may also be a tag or branch name (see resolveRecordQueryVersion)
+	versionHashParam := req.PathParameter("configVersionHash")
+	if versionHashParam == "" {
+		versionHashParam = req.QueryParameter("configVersionHash")
+	}
+
 	var versionHash *util.ConfigVersionHash
-	if v := req.QueryParameter("configVersionHash"); true {
+	if v := versionHashParam; true {
 		if v != "" {
 			hash := util.ConfigVersionHash(v)
 			versionHash = &hash
@@ -89,7 +98,39 @@ func (r *ConfigRoute) getRecordList(req *restful.Request, res *restful.Response)
 
 	// TBD: should we support other parameters for the record query?
 
-	recordList, err := r.configService.ListConfigs(context.Background(), nil, scope, accountId, userId, nil)
+	ctx := context.Background()
+
+	toVersion, ok := resolveRequestRef(ctx, req, res, r.configService, scope, accountId, userId)
+	if !ok {
+		return
+	}
+
+	// An explicit configVersionHash (or tag name) takes precedence over ref, as for records
+	if v := req.QueryParameter("configVersionHash"); v != "" {
+		if req.QueryParameter("asOf") != "" {
+			res.WriteErrorString(http.StatusBadRequest, "Only one of configVersionHash and asOf can be given")
+			return
+		}
+
+		hash := util.ConfigVersionHash(v)
+		listQuery := &config.ConfigRecordQuery{
+			Scope:             &scope,
+			AccountId:         &accountId,
+			UserId:            &userId,
+			ConfigVersionHash: &hash,
+		}
+		toVersion, ok = resolveRecordQueryVersion(ctx, res, r.configService, listQuery)
+		if !ok {
+			return
+		}
+	}
+
+	listConfigs := r.configService.ListConfigs
+	if req.QueryParameter("history") == "true" {
+		listConfigs = r.configService.ListConfigsWithHistory
+	}
+
+	recordList, err := listConfigs(ctx, nil, scope, accountId, userId, toVersion, nil)
 	if err != nil {
 		r.logger.Printf("Failed to list configs: %v\n", err)
 		res.WriteErrorString(http.StatusInternalServerError, "Failed to list configs")
@@ -100,6 +141,7 @@ func (r *ConfigRoute) getRecordList(req *restful.Request, res *restful.Response)
 
 	// Add Content-Range header
 	res.Header().Set("Content-Range", fmt.Sprintf("configs 0-%d/%d", len(recordList), len(recordList)))
+	writeVersionCacheHeaders(req, res, toVersion)
 
 	res.WriteEntity(recordList)
 }
@@ -110,6 +152,9 @@ type configRecordValues struct {
 
 type configDocumentInput struct {
 	Data *configRecordValues `json:"data"`
+	// The record version the client last saw, same as the If-Match header
+	ExpectedVersionHash *util.ConfigVersionHash `json:"expected_version_hash"`
+	configCommitInput
 }
 
 type uiMetadata interface{}
@@ -118,6 +163,13 @@ type configRecordCreateInput struct {
 	Data           *configRecordValues          `json:"data"`
 	RecordMetadata *config.ConfigRecordMetadata `json:"record_metadata"`
 	UiMetadata     *uiMetadata                  `json:"ui_metadata"`
+	// replace_all (the default) or deep_merge into the current values
+	Mode config.ValueSettingMode `json:"mode"`
+	// Merge strategies of a deep_merge, on top of those declared by the collection's schema
+	MergeStrategies config.ConfigMergeStrategies `json:"merge_strategies"`
+	// The record version the client last saw, same as the If-Match header
+	ExpectedVersionHash *util.ConfigVersionHash `json:"expected_version_hash"`
+	configCommitInput
 }
 
 type configRecordResponse struct {
@@ -141,9 +193,32 @@ func (r *ConfigRoute) getRecordValues(req *restful.Request, res *restful.Respons
 		return
 	}
 
-	// TODO: If version hash is provided, use it to get the record
+	ctx := context.Background()
 
-	version, err := r.configService.GetLatestRecord(context.Background(), nil, scope, accountId, userId, nil, nil, recordQuery)
+	toVersion, ok := resolveRequestRef(ctx, req, res, r.configService, scope, accountId, userId)
+	if !ok {
+		return
+	}
+
+	// An explicit configVersionHash (or tag name) takes precedence over ref
+	if recordQuery.ConfigVersionHash != nil {
+		if req.QueryParameter("asOf") != "" {
+			res.WriteErrorString(http.StatusBadRequest, "Only one of configVersionHash and asOf can be given")
+			return
+		}
+
+		toVersion, ok = resolveRecordQueryVersion(ctx, res, r.configService, recordQuery)
+		if !ok {
+			return
+		}
+	}
+
+	getLatestRecord := r.configService.GetLatestRecord
+	if req.QueryParameter("history") == "true" {
+		getLatestRecord = r.configService.GetLatestRecordWithHistory
+	}
+
+	version, err := getLatestRecord(ctx, nil, scope, accountId, userId, nil, toVersion, recordQuery)
 	if err != nil {
 		r.logger.Printf("Failed to get latest record: %v\n", err)
 		res.WriteErrorString(http.StatusInternalServerError, "Failed to get latest record")
@@ -188,12 +263,41 @@ func (r *ConfigRoute) getRecordValues(req *restful.Request, res *restful.Respons
 		RecordMetadata: version.RecordMetadata,
 	}
 
+	writeVersionCacheHeaders(req, res, toVersion)
+
 	res.WriteEntity(doc)
 }
 
+// Marks the response immutable when the version was requested by its hash. The records
+// at a hash never change, unlike those at a ref, tag or asOf time, so clients can pin
+// to the version and cache it for good.
+func writeVersionCacheHeaders(req *restful.Request, res *restful.Response, version *config.ConfigVersionRef) {
+	if version == nil || req.QueryParameter("asOf") != "" {
+		return
+	}
+
+	requested := req.PathParameter("configVersionHash")
+	if requested == "" {
+		requested = req.QueryParameter("configVersionHash")
+	}
+	if requested == "" {
+		requested = req.QueryParameter("ref")
+	}
+
+	hash := string(version.ConfigVersionHash)
+	if requested != hash {
+		return
+	}
+
+	res.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	res.Header().Set("ETag", `"`+hash+`"`)
+}
+
+// Replaces the contents of the record at the collection key (and item key) in the path,
+// creating it if it does not exist
 func (r *ConfigRoute) setRecordValuesByPath(req *restful.Request, res *restful.Response, withCollectionKey bool, withItemKey bool) {
 
-	scope, _, _ := util.GetRequestScopeAndIds(req)
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
 	if scope == util.ScopeKindInvalid {
 		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
 		return
@@ -213,14 +317,124 @@ func (r *ConfigRoute) setRecordValuesByPath(req *restful.Request, res *restful.R
 		return
 	}
 
-	// Read Data from request
-	// configInput := &util.Data{}
+	kind := config.ConfigRecordKindKeyed
+	if withItemKey {
+		kind = config.ConfigRecordKindDocument
+	}
+	recordMetadata.RecordKind = &kind
+
 	configInput := &configDocumentInput{}
 
 	if err := req.ReadEntity(configInput); err != nil {
 		res.WriteErrorString(http.StatusBadRequest, "Invalid config values")
 		return
 	}
+
+	if configInput.Data == nil || configInput.Data.Data == nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid data (data.data)")
+		return
+	}
+
+	if !readCommitHeaders(req, res, &configInput.configCommitInput) {
+		return
+	}
+
+	r.setRecordValues(req, res, scope, accountId, userId, configInput.Data.Data, recordMetadata, config.ValueSettingModeReplace, nil, configInput.ExpectedVersionHash, &configInput.configCommitInput)
+}
+
+const (
+	mimeJsonPatch  = "application/json-patch+json"
+	mimeMergePatch = "application/merge-patch+json"
+)
+
+// Applies the JSON Patch or Merge Patch in the body (chosen by Content-Type) to the
+// record at the collection key (and item key) in the path, the record must exist
+func (r *ConfigRoute) patchRecordValuesByPath(req *restful.Request, res *restful.Response, withItemKey bool) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	var format config.ConfigPatchFormat
+	mediaType, _, _ := mime.ParseMediaType(req.HeaderParameter("Content-Type"))
+	switch mediaType {
+	case mimeJsonPatch:
+		format = config.ConfigPatchFormatJsonPatch
+	case mimeMergePatch:
+		format = config.ConfigPatchFormatMergePatch
+	default:
+		res.WriteErrorString(http.StatusUnsupportedMediaType, "Content-Type must be "+mimeJsonPatch+" or "+mimeMergePatch)
+		return
+	}
+
+	recordQuery := getRecordQuery(req, res, true, withItemKey, false)
+	if recordQuery == nil {
+		return
+	} else if recordQuery.ConfigVersionHash != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Cannot set values by version hash")
+		return
+	}
+
+	recordMetadata := recordQuery.AsMetadata()
+	if recordMetadata == nil {
+		res.WriteErrorString(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	kind := config.ConfigRecordKindKeyed
+	if withItemKey {
+		kind = config.ConfigRecordKindDocument
+	}
+	recordMetadata.RecordKind = &kind
+
+	patch, err := io.ReadAll(req.Request.Body)
+	if err != nil || len(patch) == 0 {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid patch")
+		return
+	}
+
+	// Patch bodies have no room for the commit message
+	commit := &configCommitInput{}
+	if !readCommitHeaders(req, res, commit) {
+		return
+	}
+
+	ctx := context.Background()
+
+	options := &config.SetRecordValuesOptions{
+		Note:     commit.Note,
+		Trailers: commit.Trailers,
+	}
+
+	options.RefName = getRequestBranchName(req)
+
+	if ifMatch := getIfMatchVersionHash(req); ifMatch != nil {
+		options.ExpectedVersionHash = *ifMatch
+	}
+
+	newNode, values, err := r.configService.PatchRecordValues(ctx, nil, scope, accountId, userId, kind, recordMetadata, format, patch, options)
+	if writeConflictError(res, err) {
+		return
+	} else if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to patch config values: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to patch config values")
+		}
+		return
+	}
+
+	res.Header().Set("X-Config-Version-Hash", string(newNode.VersionRef.ConfigVersionHash))
+
+	recordKey := string(recordMetadata.CollectionKey)
+	if recordMetadata.ItemKey != nil {
+		recordKey += "/" + string(*recordMetadata.ItemKey)
+	}
+
+	res.WriteEntity(&configRecordResponse{
+		Id:   recordKey,
+		Data: &configRecordValues{Data: values},
+	})
 }
 
 func (r *ConfigRoute) setRecordValuesFromPost(req *restful.Request, res *restful.Response, kind config.ConfigRecordKind) {
@@ -260,12 +474,85 @@ func (r *ConfigRoute) setRecordValuesFromPost(req *restful.Request, res *restful
 		return
 	}
 
+	mode := input.Mode
+	switch mode {
+	case "":
+		mode = config.ValueSettingModeReplace
+	case config.ValueSettingModeReplace, config.ValueSettingModeDeepMerge:
+	default:
+		res.WriteErrorString(http.StatusBadRequest, "Invalid mode (replace_all or deep_merge)")
+		return
+	}
+
+	if len(input.MergeStrategies) > 0 && mode != config.ValueSettingModeDeepMerge {
+		res.WriteErrorString(http.StatusBadRequest, "Merge strategies require the deep_merge mode")
+		return
+	}
+
 	recordMetadata := input.RecordMetadata
+	recordMetadata.RecordKind = &kind
+
+	if !readCommitHeaders(req, res, &input.configCommitInput) {
+		return
+	}
+
+	r.setRecordValues(req, res, scope, accountId, userId, input.Data.Data, recordMetadata, mode, input.MergeStrategies, input.ExpectedVersionHash, &input.configCommitInput)
+}
+
+// Returns the version hash from the If-Match header, without quotes or the weak prefix
+func getIfMatchVersionHash(req *restful.Request) *util.ConfigVersionHash {
+	v := strings.TrimSpace(req.HeaderParameter("If-Match"))
+	v = strings.Trim(strings.TrimPrefix(v, "W/"), "\"")
+	if v == "" {
+		return nil
+	}
+	return util.ConfigVersionHashPtr(util.ConfigVersionHash(v))
+}
+
+// Returns the branch named by the ref query parameter of a write, "" for head. Writes to
+// a branch that does not exist fail with ErrReferenceNotFound.
+func getRequestBranchName(req *restful.Request) string {
+	if refName := req.QueryParameter("ref"); refName != string(config.ConfigReferenceKindHead) {
+		return refName
+	}
+	return ""
+}
 
-	r.setRecordValues(req, res, accountId, userId, input.Data.Data, recordMetadata)
+// The commit message of a write, stored as the note and trailers of the new versions
+type configCommitInput struct {
+	Note string `json:"note"`
+	// e.g. {"Ticket": "CHG-1234", "Reason": "rollout"}
+	Trailers config.ConfigCommitTrailers `json:"trailers"`
 }
 
-func (r *ConfigRoute) setRecordValues(req *restful.Request, res *restful.Response, accountId util.AccountId, userId util.UserId, data *util.Data, recordMetadata *config.ConfigRecordMetadata) {
+// Fills in the commit message from the X-Config-Commit-Message and X-Config-Commit-Trailer
+// ("Key: value", repeatable) headers, the body takes precedence. Writes the error response
+// and returns false on failure.
+func readCommitHeaders(req *restful.Request, res *restful.Response, commit *configCommitInput) bool {
+	if commit.Note == "" {
+		commit.Note = strings.TrimSpace(req.HeaderParameter("X-Config-Commit-Message"))
+	}
+
+	for _, header := range req.Request.Header.Values("X-Config-Commit-Trailer") {
+		key, value, ok := strings.Cut(header, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			res.WriteErrorString(http.StatusBadRequest, "Invalid X-Config-Commit-Trailer header (expected Key: value)")
+			return false
+		}
+
+		if commit.Trailers == nil {
+			commit.Trailers = config.ConfigCommitTrailers{}
+		}
+		if _, exists := commit.Trailers[key]; !exists {
+			commit.Trailers[key] = value
+		}
+	}
+
+	return true
+}
+
+func (r *ConfigRoute) setRecordValues(req *restful.Request, res *restful.Response, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, data *util.Data, recordMetadata *config.ConfigRecordMetadata, mode config.ValueSettingMode, mergeStrategies config.ConfigMergeStrategies, expectedVersionHash *util.ConfigVersionHash, commit *configCommitInput) {
 
 	// TODO: See if there's a better context to use from the request
 	ctx := context.Background()
@@ -282,10 +569,35 @@ func (r *ConfigRoute) setRecordValues(req *restful.Request, res *restful.Respons
 
 	r.logger.Printf("Input values: %+v\n", inputValues)
 
-	newNode, err := r.configService.SetRecordValues(ctx, nil, util.ScopeKindAccount, accountId, userId, config.ConfigRecordKindKeyed, recordMetadata, config.ValueSettingModeReplace, inputValues)
-	if err != nil {
-		r.logger.Printf("Failed to write config values: %v\n", err)
-		res.WriteErrorString(http.StatusInternalServerError, "Failed to write config values")
+	options := &config.SetRecordValuesOptions{
+		Note:            commit.Note,
+		Trailers:        commit.Trailers,
+		MergeStrategies: mergeStrategies,
+	}
+
+	options.RefName = getRequestBranchName(req)
+
+	// The If-Match header takes precedence over the body
+	if ifMatch := getIfMatchVersionHash(req); ifMatch != nil {
+		expectedVersionHash = ifMatch
+	}
+	if expectedVersionHash != nil {
+		options.ExpectedVersionHash = *expectedVersionHash
+	}
+
+	kind := config.ConfigRecordKindKeyed
+	if recordMetadata.RecordKind != nil {
+		kind = *recordMetadata.RecordKind
+	}
+
+	newNode, err := r.configService.SetRecordValuesWithOptions(ctx, nil, scope, accountId, userId, kind, recordMetadata, mode, inputValues, options)
+	if writeConflictError(res, err) {
+		return
+	} else if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to write config values: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to write config values")
+		}
 		return
 	}
 
@@ -303,6 +615,21 @@ func (r *ConfigRoute) setRecordValues(req *restful.Request, res *restful.Respons
 		recordKey += "/" + string(*recordMetadata.ItemKey)
 	}
 
+	// The merged values are only known once written
+	if mode == config.ValueSettingModeDeepMerge {
+		merged, err := r.configService.GetLatestRecord(ctx, nil, scope, accountId, userId, nil, &newVersion, &config.ConfigRecordQuery{
+			RecordKind:    &kind,
+			CollectionKey: &recordMetadata.CollectionKey,
+			ItemKey:       recordMetadata.ItemKey,
+		})
+		if err != nil || merged == nil {
+			r.logger.Printf("Failed to read merged config values: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to read merged config values")
+			return
+		}
+		inputValues = merged.RecordContents
+	}
+
 	output := &configRecordResponse{
 		Id:   recordKey,
 		Data: &configRecordValues{Data: inputValues},
@@ -311,6 +638,188 @@ func (r *ConfigRoute) setRecordValues(req *restful.Request, res *restful.Respons
 	res.WriteHeaderAndEntity(http.StatusCreated, output)
 }
 
+// Deletes the record by writing a tombstone, its history stays readable
+func (r *ConfigRoute) deleteRecordValues(req *restful.Request, res *restful.Response, withItemKey bool) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	recordQuery := getRecordQuery(req, res, true, withItemKey, false)
+	if recordQuery == nil {
+		return
+	} else if recordQuery.ConfigVersionHash != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Cannot delete values by version hash")
+		return
+	}
+
+	recordMetadata := recordQuery.AsMetadata()
+	if recordMetadata == nil {
+		res.WriteErrorString(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	kind := config.ConfigRecordKindKeyed
+	if withItemKey {
+		kind = config.ConfigRecordKindDocument
+	}
+	recordMetadata.RecordKind = &kind
+
+	commit := &configCommitInput{}
+	if !readCommitHeaders(req, res, commit) {
+		return
+	}
+
+	ctx := context.Background()
+
+	options := &config.SetRecordValuesOptions{
+		Note:     commit.Note,
+		Trailers: commit.Trailers,
+	}
+
+	options.RefName = getRequestBranchName(req)
+
+	if ifMatch := getIfMatchVersionHash(req); ifMatch != nil {
+		options.ExpectedVersionHash = *ifMatch
+	}
+
+	newNode, err := r.configService.DeleteRecord(ctx, nil, scope, accountId, userId, kind, recordMetadata, options)
+	if writeConflictError(res, err) {
+		return
+	} else if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to delete record: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to delete record")
+		}
+		return
+	}
+
+	res.Header().Set("X-Config-Version-Hash", string(newNode.VersionRef.ConfigVersionHash))
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+type configMoveInput struct {
+	From *config.ConfigRecordMetadata `json:"from"`
+	To   *config.ConfigRecordMetadata `json:"to"`
+	// The version of the moved record the client last saw, same as the If-Match header
+	ExpectedVersionHash *util.ConfigVersionHash `json:"expected_version_hash"`
+	configCommitInput
+}
+
+func (r *ConfigRoute) postMove(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	input := &configMoveInput{}
+	if err := req.ReadEntity(input); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if input.From == nil || input.From.CollectionKey == "" {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request (from.record_collection_key is required)")
+		return
+	}
+	if input.To == nil || input.To.CollectionKey == "" {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request (to.record_collection_key is required)")
+		return
+	}
+
+	if !readCommitHeaders(req, res, &input.configCommitInput) {
+		return
+	}
+
+	ctx := context.Background()
+
+	options := &config.SetRecordValuesOptions{
+		Note:     input.Note,
+		Trailers: input.Trailers,
+	}
+
+	options.RefName = getRequestBranchName(req)
+
+	expectedVersionHash := input.ExpectedVersionHash
+	if ifMatch := getIfMatchVersionHash(req); ifMatch != nil {
+		expectedVersionHash = ifMatch
+	}
+	if expectedVersionHash != nil {
+		options.ExpectedVersionHash = *expectedVersionHash
+	}
+
+	result, err := r.configService.MoveRecord(ctx, nil, scope, accountId, userId, input.From, input.To, options)
+	if writeConflictError(res, err) {
+		return
+	} else if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to move record: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to move record")
+		}
+		return
+	}
+
+	res.Header().Set("X-Config-Version-Hash", string(result.NodeMetadata.VersionRef.ConfigVersionHash))
+
+	res.WriteEntity(result)
+}
+
+type configBatchInput struct {
+	Writes []config.ConfigBatchWrite `json:"writes"`
+	// Stored on every version written by the batch
+	configCommitInput
+}
+
+func (r *ConfigRoute) postBatch(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	input := &configBatchInput{}
+	if err := req.ReadEntity(input); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if len(input.Writes) == 0 {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request (writes is required)")
+		return
+	}
+
+	if !readCommitHeaders(req, res, &input.configCommitInput) {
+		return
+	}
+
+	ctx := context.Background()
+
+	options := &config.ConfigBatchOptions{
+		Note:     input.Note,
+		Trailers: input.Trailers,
+	}
+
+	options.RefName = getRequestBranchName(req)
+
+	result, err := r.configService.CommitBatch(ctx, nil, scope, accountId, userId, input.Writes, options)
+	if writeConflictError(res, err) {
+		return
+	} else if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to write batch: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to write batch")
+		}
+		return
+	}
+
+	res.Header().Set("X-Config-Version-Hash", string(result.NodeMetadata.VersionRef.ConfigVersionHash))
+
+	res.WriteHeaderAndEntity(http.StatusCreated, result)
+}
+
 func (r *ConfigRoute) postKeyedConfigValues(req *restful.Request, res *restful.Response) {
 	r.setRecordValuesFromPost(req, res, config.ConfigRecordKindKeyed)
 }
@@ -319,10 +828,18 @@ func (r *ConfigRoute) putKeyedConfigValues(req *restful.Request, res *restful.Re
 	r.setRecordValuesByPath(req, res, true, false)
 }
 
+func (r *ConfigRoute) patchKeyedConfigValues(req *restful.Request, res *restful.Response) {
+	r.patchRecordValuesByPath(req, res, false)
+}
+
 func (r *ConfigRoute) getKeyedConfigValues(req *restful.Request, res *restful.Response) {
 	r.getRecordValues(req, res, true, false, false)
 }
 
+func (r *ConfigRoute) deleteKeyedConfigValues(req *restful.Request, res *restful.Response) {
+	r.deleteRecordValues(req, res, false)
+}
+
 func (r *ConfigRoute) postDocumentValues(req *restful.Request, res *restful.Response) {
 	r.setRecordValuesFromPost(req, res, config.ConfigRecordKindDocument)
 }
@@ -331,57 +848,157 @@ func (r *ConfigRoute) putDocumentValues(req *restful.Request, res *restful.Respo
 	r.setRecordValuesByPath(req, res, true, true)
 }
 
+func (r *ConfigRoute) patchDocumentValues(req *restful.Request, res *restful.Response) {
+	r.patchRecordValuesByPath(req, res, true)
+}
+
 func (r *ConfigRoute) getDocumentValues(req *restful.Request, res *restful.Response) {
 	r.getRecordValues(req, res, true, true, false)
 }
 
+func (r *ConfigRoute) deleteDocumentValues(req *restful.Request, res *restful.Response) {
+	r.deleteRecordValues(req, res, true)
+}
+
 // Prefixed routes
 func (r *ConfigRoute) Prefixed(ws *restful.WebService, prefix string) {
 
 	ws.Route(ws.GET(prefix + "/configs").
 		To(r.getRecordList).
 		Doc("List all config records").
+		Param(ws.QueryParameter("ref", "Branch, tag, ref or version hash to read from (defaults to head)").DataType("string")).
+		Param(ws.QueryParameter("stage", "Read the version promoted to this stage instead of head").DataType("string")).
+		Param(ws.QueryParameter("asOf", "Read the newest version of the ref committed at or before this RFC3339 time").DataType("string")).
+		Param(ws.QueryParameter("configVersionHash", "Version hash or tag name to read, responses for a hash are immutable").DataType("string")).
+		Param(ws.QueryParameter("history", "Include the history of each record (walks the version chain)").DataType("boolean")).
 		Writes([]config.ConfigListEntry{}))
 
 	ws.Route(ws.POST(prefix + "/configs").
 		To(r.postKeyedConfigValues).
-		Doc("Create a new keyed config (has only a collection key)").
+		Doc("Create a new keyed config (has only a collection key), or deep merge into it with mode deep_merge").
+		Param(ws.QueryParameter("ref", "Branch to write to (defaults to head)").DataType("string")).
+		Param(ws.HeaderParameter("If-Match", "Version hash the client last saw, the write fails with 409 if the record has changed since (* requires an existing record)").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new version, the body note takes precedence").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
 		Reads(configRecordCreateInput{}).
 		Writes(configRecordResponse{}))
 
+	ws.Route(ws.POST(prefix + "/move").
+		To(r.postMove).
+		Doc("Move a record to another collection and item key, its history follows it to the new key").
+		Param(ws.QueryParameter("ref", "Branch to write to (defaults to head)").DataType("string")).
+		Param(ws.HeaderParameter("If-Match", "Version hash of the moved record the client last saw, the move fails with 409 if it has changed since").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new version, the body note takes precedence").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
+		Reads(configMoveInput{}).
+		Writes(config.ConfigMoveResult{}))
+
+	ws.Route(ws.POST(prefix + "/batch").
+		To(r.postBatch).
+		Doc("Write several records as a single commit, either every write is committed or none are").
+		Param(ws.QueryParameter("ref", "Branch to write to (defaults to head)").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new version, the body note takes precedence").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
+		Reads(configBatchInput{}).
+		Writes(config.ConfigBatchResult{}))
+
 	ws.Route(ws.PUT(prefix + "/configs/{collectionKey}").
 		To(r.putKeyedConfigValues).
-		Doc("Set values for a keyed config (only has a collection key)").
+		Doc("Replace the values of a keyed config (only has a collection key), creating it if it does not exist").
 		Param(ws.PathParameter("collectionKey", "The config key").DataType("string")).
-		Reads(util.Data{}).
-		Writes(nil))
+		Param(ws.QueryParameter("ref", "Branch to write to (defaults to head)").DataType("string")).
+		Param(ws.HeaderParameter("If-Match", "Version hash the client last saw, the write fails with 409 if the record has changed since (* requires an existing record)").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new version, the body note takes precedence").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
+		Reads(configDocumentInput{}).
+		Writes(configRecordResponse{}))
+
+	ws.Route(ws.PATCH(prefix+"/configs/{collectionKey}").
+		To(r.patchKeyedConfigValues).
+		Doc("Patch the values of a keyed config with a JSON Patch (RFC 6902) or Merge Patch (RFC 7396), if any operation or test fails nothing is written").
+		Consumes(mimeJsonPatch, mimeMergePatch).
+		Param(ws.PathParameter("collectionKey", "The config key").DataType("string")).
+		Param(ws.QueryParameter("ref", "Branch to write to (defaults to head)").DataType("string")).
+		Param(ws.HeaderParameter("If-Match", "Version hash the client last saw, the patch fails with 409 if the record has changed since").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new version").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
+		Writes(configRecordResponse{}))
 
 	ws.Route(ws.GET(prefix + "/configs/{collectionKey}").
 		To(r.getKeyedConfigValues).
 		Doc("Get values for a keyed config (only has a collection key)").
 		Param(ws.PathParameter("collectionKey", "The config key").DataType("string")).
+		Param(ws.QueryParameter("ref", "Branch, tag, ref or version hash to read from (defaults to head)").DataType("string")).
+		Param(ws.QueryParameter("stage", "Read the version promoted to this stage instead of head").DataType("string")).
+		Param(ws.QueryParameter("asOf", "Read the newest version of the ref committed at or before this RFC3339 time").DataType("string")).
+		Param(ws.QueryParameter("configVersionHash", "Version hash or tag name to read, responses for a hash are immutable").DataType("string")).
+		Param(ws.QueryParameter("history", "Include the history of each record (walks the version chain)").DataType("boolean")).
 		Writes(util.Data{}))
 
+	ws.Route(ws.DELETE(prefix + "/configs/{collectionKey}").
+		To(r.deleteKeyedConfigValues).
+		Doc("Delete a keyed config, its history stays readable and a later write brings it back").
+		Param(ws.PathParameter("collectionKey", "The config key").DataType("string")).
+		Param(ws.QueryParameter("ref", "Branch to write to (defaults to head)").DataType("string")).
+		Param(ws.HeaderParameter("If-Match", "Version hash the client last saw, the delete fails with 409 if the record has changed since").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new version").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")))
+
 	ws.Route(ws.POST(prefix + "/configs/{collectionKey}").
 		To(r.postDocumentValues).
-		Doc("Create a new config document (has both a collection key and an item key)").
+		Doc("Create a new config document (has both a collection key and an item key), or deep merge into it with mode deep_merge").
 		Param(ws.PathParameter("collectionKey", "The config document key").DataType("string")).
+		Param(ws.QueryParameter("ref", "Branch to write to (defaults to head)").DataType("string")).
+		Param(ws.HeaderParameter("If-Match", "Version hash the client last saw, the write fails with 409 if the record has changed since (* requires an existing record)").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new version, the body note takes precedence").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
 		Reads(configRecordCreateInput{}).
 		Writes(configRecordResponse{}))
 
 	ws.Route(ws.PUT(prefix + "/configs/{collectionKey}/{itemKey}").
 		To(r.putDocumentValues).
-		Doc("Set values for a config document (has both a collection key and an item key)").
+		Doc("Replace the values of a config document (has both a collection key and an item key), creating it if it does not exist").
 		Param(ws.PathParameter("collectionKey", "The config document key").DataType("string")).
 		Param(ws.PathParameter("itemKey", "The config document id").DataType("string")).
-		Reads(util.Data{}).
-		Writes(nil))
+		Param(ws.QueryParameter("ref", "Branch to write to (defaults to head)").DataType("string")).
+		Param(ws.HeaderParameter("If-Match", "Version hash the client last saw, the write fails with 409 if the record has changed since (* requires an existing record)").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new version, the body note takes precedence").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
+		Reads(configDocumentInput{}).
+		Writes(configRecordResponse{}))
+
+	ws.Route(ws.PATCH(prefix+"/configs/{collectionKey}/{itemKey}").
+		To(r.patchDocumentValues).
+		Doc("Patch the values of a config document with a JSON Patch (RFC 6902) or Merge Patch (RFC 7396), if any operation or test fails nothing is written").
+		Consumes(mimeJsonPatch, mimeMergePatch).
+		Param(ws.PathParameter("collectionKey", "The config document key").DataType("string")).
+		Param(ws.PathParameter("itemKey", "The config document id").DataType("string")).
+		Param(ws.QueryParameter("ref", "Branch to write to (defaults to head)").DataType("string")).
+		Param(ws.HeaderParameter("If-Match", "Version hash the client last saw, the patch fails with 409 if the record has changed since").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new version").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
+		Writes(configRecordResponse{}))
 
 	ws.Route(ws.GET(prefix + "/configs/{collectionKey}/{itemKey}").
 		To(r.getDocumentValues).
 		Doc("Get values for a config document (has both a collection key and an item key)").
 		Param(ws.PathParameter("collectionKey", "The config document key").DataType("string")).
 		Param(ws.PathParameter("itemKey", "The config document id").DataType("string")).
+		Param(ws.QueryParameter("ref", "Branch, tag, ref or version hash to read from (defaults to head)").DataType("string")).
+		Param(ws.QueryParameter("stage", "Read the version promoted to this stage instead of head").DataType("string")).
+		Param(ws.QueryParameter("asOf", "Read the newest version of the ref committed at or before this RFC3339 time").DataType("string")).
+		Param(ws.QueryParameter("configVersionHash", "Version hash or tag name to read, responses for a hash are immutable").DataType("string")).
+		Param(ws.QueryParameter("history", "Include the history of each record (walks the version chain)").DataType("boolean")).
 		Writes(util.Data{}))
 
+	ws.Route(ws.DELETE(prefix + "/configs/{collectionKey}/{itemKey}").
+		To(r.deleteDocumentValues).
+		Doc("Delete a config document, its history stays readable and a later write brings it back").
+		Param(ws.PathParameter("collectionKey", "The config document key").DataType("string")).
+		Param(ws.PathParameter("itemKey", "The config document id").DataType("string")).
+		Param(ws.QueryParameter("ref", "Branch to write to (defaults to head)").DataType("string")).
+		Param(ws.HeaderParameter("If-Match", "Version hash the client last saw, the delete fails with 409 if the record has changed since").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new version").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")))
+
 }
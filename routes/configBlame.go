@@ -0,0 +1,102 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	restful "github.com/emicklei/go-restful/v3"
+	"github.com/tmzt/config-api/config"
+	"github.com/tmzt/config-api/util"
+)
+
+type ConfigBlameRoute struct {
+	logger        util.SetRequestLogger
+	configService *config.ConfigService
+}
+
+func NewConfigBlameRoute(resource *config.ConfigService) *ConfigBlameRoute {
+	logger := util.NewLogger("ConfigBlameRoute", 0)
+
+	return &ConfigBlameRoute{
+		logger:        logger,
+		configService: resource,
+	}
+}
+
+func (r *ConfigBlameRoute) getBlame(req *restful.Request, res *restful.Response, withItemKey bool) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	recordQuery := getRecordQuery(req, res, true, withItemKey, false)
+	if recordQuery == nil {
+		return
+	}
+
+	ctx := context.Background()
+
+	toVersion, ok := resolveRequestRef(ctx, req, res, r.configService, scope, accountId, userId)
+	if !ok {
+		return
+	}
+
+	if recordQuery.ConfigVersionHash != nil {
+		if req.QueryParameter("asOf") != "" {
+			res.WriteErrorString(http.StatusBadRequest, "Only one of configVersionHash and asOf can be given")
+			return
+		}
+
+		toVersion, ok = resolveRecordQueryVersion(ctx, res, r.configService, recordQuery)
+		if !ok {
+			return
+		}
+	}
+
+	blame, err := r.configService.Blame(ctx, nil, scope, accountId, userId, toVersion, recordQuery)
+	if err != nil {
+		r.logger.Printf("Failed to blame record: %v\n", err)
+		res.WriteErrorString(http.StatusInternalServerError, "Failed to blame record")
+		return
+	} else if blame == nil {
+		res.WriteErrorString(http.StatusNotFound, "Record not found")
+		return
+	}
+
+	writeVersionCacheHeaders(req, res, toVersion)
+
+	res.WriteEntity(blame)
+}
+
+func (r *ConfigBlameRoute) getKeyedConfigBlame(req *restful.Request, res *restful.Response) {
+	r.getBlame(req, res, false)
+}
+
+func (r *ConfigBlameRoute) getDocumentBlame(req *restful.Request, res *restful.Response) {
+	r.getBlame(req, res, true)
+}
+
+func (r *ConfigBlameRoute) Prefixed(ws *restful.WebService, prefix string) {
+
+	ws.Route(ws.GET(prefix + "/config/blame/configs/{collectionKey}").
+		To(r.getKeyedConfigBlame).
+		Doc("Get the version that last changed each field of a keyed config").
+		Param(ws.PathParameter("collectionKey", "The config key").DataType("string")).
+		Param(ws.QueryParameter("ref", "Branch, tag, ref or version hash to read from (defaults to head)").DataType("string")).
+		Param(ws.QueryParameter("stage", "Read the version promoted to this stage instead of head").DataType("string")).
+		Param(ws.QueryParameter("asOf", "Read the newest version of the ref committed at or before this RFC3339 time").DataType("string")).
+		Param(ws.QueryParameter("configVersionHash", "Version hash or tag name to read, responses for a hash are immutable").DataType("string")).
+		Writes(config.ConfigBlame{}))
+
+	ws.Route(ws.GET(prefix + "/config/blame/configs/{collectionKey}/{itemKey}").
+		To(r.getDocumentBlame).
+		Doc("Get the version that last changed each field of a config document").
+		Param(ws.PathParameter("collectionKey", "The config document key").DataType("string")).
+		Param(ws.PathParameter("itemKey", "The config document id").DataType("string")).
+		Param(ws.QueryParameter("ref", "Branch, tag, ref or version hash to read from (defaults to head)").DataType("string")).
+		Param(ws.QueryParameter("stage", "Read the version promoted to this stage instead of head").DataType("string")).
+		Param(ws.QueryParameter("asOf", "Read the newest version of the ref committed at or before this RFC3339 time").DataType("string")).
+		Param(ws.QueryParameter("configVersionHash", "Version hash or tag name to read, responses for a hash are immutable").DataType("string")).
+		Writes(config.ConfigBlame{}))
+}
@@ -50,142 +50,99 @@ func NewConfigDiffRoute(resource *config.ConfigService) *ConfigDiffRoute {
 // 	res.WriteEntity(configValues)
 // }
 
-// func (r *ConfigDiffRoute) getDiffsBetweenHashesWithParams(req *restful.Request, res *restful.Response, params *config.ConfigDiffParams) {
-// 	scope, accountId, userId := util.GetRequestScopeAndIds(req)
-// 	if scope == util.ScopeKindInvalid {
-// 		res.WriteErrorString(http.StatusForbidden, "Invalid request scope")
-// 		return
-// 	}
-
-// 	if params == nil {
-// 		params = &config.ConfigDiffParams{}
-// 	}
-
-// 	fromHashParam := req.PathParameter("fromHash")
-// 	toHashParam := req.PathParameter("toHash")
-
-// 	var fromHash *util.ConfigVersionHash
-// 	if fromHashParam != "" {
-// 		fromHash = util.ConfigVersionHashPtr(util.ConfigVersionHash(fromHashParam))
-// 		params.From = &config.ConfigDiffSpec{
-// 			Version: &config.ConfigVersionRef{
-// 				ConfigVersionHash: *fromHash,
-// 			},
-// 		}
-// 	}
-
-// 	var toHash *util.ConfigVersionHash
-// 	if toHashParam != "" {
-// 		toHash = util.ConfigVersionHashPtr(util.ConfigVersionHash(toHashParam))
-// 		params.To = &config.ConfigDiffSpec{
-// 			Version: &config.ConfigVersionRef{
-// 				ConfigVersionHash: *toHash,
-// 			},
-// 		}
-// 	}
-
-// 	versions, err := r.configService.GetDiffsWithParams(context.Background(), nil, scope, accountId, userId, params)
-// 	if err != nil {
-// 		res.WriteErrorString(http.StatusInternalServerError, "Failed to get versions")
-// 		return
-// 	}
-
-// 	res.WriteEntity(versions)
-// }
-
-// func (r *ConfigDiffRoute) getDiffsBetweenHashesWithRecordQuery(req *restful.Request, res *restful.Response, recordQuery *config.ConfigRecordQuery) {
-
-// 	diffParams := &config.ConfigDiffParams{
-// 		IncludeObject:         true,
-// 		IncludePreviousObject: true,
-// 		IncludePatch:          true,
-// 	}
-
-// 	r.getDiffsBetweenHashesWithParams(req, res, diffParams)
-// }
-
-// func (r *ConfigDiffRoute) getVersionsBetweenHashes(req *restful.Request, res *restful.Response) {
-// 	r.getDiffsBetweenHashesWithParams(req, res, nil)
-// }
-
-// func (r *ConfigDiffRoute) getDiffsBetweenHashes(req *restful.Request, res *restful.Response) {
-// 	diffParams := &config.ConfigDiffParams{
-// 		IncludeObject:         true,
-// 		IncludePreviousObject: true,
-// 		IncludePatch:          true,
-// 	}
-
-// 	r.getDiffsBetweenHashesWithParams(req, res, diffParams)
-// }
-
-func (r *ConfigDiffRoute) getKeyedConfigDiffs(req *restful.Request, res *restful.Response) {
+// Returns the name of one side of the diff, the path parameter or else the query parameter
+func getDiffSideName(req *restful.Request, pathParam string, queryParam string) string {
+	if v := req.PathParameter(pathParam); v != "" {
+		return v
+	}
+	return req.QueryParameter(queryParam)
+}
 
+// Diffs the versions between the from and to sides of the request, each may be a version
+// hash, tag, branch, head, root or stage/<stage>
+func (r *ConfigDiffRoute) getDiffsWithParams(req *restful.Request, res *restful.Response, diffParams *config.ConfigDiffParams) {
 	scope, accountId, userId := util.GetRequestScopeAndIds(req)
 	if scope == util.ScopeKindInvalid {
 		res.WriteErrorString(http.StatusForbidden, "Unauthorized request")
 		return
 	}
 
+	diffParams.From = &config.ConfigDiffSpec{Name: getDiffSideName(req, "fromHash", "from")}
+	diffParams.To = &config.ConfigDiffSpec{Name: getDiffSideName(req, "toHash", "to")}
+
+	diffService := r.configService.GetConfigDiffService()
+
+	versions, err := diffService.GetVersionChain(context.Background(), nil, scope, accountId, userId, diffParams)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to get versions: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to get versions")
+		}
+		return
+	}
+
+	res.WriteEntity(versions)
+}
+
+func (r *ConfigDiffRoute) getKeyedConfigDiffs(req *restful.Request, res *restful.Response) {
 	configCollectionKeyStr := req.PathParameter("configCollectionKey")
 	if configCollectionKeyStr == "" {
 		res.WriteErrorString(http.StatusBadRequest, "Invalid collection key")
 		return
 	}
 
-	// resourceConds := config.ConfigQueryValues{
-	// 	"config_key": util.ConfigKey(configCollectionKeyStr),
-	// }
-
+	kind := config.ConfigRecordKindKeyed
 	recordQuery := &config.ConfigRecordQuery{
+		RecordKind:    &kind,
 		CollectionKey: util.ConfigCollectionKeyPtr(configCollectionKeyStr),
 	}
 
-	// r.getDiffsBetweenHashesWithRecordQuery(req, res, recordQuery)
-	// r.configService.GetConfigDiffService().GetVersionChain()
-
-	diffService := r.configService.GetConfigDiffService()
-
-	diffParams := &config.ConfigDiffParams{
+	r.getDiffsWithParams(req, res, &config.ConfigDiffParams{
 		ConfigRecordQuery:          recordQuery,
 		IncludeRecordContentsPatch: true,
 		IncludeObject:              true,
 		OnlyMatching:               true,
-	}
+	})
+}
 
-	versions, err := diffService.GetVersionChain(context.Background(), nil, scope, accountId, userId, diffParams)
-	if err != nil {
-		res.WriteErrorString(http.StatusInternalServerError, "Failed to get versions")
+func (r *ConfigDiffRoute) getDocumentConfigDiffs(req *restful.Request, res *restful.Response) {
+	configCollectionKeyStr := req.PathParameter("configCollectionKey")
+	if configCollectionKeyStr == "" {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid config document key")
 		return
 	}
 
-	res.WriteEntity(versions)
-}
-
-// func (r *ConfigDiffRoute) getDocumentConfigDiffs(req *restful.Request, res *restful.Response) {
-// 	configCollectionKeyStr := req.PathParameter("configCollectionKey")
-// 	if configCollectionKeyStr == "" {
-// 		res.WriteErrorString(http.StatusBadRequest, "Invalid config document key")
-// 		return
-// 	}
+	configItemKeyStr := req.PathParameter("configItemKey")
+	if configItemKeyStr == "" {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid config document id")
+		return
+	}
 
-// 	configItemKeyStr := req.PathParameter("configItemKey")
-// 	if configItemKeyStr == "" {
-// 		res.WriteErrorString(http.StatusBadRequest, "Invalid config document id")
-// 		return
-// 	}
+	kind := config.ConfigRecordKindDocument
+	recordQuery := &config.ConfigRecordQuery{
+		RecordKind:    &kind,
+		CollectionKey: util.ConfigCollectionKeyPtr(configCollectionKeyStr),
+		ItemKey:       util.ConfigItemKeyPtr(configItemKeyStr),
+	}
 
-// 	// resourceConds := config.ConfigQueryValues{
-// 	// 	"config_document_key": util.ConfigDocumentKey(configCollectionKeyStr),
-// 	// 	"config_document_id":  util.ConfigDocumentId(configItemKeyStr),
-// 	// }
+	r.getDiffsWithParams(req, res, &config.ConfigDiffParams{
+		ConfigRecordQuery:          recordQuery,
+		IncludeRecordContentsPatch: true,
+		IncludeObject:              true,
+		OnlyMatching:               true,
+	})
+}
 
-// 	recordQuery := &config.ConfigRecordQuery{
-// 		CollectionKey: util.ConfigCollectionKeyPtr(configCollectionKeyStr),
-// 		ItemKey:       util.ConfigItemKeyPtr(configItemKeyStr),
-// 	}
+// Every version in the range with the records it wrote, contents and patches are only
+// included with patch=true
+func (r *ConfigDiffRoute) getVersionDiffs(req *restful.Request, res *restful.Response) {
+	withPatch := req.QueryParameter("patch") == "true"
 
-// 	r.getDiffsBetweenHashesWithRecordQuery(req, res, recordQuery)
-// }
+	r.getDiffsWithParams(req, res, &config.ConfigDiffParams{
+		IncludeRecordContentsPatch: withPatch,
+		IncludeObject:              withPatch,
+	})
+}
 
 // Prefixed routes
 func (r *ConfigDiffRoute) Prefixed(ws *restful.WebService, prefix string) {
@@ -211,36 +168,54 @@ func (r *ConfigDiffRoute) Prefixed(ws *restful.WebService, prefix string) {
 	// 	Param(ws.PathParameter("configCollectionKey", "The config key").DataType("string")).
 	// 	Writes(util.Data{}))
 
-	// ws.Route(ws.GET(prefix + "/config/diff/versions/{fromHash}/{toHash}").
-	// 	To(r.getVersionsBetweenHashes).
-	// 	Doc("Get config versions between two hashes").
-	// 	Param(ws.PathParameter("fromHash", "The from hash").DataType("string")).
-	// 	Param(ws.PathParameter("toHash", "The to hash").DataType("string")).
-	// 	Writes(config.ConfigDiffVersions{}))
-
-	// ws.Route(ws.GET(prefix + "/config/diff/{resource}/{fromHash}/{toHash}").
-	// 	To(r.getDiffsBetweenHashes).
-	// 	Doc("Get config diffs between two hashes").
-	// 	Param(ws.PathParameter("resource", "The resource").DataType("string")).
-	// 	Param(ws.PathParameter("fromHash", "The from hash").DataType("string")).
-	// 	Param(ws.PathParameter("toHash", "The to hash").DataType("string")).
-	// 	Writes(config.ConfigDiffVersions{}))
-
 	ws.Route(ws.GET(prefix + "/config/diff/configs/{configCollectionKey}/{fromHash}/{toHash}").
 		To(r.getKeyedConfigDiffs).
-		Doc("Get config diffs between two hashes for a config key").
+		Doc("Get config diffs between two versions for a config key").
 		Param(ws.PathParameter("configCollectionKey", "The config key").DataType("string")).
-		Param(ws.PathParameter("fromHash", "The from hash").DataType("string")).
-		Param(ws.PathParameter("toHash", "The to hash").DataType("string")).
+		Param(ws.PathParameter("fromHash", "The from version hash, tag or branch name (excluded from the result)").DataType("string")).
+		Param(ws.PathParameter("toHash", "The to version hash, tag or branch name").DataType("string")).
 		Writes(config.ConfigDiffVersions{}))
 
-	// ws.Route(ws.GET(prefix + "/config/diff/documents/{configCollectionKey}/{configItemKey}/{fromHash}/{toHash}").
-	// 	To(r.getDocumentConfigDiffs).
-	// 	Doc("Get config diffs between two hashes for a config document").
-	// 	Param(ws.PathParameter("configCollectionKey", "The config document key").DataType("string")).
-	// 	Param(ws.PathParameter("configItemKey", "The config document id").DataType("string")).
-	// 	Param(ws.PathParameter("fromHash", "The from hash").DataType("string")).
-	// 	Param(ws.PathParameter("toHash", "The to hash").DataType("string")).
-	// 	Writes(config.ConfigDiffVersions{}))
+	ws.Route(ws.GET(prefix + "/config/diff/configs/{configCollectionKey}").
+		To(r.getKeyedConfigDiffs).
+		Doc("Get config diffs between two versions for a config key, the sides may also be stages").
+		Param(ws.PathParameter("configCollectionKey", "The config key").DataType("string")).
+		Param(ws.QueryParameter("from", "Version hash, tag, branch, head, root or stage/<stage> (excluded from the result, defaults to the first version)").DataType("string")).
+		Param(ws.QueryParameter("to", "Version hash, tag, branch, head, root or stage/<stage> (defaults to head)").DataType("string")).
+		Writes(config.ConfigDiffVersions{}))
+
+	ws.Route(ws.GET(prefix + "/config/diff/documents/{configCollectionKey}/{configItemKey}/{fromHash}/{toHash}").
+		To(r.getDocumentConfigDiffs).
+		Doc("Get config diffs between two versions for a config document").
+		Param(ws.PathParameter("configCollectionKey", "The config document key").DataType("string")).
+		Param(ws.PathParameter("configItemKey", "The config document id").DataType("string")).
+		Param(ws.PathParameter("fromHash", "The from version hash, tag or branch name (excluded from the result)").DataType("string")).
+		Param(ws.PathParameter("toHash", "The to version hash, tag or branch name").DataType("string")).
+		Writes(config.ConfigDiffVersions{}))
+
+	ws.Route(ws.GET(prefix + "/config/diff/documents/{configCollectionKey}/{configItemKey}").
+		To(r.getDocumentConfigDiffs).
+		Doc("Get config diffs between two versions for a config document, the sides may also be stages").
+		Param(ws.PathParameter("configCollectionKey", "The config document key").DataType("string")).
+		Param(ws.PathParameter("configItemKey", "The config document id").DataType("string")).
+		Param(ws.QueryParameter("from", "Version hash, tag, branch, head, root or stage/<stage> (excluded from the result, defaults to the first version)").DataType("string")).
+		Param(ws.QueryParameter("to", "Version hash, tag, branch, head, root or stage/<stage> (defaults to head)").DataType("string")).
+		Writes(config.ConfigDiffVersions{}))
+
+	ws.Route(ws.GET(prefix + "/config/diff/versions/{fromHash}/{toHash}").
+		To(r.getVersionDiffs).
+		Doc("Get every version between two versions of the repository").
+		Param(ws.PathParameter("fromHash", "The from version hash, tag or branch name (excluded from the result)").DataType("string")).
+		Param(ws.PathParameter("toHash", "The to version hash, tag or branch name").DataType("string")).
+		Param(ws.QueryParameter("patch", "Include the record contents and their diffs").DataType("boolean")).
+		Writes(config.ConfigDiffVersions{}))
+
+	ws.Route(ws.GET(prefix + "/config/diff/versions").
+		To(r.getVersionDiffs).
+		Doc("Get every version between two versions of the repository, the sides may also be stages").
+		Param(ws.QueryParameter("from", "Version hash, tag, branch, head, root or stage/<stage> (excluded from the result, defaults to the first version)").DataType("string")).
+		Param(ws.QueryParameter("to", "Version hash, tag, branch, head, root or stage/<stage> (defaults to head)").DataType("string")).
+		Param(ws.QueryParameter("patch", "Include the record contents and their diffs").DataType("boolean")).
+		Writes(config.ConfigDiffVersions{}))
 
 }
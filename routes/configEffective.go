@@ -0,0 +1,85 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	restful "github.com/emicklei/go-restful/v3"
+	"github.com/tmzt/config-api/config"
+	"github.com/tmzt/config-api/util"
+)
+
+type ConfigEffectiveRoute struct {
+	logger        util.SetRequestLogger
+	configService *config.ConfigService
+}
+
+func NewConfigEffectiveRoute(resource *config.ConfigService) *ConfigEffectiveRoute {
+	logger := util.NewLogger("ConfigEffectiveRoute", 0)
+
+	return &ConfigEffectiveRoute{
+		logger:        logger,
+		configService: resource,
+	}
+}
+
+func (r *ConfigEffectiveRoute) getEffective(req *restful.Request, res *restful.Response, kind config.ConfigRecordKind) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	recordQuery := getRecordQuery(req, res, true, kind == config.ConfigRecordKindDocument, false)
+	if recordQuery == nil {
+		return
+	} else if recordQuery.ConfigVersionHash != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Effective reads are always at head")
+		return
+	}
+	recordQuery.RecordKind = &kind
+
+	// The overrides of the requesting user are included unless user=false
+	var effectiveUserId *util.UserId
+	if scope == util.ScopeKindUser || (scope == util.ScopeKindAccount && req.QueryParameter("user") != "false") {
+		effectiveUserId = &userId
+	}
+
+	effective, err := r.configService.Effective(context.Background(), nil, accountId, effectiveUserId, recordQuery)
+	if err != nil {
+		r.logger.Printf("Failed to read effective config: %v\n", err)
+		res.WriteErrorString(http.StatusInternalServerError, "Failed to read effective config")
+		return
+	} else if effective == nil {
+		res.WriteErrorString(http.StatusNotFound, "Record not found")
+		return
+	}
+
+	res.WriteEntity(effective)
+}
+
+func (r *ConfigEffectiveRoute) getKeyedConfigEffective(req *restful.Request, res *restful.Response) {
+	r.getEffective(req, res, config.ConfigRecordKindKeyed)
+}
+
+func (r *ConfigEffectiveRoute) getDocumentEffective(req *restful.Request, res *restful.Response) {
+	r.getEffective(req, res, config.ConfigRecordKindDocument)
+}
+
+func (r *ConfigEffectiveRoute) Prefixed(ws *restful.WebService, prefix string) {
+
+	ws.Route(ws.GET(prefix + "/config/effective/configs/{collectionKey}").
+		To(r.getKeyedConfigEffective).
+		Doc("Get a keyed config deep merged across the global scope, inherited parent accounts, the account and the user scope, with the scope and version that set each top-level key").
+		Param(ws.PathParameter("collectionKey", "The config key").DataType("string")).
+		Param(ws.QueryParameter("user", "Include the overrides of the requesting user (defaults to true)").DataType("boolean")).
+		Writes(config.ConfigEffectiveRecord{}))
+
+	ws.Route(ws.GET(prefix + "/config/effective/configs/{collectionKey}/{itemKey}").
+		To(r.getDocumentEffective).
+		Doc("Get a config document deep merged across the global scope, inherited parent accounts, the account and the user scope, with the scope and version that set each top-level key").
+		Param(ws.PathParameter("collectionKey", "The config document key").DataType("string")).
+		Param(ws.PathParameter("itemKey", "The config document id").DataType("string")).
+		Param(ws.QueryParameter("user", "Include the overrides of the requesting user (defaults to true)").DataType("boolean")).
+		Writes(config.ConfigEffectiveRecord{}))
+}
@@ -0,0 +1,67 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	restful "github.com/emicklei/go-restful/v3"
+	"github.com/tmzt/config-api/config"
+	"github.com/tmzt/config-api/util"
+)
+
+type ConfigFsckRoute struct {
+	logger        util.SetRequestLogger
+	configService *config.ConfigService
+}
+
+func NewConfigFsckRoute(resource *config.ConfigService) *ConfigFsckRoute {
+	logger := util.NewLogger("ConfigFsckRoute", 0)
+
+	return &ConfigFsckRoute{
+		logger:        logger,
+		configService: resource,
+	}
+}
+
+// Checks every scope of the account (the account and its users), repairs refs when
+// called with POST and repair=true. Only platform admins can run it.
+func (r *ConfigFsckRoute) fsck(req *restful.Request, res *restful.Response) {
+	scope, accountId, _ := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	if !util.RequestBoolAttribute(req, "isActualPlatformAdmin") {
+		res.WriteErrorString(http.StatusForbidden, "Only platform admins can check the config repository")
+		return
+	}
+
+	options := &config.ConfigFsckOptions{
+		AccountId: &accountId,
+		Repair:    req.Request.Method == http.MethodPost && req.QueryParameter("repair") == "true",
+	}
+
+	report, err := r.configService.Fsck(context.Background(), nil, options)
+	if err != nil {
+		r.logger.Printf("Failed to check config repository: %v\n", err)
+		res.WriteErrorString(http.StatusInternalServerError, "Failed to check config repository")
+		return
+	}
+
+	res.WriteEntity(report)
+}
+
+func (r *ConfigFsckRoute) Prefixed(ws *restful.WebService, prefix string) {
+
+	ws.Route(ws.GET(prefix + "/fsck").
+		To(r.fsck).
+		Doc("Check node hashes, parents and refs of the account (platform admins only)").
+		Writes(config.ConfigFsckReport{}))
+
+	ws.Route(ws.POST(prefix + "/fsck").
+		To(r.fsck).
+		Doc("Check the account and repair dangling refs when repair is true (platform admins only)").
+		Param(ws.QueryParameter("repair", "Move dangling root and head refs to existing nodes and delete other dangling refs").DataType("boolean")).
+		Writes(config.ConfigFsckReport{}))
+}
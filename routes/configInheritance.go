@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	restful "github.com/emicklei/go-restful/v3"
+	"github.com/tmzt/config-api/config"
+	"github.com/tmzt/config-api/resources"
+	"github.com/tmzt/config-api/util"
+)
+
+type ConfigInheritanceRoute struct {
+	logger             util.SetRequestLogger
+	configService      *config.ConfigService
+	accountPermissions *resources.AccountPermissionsResource
+}
+
+func NewConfigInheritanceRoute(resource *config.ConfigService, accountPermissions *resources.AccountPermissionsResource) *ConfigInheritanceRoute {
+	logger := util.NewLogger("ConfigInheritanceRoute", 0)
+
+	return &ConfigInheritanceRoute{
+		logger:             logger,
+		configService:      resource,
+		accountPermissions: accountPermissions,
+	}
+}
+
+type configInheritanceInput struct {
+	// Merge the config of the parent account under this account in effective reads
+	InheritFromParent bool `json:"inherit_from_parent"`
+	// Collections that are never inherited
+	ExcludedCollections []util.ConfigCollectionKey `json:"excluded_collections"`
+}
+
+func (r *ConfigInheritanceRoute) getInheritance(req *restful.Request, res *restful.Response) {
+	scope, accountId, _ := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	inheritance, err := r.configService.GetInheritance(context.Background(), nil, accountId)
+	if err != nil {
+		r.logger.Printf("Failed to get inheritance: %v\n", err)
+		res.WriteErrorString(http.StatusInternalServerError, "Failed to get inheritance")
+		return
+	} else if inheritance == nil {
+		res.WriteErrorString(http.StatusNotFound, "No inheritance settings")
+		return
+	}
+
+	res.WriteEntity(inheritance)
+}
+
+func (r *ConfigInheritanceRoute) setInheritance(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	input := &configInheritanceInput{}
+	if err := req.ReadEntity(input); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	ctx := context.Background()
+
+	// Inheriting shares the parent's config with every member of this account, so
+	// only an admin of the parent (or a platform admin) can turn it on
+	if input.InheritFromParent && !util.RequestBoolAttribute(req, "isPlatformAdmin") {
+		parentAccountId, err := r.configService.GetParentAccountId(ctx, nil, accountId)
+		if err != nil {
+			r.logger.Printf("Failed to get parent account: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to set inheritance")
+			return
+		} else if parentAccountId == nil ||
+			!r.accountPermissions.IsAccountParent(*parentAccountId, accountId) ||
+			!r.accountPermissions.HasAccountAdminAccess(*parentAccountId, userId) {
+			res.WriteErrorString(http.StatusForbidden, "Only admins of the parent account can inherit its config")
+			return
+		}
+	}
+
+	inheritance, err := r.configService.SetInheritance(ctx, nil, accountId, userId, input.InheritFromParent, input.ExcludedCollections)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to set inheritance: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to set inheritance")
+		}
+		return
+	}
+
+	res.WriteEntity(inheritance)
+}
+
+func (r *ConfigInheritanceRoute) Prefixed(ws *restful.WebService, prefix string) {
+
+	ws.Route(ws.GET(prefix + "/inheritance").
+		To(r.getInheritance).
+		Doc("Get whether the account inherits config from its parent account in effective reads").
+		Writes(config.ConfigInheritanceORM{}))
+
+	ws.Route(ws.PUT(prefix + "/inheritance").
+		To(r.setInheritance).
+		Doc("Set whether the account inherits config from its parent account in effective reads, the parent's own settings decide whether the walk continues to its parent. Turning it on requires admin access to the parent account").
+		Reads(configInheritanceInput{}).
+		Writes(config.ConfigInheritanceORM{}))
+}
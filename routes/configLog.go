@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	restful "github.com/emicklei/go-restful/v3"
+	"github.com/tmzt/config-api/config"
+	"github.com/tmzt/config-api/util"
+)
+
+type ConfigLogRoute struct {
+	logger        util.SetRequestLogger
+	configService *config.ConfigService
+}
+
+func NewConfigLogRoute(resource *config.ConfigService) *ConfigLogRoute {
+	logger := util.NewLogger("ConfigLogRoute", 0)
+
+	return &ConfigLogRoute{
+		logger:        logger,
+		configService: resource,
+	}
+}
+
+// Parses an optional RFC3339 query parameter, writes the error response and returns
+// false when it is invalid
+func getTimeQueryParameter(req *restful.Request, res *restful.Response, name string) (*time.Time, bool) {
+	v := req.QueryParameter(name)
+	if v == "" {
+		return nil, true
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid "+name+", expected an RFC3339 timestamp")
+		return nil, false
+	}
+
+	return &t, true
+}
+
+func (r *ConfigLogRoute) getLog(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	ctx := context.Background()
+
+	toVersion, ok := resolveRequestRef(ctx, req, res, r.configService, scope, accountId, userId)
+	if !ok {
+		return
+	}
+
+	options := &config.ConfigLogOptions{
+		ToVersion: toVersion,
+	}
+
+	if v := req.QueryParameter("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			res.WriteErrorString(http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		options.Limit = limit
+	}
+	if v := req.QueryParameter("cursor"); v != "" {
+		cursor := util.ConfigVersionHash(v)
+		options.Cursor = &cursor
+	}
+	if options.Since, ok = getTimeQueryParameter(req, res, "since"); !ok {
+		return
+	}
+	if options.Until, ok = getTimeQueryParameter(req, res, "until"); !ok {
+		return
+	}
+	if v := req.QueryParameter("author"); v != "" {
+		options.Author = util.UserIdPtr(v)
+	}
+	if v := req.QueryParameter("collectionKey"); v != "" {
+		options.CollectionKey = util.ConfigCollectionKeyPtr(v)
+	}
+
+	log, err := r.configService.Log(ctx, nil, scope, accountId, userId, options)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to list versions: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to list versions")
+		}
+		return
+	}
+
+	res.WriteEntity(log)
+}
+
+func (r *ConfigLogRoute) Prefixed(ws *restful.WebService, prefix string) {
+
+	ws.Route(ws.GET(prefix + "/log").
+		To(r.getLog).
+		Doc("List the versions of a ref, newest first, with the records each version changed").
+		Param(ws.QueryParameter("ref", "Branch, tag, ref or version hash to list from (defaults to head)").DataType("string")).
+		Param(ws.QueryParameter("stage", "List from the version promoted to this stage instead of head").DataType("string")).
+		Param(ws.QueryParameter("cursor", "The next_cursor of the previous page, 404 when it is not on the chain").DataType("string")).
+		Param(ws.QueryParameter("limit", "Versions per page (default 50, at most 500)").DataType("integer")).
+		Param(ws.QueryParameter("since", "Only versions committed at or after this RFC3339 time").DataType("string")).
+		Param(ws.QueryParameter("until", "Only versions committed at or before this RFC3339 time").DataType("string")).
+		Param(ws.QueryParameter("author", "Only versions committed by this user id").DataType("string")).
+		Param(ws.QueryParameter("collectionKey", "Only versions that changed a record with this collection key").DataType("string")).
+		Writes(config.ConfigLog{}))
+}
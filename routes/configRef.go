@@ -0,0 +1,847 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/emicklei/go-restful/v3"
+	"github.com/tmzt/config-api/config"
+	"github.com/tmzt/config-api/util"
+)
+
+type ConfigRefRoute struct {
+	logger        util.SetRequestLogger
+	configService *config.ConfigService
+}
+
+func NewConfigRefRoute(resource *config.ConfigService) *ConfigRefRoute {
+	logger := util.NewLogger("ConfigRefRoute", 0)
+
+	return &ConfigRefRoute{
+		logger:        logger,
+		configService: resource,
+	}
+}
+
+// Writes the response for errors returned by the reference service,
+// returns false if the error was not handled
+func writeRefError(res *restful.Response, err error) bool {
+	switch e := err.(type) {
+	case *config.ErrReferenceNotFound:
+		res.WriteErrorString(http.StatusNotFound, e.Error())
+	case *config.ErrVersionNotFound:
+		res.WriteErrorString(http.StatusNotFound, e.Error())
+	case *config.ErrVersionNotFoundAsOf:
+		res.WriteErrorString(http.StatusNotFound, e.Error())
+	case *config.ErrRecordNotFound:
+		res.WriteErrorString(http.StatusNotFound, e.Error())
+	case *config.ErrInvalidReferenceName:
+		res.WriteErrorString(http.StatusBadRequest, e.Error())
+	case *config.ErrReferenceAlreadyExists:
+		res.WriteErrorString(http.StatusConflict, e.Error())
+	case *config.ErrRecordAlreadyExists:
+		res.WriteErrorString(http.StatusConflict, e.Error())
+	case *config.ErrStagePromotionNotAllowed:
+		res.WriteErrorString(http.StatusConflict, e.Error())
+	case *config.ErrConfigPatchTestFailed:
+		res.WriteErrorString(http.StatusConflict, e.Error())
+	case *config.ErrConfigSettingError:
+		res.WriteErrorString(http.StatusUnprocessableEntity, e.Error())
+	default:
+		return false
+	}
+	return true
+}
+
+type configVersionConflictResponse struct {
+	Error               string                  `json:"error"`
+	ExpectedVersionHash *util.ConfigVersionHash `json:"expected_version_hash"`
+	CurrentVersionHash  *util.ConfigVersionHash `json:"current_version_hash"`
+}
+
+// Writes the 409 response for ErrConfigObjectSettingConflict, with the conflicting paths
+// of a merge or else the expected and current version of the record (also set as the
+// X-Config-Version-Hash header). Returns false for other errors.
+func writeConflictError(res *restful.Response, err error) bool {
+	conflictErr, ok := err.(*config.ErrConfigObjectSettingConflict)
+	if !ok {
+		return false
+	}
+
+	if len(conflictErr.Conflicts) > 0 {
+		res.WriteHeaderAndEntity(http.StatusConflict, &configConflictResponse{
+			Error:     conflictErr.Error(),
+			Conflicts: conflictErr.Conflicts,
+		})
+		return true
+	}
+
+	if conflictErr.CurrentVersionHash != nil {
+		res.Header().Set("X-Config-Version-Hash", string(*conflictErr.CurrentVersionHash))
+	}
+	res.WriteHeaderAndEntity(http.StatusConflict, &configVersionConflictResponse{
+		Error:               conflictErr.Error(),
+		ExpectedVersionHash: conflictErr.ExpectedVersionHash,
+		CurrentVersionHash:  conflictErr.CurrentVersionHash,
+	})
+	return true
+}
+
+// Resolves the ref query parameter (head, root, stage/<stage>, a branch or tag name or a
+// version hash) or the stage query parameter, returns nil for head. With asOf the version
+// committed at or before that time on the ref is returned instead. Writes the error
+// response and returns false on failure.
+func resolveRequestRef(ctx context.Context, req *restful.Request, res *restful.Response, configService *config.ConfigService, scope util.ScopeKind, accountId util.AccountId, userId util.UserId) (*config.ConfigVersionRef, bool) {
+	refParam := req.QueryParameter("ref")
+	if stageParam := req.QueryParameter("stage"); stageParam != "" {
+		if refParam != "" {
+			res.WriteErrorString(http.StatusBadRequest, "Only one of ref and stage can be given")
+			return nil, false
+		}
+		refParam = "stage/" + stageParam
+	}
+
+	var versionRef *config.ConfigVersionRef
+	if refParam != "" {
+		var err error
+		versionRef, err = configService.GetConfigReferenceService().ResolveVersion(ctx, nil, scope, accountId, userId, refParam)
+		if err != nil {
+			if !writeRefError(res, err) {
+				res.WriteErrorString(http.StatusInternalServerError, "Failed to resolve ref")
+			}
+			return nil, false
+		}
+	}
+
+	if asOfParam := req.QueryParameter("asOf"); asOfParam != "" {
+		asOf, err := time.Parse(time.RFC3339, asOfParam)
+		if err != nil {
+			res.WriteErrorString(http.StatusBadRequest, "Invalid asOf, expected an RFC3339 timestamp")
+			return nil, false
+		}
+
+		versionRef, err = configService.GetConfigReferenceService().ResolveVersionAsOf(ctx, nil, scope, accountId, userId, versionRef, asOf)
+		if err != nil {
+			if !writeRefError(res, err) {
+				res.WriteErrorString(http.StatusInternalServerError, "Failed to resolve asOf")
+			}
+			return nil, false
+		}
+	}
+
+	return versionRef, true
+}
+
+// Resolves the configVersionHash of a record query, which may also be a tag or
+// branch name, and replaces it with the resolved hash. Writes the error response
+// and returns false on failure.
+func resolveRecordQueryVersion(ctx context.Context, res *restful.Response, configService *config.ConfigService, recordQuery *config.ConfigRecordQuery) (*config.ConfigVersionRef, bool) {
+	if recordQuery.ConfigVersionHash == nil {
+		return nil, true
+	}
+
+	var userId util.UserId
+	if recordQuery.UserId != nil {
+		userId = *recordQuery.UserId
+	}
+
+	versionRef, err := configService.GetConfigReferenceService().ResolveVersion(ctx, nil, *recordQuery.Scope, *recordQuery.AccountId, userId, string(*recordQuery.ConfigVersionHash))
+	if err != nil {
+		if !writeRefError(res, err) {
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to resolve config version")
+		}
+		return nil, false
+	}
+
+	recordQuery.ConfigVersionHash = &versionRef.ConfigVersionHash
+
+	return versionRef, true
+}
+
+type configBranchCreateInput struct {
+	Name string `json:"name"`
+	// Ref or version hash to start the branch from, defaults to head
+	From string `json:"from"`
+}
+
+func (r *ConfigRefRoute) listBranches(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	branches, err := r.configService.GetConfigReferenceService().ListBranches(context.Background(), nil, scope, accountId, userId)
+	if err != nil {
+		r.logger.Printf("Failed to list branches: %v\n", err)
+		res.WriteErrorString(http.StatusInternalServerError, "Failed to list branches")
+		return
+	}
+
+	res.WriteEntity(branches)
+}
+
+func (r *ConfigRefRoute) getBranch(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	branch, err := r.configService.GetConfigReferenceService().GetBranch(context.Background(), nil, scope, accountId, userId, req.PathParameter("branchName"))
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to get branch: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to get branch")
+		}
+		return
+	}
+
+	res.WriteEntity(branch)
+}
+
+func (r *ConfigRefRoute) createBranch(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	input := &configBranchCreateInput{}
+	if err := req.ReadEntity(input); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	ctx := context.Background()
+	refService := r.configService.GetConfigReferenceService()
+
+	from := input.From
+	if from == "" {
+		from = string(config.ConfigReferenceKindHead)
+	}
+
+	fromVersion, err := refService.ResolveVersion(ctx, nil, scope, accountId, userId, from)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to resolve branch start: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to resolve branch start")
+		}
+		return
+	}
+
+	branch, err := refService.CreateBranch(ctx, nil, scope, accountId, userId, input.Name, fromVersion)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to create branch: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to create branch")
+		}
+		return
+	}
+
+	res.Header().Set("X-Config-Version-Hash", string(branch.VersionRef.ConfigVersionHash))
+
+	res.WriteHeaderAndEntity(http.StatusCreated, branch)
+}
+
+func (r *ConfigRefRoute) deleteBranch(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	err := r.configService.GetConfigReferenceService().DeleteBranch(context.Background(), nil, scope, accountId, userId, req.PathParameter("branchName"))
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to delete branch: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to delete branch")
+		}
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+type configTagInput struct {
+	Name string `json:"name"`
+	// Ref, tag or version hash the tag points at, defaults to head
+	Version string `json:"version"`
+}
+
+// Resolves the version a tag should point at, writes the error response
+// and returns false on failure
+func (r *ConfigRefRoute) resolveTagVersion(ctx context.Context, res *restful.Response, scope util.ScopeKind, accountId util.AccountId, userId util.UserId, version string) (*config.ConfigVersionRef, bool) {
+	if version == "" {
+		version = string(config.ConfigReferenceKindHead)
+	}
+
+	versionRef, err := r.configService.GetConfigReferenceService().ResolveVersion(ctx, nil, scope, accountId, userId, version)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to resolve tag version: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to resolve tag version")
+		}
+		return nil, false
+	}
+
+	return versionRef, true
+}
+
+func (r *ConfigRefRoute) listTags(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	tags, err := r.configService.GetConfigReferenceService().ListTags(context.Background(), nil, scope, accountId, userId)
+	if err != nil {
+		r.logger.Printf("Failed to list tags: %v\n", err)
+		res.WriteErrorString(http.StatusInternalServerError, "Failed to list tags")
+		return
+	}
+
+	res.WriteEntity(tags)
+}
+
+func (r *ConfigRefRoute) getTag(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	tag, err := r.configService.GetConfigReferenceService().GetTag(context.Background(), nil, scope, accountId, userId, req.PathParameter("tagName"))
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to get tag: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to get tag")
+		}
+		return
+	}
+
+	res.WriteEntity(tag)
+}
+
+func (r *ConfigRefRoute) createTag(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	input := &configTagInput{}
+	if err := req.ReadEntity(input); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	ctx := context.Background()
+
+	version, ok := r.resolveTagVersion(ctx, res, scope, accountId, userId, input.Version)
+	if !ok {
+		return
+	}
+
+	tag, err := r.configService.GetConfigReferenceService().CreateTag(ctx, nil, scope, accountId, userId, input.Name, version)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to create tag: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to create tag")
+		}
+		return
+	}
+
+	res.Header().Set("X-Config-Version-Hash", string(tag.VersionRef.ConfigVersionHash))
+
+	res.WriteHeaderAndEntity(http.StatusCreated, tag)
+}
+
+func (r *ConfigRefRoute) moveTag(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	input := &configTagInput{}
+	if err := req.ReadEntity(input); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	ctx := context.Background()
+
+	version, ok := r.resolveTagVersion(ctx, res, scope, accountId, userId, input.Version)
+	if !ok {
+		return
+	}
+
+	tag, err := r.configService.GetConfigReferenceService().MoveTag(ctx, nil, scope, accountId, userId, req.PathParameter("tagName"), version)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to move tag: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to move tag")
+		}
+		return
+	}
+
+	res.Header().Set("X-Config-Version-Hash", string(tag.VersionRef.ConfigVersionHash))
+
+	res.WriteEntity(tag)
+}
+
+func (r *ConfigRefRoute) deleteTag(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	err := r.configService.GetConfigReferenceService().DeleteTag(context.Background(), nil, scope, accountId, userId, req.PathParameter("tagName"))
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to delete tag: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to delete tag")
+		}
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+type configStagePromoteInput struct {
+	// Ref, stage/<stage>, tag or version hash to promote, defaults to head
+	Version string `json:"version"`
+	Reason  string `json:"reason"`
+	// Allow skipping stages or moving the stage backwards
+	Force bool `json:"force"`
+}
+
+func (r *ConfigRefRoute) listStages(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	stages, err := r.configService.GetConfigReferenceService().ListStages(context.Background(), nil, scope, accountId, userId)
+	if err != nil {
+		r.logger.Printf("Failed to list stages: %v\n", err)
+		res.WriteErrorString(http.StatusInternalServerError, "Failed to list stages")
+		return
+	}
+
+	res.WriteEntity(stages)
+}
+
+func (r *ConfigRefRoute) getStage(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	stage, err := r.configService.GetConfigReferenceService().GetStage(context.Background(), nil, scope, accountId, userId, config.ConfigStageKind(req.PathParameter("stage")))
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to get stage: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to get stage")
+		}
+		return
+	}
+
+	res.WriteEntity(stage)
+}
+
+func (r *ConfigRefRoute) getStageHistory(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	promotions, err := r.configService.GetConfigReferenceService().ListStagePromotions(context.Background(), nil, scope, accountId, userId, config.ConfigStageKind(req.PathParameter("stage")))
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to list stage promotions: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to list stage promotions")
+		}
+		return
+	}
+
+	res.WriteEntity(promotions)
+}
+
+func (r *ConfigRefRoute) promoteStage(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	input := &configStagePromoteInput{}
+	if err := req.ReadEntity(input); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	ctx := context.Background()
+
+	version := input.Version
+	if version == "" {
+		version = string(config.ConfigReferenceKindHead)
+	}
+
+	versionRef, err := r.configService.GetConfigReferenceService().ResolveVersion(ctx, nil, scope, accountId, userId, version)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to resolve promoted version: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to resolve promoted version")
+		}
+		return
+	}
+
+	options := &config.ConfigStagePromotionOptions{
+		Reason: input.Reason,
+		Force:  input.Force,
+	}
+
+	promotion, err := r.configService.PromoteStage(ctx, nil, scope, accountId, userId, config.ConfigStageKind(req.PathParameter("stage")), versionRef, options)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to promote stage: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to promote stage")
+		}
+		return
+	}
+
+	res.Header().Set("X-Config-Version-Hash", string(promotion.VersionRef.ConfigVersionHash))
+
+	res.WriteEntity(promotion)
+}
+
+type configRevertInput struct {
+	// Ref, tag or version hash to revert
+	Version string `json:"version"`
+	// Only revert this record, otherwise every record changed in the version is reverted
+	RecordKind    *config.ConfigRecordKind  `json:"record_kind"`
+	CollectionKey *util.ConfigCollectionKey `json:"record_collection_key"`
+	ItemKey       *util.ConfigItemKey       `json:"record_item_key"`
+	// Branch to commit the revert to, defaults to head
+	Target string `json:"target"`
+	// Resolve paths changed on the target since the reverted version
+	Resolutions []config.ConfigMergeResolution `json:"resolutions"`
+	// Replaces the default "Revert <hash>" note
+	configCommitInput
+}
+
+func (r *ConfigRefRoute) revert(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	input := &configRevertInput{}
+	if err := req.ReadEntity(input); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if input.Version == "" {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request (version is required)")
+		return
+	}
+
+	if !readCommitHeaders(req, res, &input.configCommitInput) {
+		return
+	}
+
+	ctx := context.Background()
+	refService := r.configService.GetConfigReferenceService()
+
+	version, err := refService.ResolveVersion(ctx, nil, scope, accountId, userId, input.Version)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to resolve reverted version: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to resolve reverted version")
+		}
+		return
+	}
+
+	options := &config.ConfigRevertOptions{
+		Resolutions: input.Resolutions,
+		Note:        input.Note,
+		Trailers:    input.Trailers,
+	}
+	if input.CollectionKey != nil {
+		options.Record = &config.ConfigRecordMetadata{
+			CollectionKey: *input.CollectionKey,
+			ItemKey:       input.ItemKey,
+			RecordKind:    input.RecordKind,
+		}
+	}
+	if input.Target != "" && input.Target != string(config.ConfigReferenceKindHead) {
+		if _, err := refService.GetBranch(ctx, nil, scope, accountId, userId, input.Target); err != nil {
+			if !writeRefError(res, err) {
+				r.logger.Printf("Failed to get branch: %v\n", err)
+				res.WriteErrorString(http.StatusInternalServerError, "Failed to get branch")
+			}
+			return
+		}
+		options.RefName = input.Target
+	}
+
+	result, err := r.configService.Revert(ctx, nil, scope, accountId, userId, version, options)
+	if writeConflictError(res, err) {
+		return
+	} else if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to revert: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to revert")
+		}
+		return
+	}
+
+	if result.NodeMetadata != nil {
+		res.Header().Set("X-Config-Version-Hash", string(result.NodeMetadata.VersionRef.ConfigVersionHash))
+	}
+
+	res.WriteEntity(result)
+}
+
+type configCherryPickInput struct {
+	// Ref, tag or version hash whose change is applied
+	Version string `json:"version"`
+	// Branch to apply the change to, defaults to head
+	Target      string                         `json:"target"`
+	Resolutions []config.ConfigMergeResolution `json:"resolutions"`
+	// Replaces the default "Cherry-pick <hash>" note
+	configCommitInput
+}
+
+func (r *ConfigRefRoute) cherryPick(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	input := &configCherryPickInput{}
+	if err := req.ReadEntity(input); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if input.Version == "" {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request (version is required)")
+		return
+	}
+
+	if !readCommitHeaders(req, res, &input.configCommitInput) {
+		return
+	}
+
+	ctx := context.Background()
+
+	version, err := r.configService.GetConfigReferenceService().ResolveVersion(ctx, nil, scope, accountId, userId, input.Version)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to resolve picked version: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to resolve picked version")
+		}
+		return
+	}
+
+	options := &config.ConfigMergeOptions{
+		Resolutions: input.Resolutions,
+		Note:        input.Note,
+		Trailers:    input.Trailers,
+	}
+
+	result, err := r.configService.CherryPick(ctx, nil, scope, accountId, userId, version, input.Target, options)
+	if writeConflictError(res, err) {
+		return
+	} else if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to cherry-pick: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to cherry-pick")
+		}
+		return
+	}
+
+	if result.NodeMetadata != nil {
+		res.Header().Set("X-Config-Version-Hash", string(result.NodeMetadata.VersionRef.ConfigVersionHash))
+	}
+
+	res.WriteEntity(result)
+}
+
+type configMergeInput struct {
+	// Ref, branch or version hash to merge
+	Source string `json:"source"`
+	// Branch to merge into, defaults to head
+	Target      string                         `json:"target"`
+	Resolutions []config.ConfigMergeResolution `json:"resolutions"`
+	configCommitInput
+}
+
+type configConflictResponse struct {
+	Error     string                       `json:"error"`
+	Conflicts []config.ConfigMergeConflict `json:"conflicts"`
+}
+
+func (r *ConfigRefRoute) merge(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	input := &configMergeInput{}
+	if err := req.ReadEntity(input); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if input.Source == "" {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request (source is required)")
+		return
+	}
+
+	if !readCommitHeaders(req, res, &input.configCommitInput) {
+		return
+	}
+
+	options := &config.ConfigMergeOptions{
+		Resolutions: input.Resolutions,
+		Note:        input.Note,
+		Trailers:    input.Trailers,
+	}
+
+	result, err := r.configService.Merge(context.Background(), nil, scope, accountId, userId, input.Source, input.Target, options)
+	if writeConflictError(res, err) {
+		return
+	} else if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to merge: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to merge")
+		}
+		return
+	}
+
+	if result.NodeMetadata != nil {
+		res.Header().Set("X-Config-Version-Hash", string(result.NodeMetadata.VersionRef.ConfigVersionHash))
+	}
+
+	res.WriteEntity(result)
+}
+
+// Prefixed routes
+func (r *ConfigRefRoute) Prefixed(ws *restful.WebService, prefix string) {
+
+	ws.Route(ws.GET(prefix + "/branches").
+		To(r.listBranches).
+		Doc("List the named branches").
+		Writes([]config.ConfigReferenceORM{}))
+
+	ws.Route(ws.POST(prefix + "/branches").
+		To(r.createBranch).
+		Doc("Create a named branch from a ref or version hash (defaults to head)").
+		Reads(configBranchCreateInput{}).
+		Writes(config.ConfigReferenceORM{}))
+
+	ws.Route(ws.GET(prefix + "/branches/{branchName}").
+		To(r.getBranch).
+		Doc("Get a named branch").
+		Param(ws.PathParameter("branchName", "The branch name").DataType("string")).
+		Writes(config.ConfigReferenceORM{}))
+
+	ws.Route(ws.DELETE(prefix + "/branches/{branchName}").
+		To(r.deleteBranch).
+		Doc("Delete a named branch, the versions it points to are kept").
+		Param(ws.PathParameter("branchName", "The branch name").DataType("string")).
+		Writes(nil))
+
+	ws.Route(ws.GET(prefix + "/tags").
+		To(r.listTags).
+		Doc("List the tags").
+		Writes([]config.ConfigTagORM{}))
+
+	ws.Route(ws.POST(prefix + "/tags").
+		To(r.createTag).
+		Doc("Create a tag pointing at a ref, tag or version hash (defaults to head)").
+		Reads(configTagInput{}).
+		Writes(config.ConfigTagORM{}))
+
+	ws.Route(ws.GET(prefix + "/tags/{tagName}").
+		To(r.getTag).
+		Doc("Get a tag").
+		Param(ws.PathParameter("tagName", "The tag name").DataType("string")).
+		Writes(config.ConfigTagORM{}))
+
+	ws.Route(ws.PUT(prefix + "/tags/{tagName}").
+		To(r.moveTag).
+		Doc("Move a tag to a ref, tag or version hash (defaults to head), the name in the body is ignored").
+		Param(ws.PathParameter("tagName", "The tag name").DataType("string")).
+		Reads(configTagInput{}).
+		Writes(config.ConfigTagORM{}))
+
+	ws.Route(ws.DELETE(prefix + "/tags/{tagName}").
+		To(r.deleteTag).
+		Doc("Delete a tag, the version it points to is kept").
+		Param(ws.PathParameter("tagName", "The tag name").DataType("string")).
+		Writes(nil))
+
+	ws.Route(ws.GET(prefix + "/stages").
+		To(r.listStages).
+		Doc("List the stages that have been promoted to").
+		Writes([]config.ConfigReferenceORM{}))
+
+	ws.Route(ws.GET(prefix + "/stages/{stage}").
+		To(r.getStage).
+		Doc("Get the version currently promoted to a stage").
+		Param(ws.PathParameter("stage", "The stage (dev, test, client_validation, beta or prod)").DataType("string")).
+		Writes(config.ConfigReferenceORM{}))
+
+	ws.Route(ws.GET(prefix + "/stages/{stage}/history").
+		To(r.getStageHistory).
+		Doc("List the promotions to a stage, newest first").
+		Param(ws.PathParameter("stage", "The stage (dev, test, client_validation, beta or prod)").DataType("string")).
+		Writes([]config.ConfigStagePromotionORM{}))
+
+	ws.Route(ws.POST(prefix + "/stages/{stage}/promote").
+		To(r.promoteStage).
+		Doc("Promote a version to a stage, it must already be in the previous stage and must not move the stage backwards unless forced").
+		Param(ws.PathParameter("stage", "The stage (dev, test, client_validation, beta or prod)").DataType("string")).
+		Reads(configStagePromoteInput{}).
+		Writes(config.ConfigStagePromotionORM{}))
+
+	ws.Route(ws.POST(prefix + "/revert").
+		To(r.revert).
+		Doc("Revert a version, or a single record changed in it, by committing the record contents from before it, conflicts with later changes are returned with status 409").
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new versions, the body note takes precedence").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
+		Reads(configRevertInput{}).
+		Writes(config.ConfigRevertResult{}))
+
+	ws.Route(ws.POST(prefix + "/cherry-pick").
+		To(r.cherryPick).
+		Doc("Apply the record changes of a single version onto a branch or head, conflicts are returned with status 409").
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new versions, the body note takes precedence").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
+		Reads(configCherryPickInput{}).
+		Writes(config.ConfigCherryPickResult{}))
+
+	ws.Route(ws.POST(prefix + "/merge").
+		To(r.merge).
+		Doc("Merge a ref, branch or version into a branch or head, conflicts are returned with status 409").
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new versions, the body note takes precedence").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
+		Reads(configMergeInput{}).
+		Writes(config.ConfigMergeResult{}))
+
+}
@@ -0,0 +1,96 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	restful "github.com/emicklei/go-restful/v3"
+	"github.com/tmzt/config-api/config"
+	"github.com/tmzt/config-api/util"
+)
+
+type ConfigRetentionRoute struct {
+	logger        util.SetRequestLogger
+	configService *config.ConfigService
+}
+
+func NewConfigRetentionRoute(resource *config.ConfigService) *ConfigRetentionRoute {
+	logger := util.NewLogger("ConfigRetentionRoute", 0)
+
+	return &ConfigRetentionRoute{
+		logger:        logger,
+		configService: resource,
+	}
+}
+
+type configRetentionInput struct {
+	// Keep at least this many versions of head, 0 for no limit
+	KeepVersions int `json:"keep_versions"`
+	// Keep the versions committed within this many days, 0 for no limit
+	KeepDays int `json:"keep_days"`
+}
+
+func (r *ConfigRetentionRoute) getRetentionPolicy(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	policy, err := r.configService.GetRetentionPolicy(context.Background(), nil, scope, accountId, userId)
+	if err != nil {
+		r.logger.Printf("Failed to get retention policy: %v\n", err)
+		res.WriteErrorString(http.StatusInternalServerError, "Failed to get retention policy")
+		return
+	} else if policy == nil {
+		res.WriteErrorString(http.StatusNotFound, "No retention policy")
+		return
+	}
+
+	res.WriteEntity(policy)
+}
+
+// Only platform admins can set the policy since gc squashes the history outside it for good
+func (r *ConfigRetentionRoute) setRetentionPolicy(req *restful.Request, res *restful.Response) {
+	scope, accountId, userId := util.GetRequestScopeAndIds(req)
+	if scope == util.ScopeKindInvalid {
+		res.WriteErrorString(http.StatusForbidden, "Invalid account id")
+		return
+	}
+
+	if !util.RequestBoolAttribute(req, "isActualPlatformAdmin") {
+		res.WriteErrorString(http.StatusForbidden, "Only platform admins can set the retention policy")
+		return
+	}
+
+	input := &configRetentionInput{}
+	if err := req.ReadEntity(input); err != nil {
+		res.WriteErrorString(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	policy, err := r.configService.SetRetentionPolicy(context.Background(), nil, scope, accountId, userId, input.KeepVersions, input.KeepDays)
+	if err != nil {
+		if !writeRefError(res, err) {
+			r.logger.Printf("Failed to set retention policy: %v\n", err)
+			res.WriteErrorString(http.StatusInternalServerError, "Failed to set retention policy")
+		}
+		return
+	}
+
+	res.WriteEntity(policy)
+}
+
+func (r *ConfigRetentionRoute) Prefixed(ws *restful.WebService, prefix string) {
+
+	ws.Route(ws.GET(prefix + "/retention").
+		To(r.getRetentionPolicy).
+		Doc("Get the retention policy applied by config gc").
+		Writes(config.ConfigRetentionPolicyORM{}))
+
+	ws.Route(ws.PUT(prefix + "/retention").
+		To(r.setRetentionPolicy).
+		Doc("Set the retention policy, versions of head outside it are squashed into a baseline by config gc. Tagged and staged versions are always kept (platform admins only). The kept versions newer than the baseline get new hashes, their old hashes (in reads, If-Match and expected_version_hash) keep resolving to the new ones").
+		Reads(configRetentionInput{}).
+		Writes(config.ConfigRetentionPolicyORM{}))
+}
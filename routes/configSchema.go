@@ -44,6 +44,7 @@ func NewConfigSchemaRoute(resource *config.ConfigService) *ConfigSchemaRoute {
 type configSchemaInput struct {
 	RecordMetadata *config.ConfigRecordMetadata `json:"record_metadata"`
 	Schema         *config.ConfigSchemaRecord   `json:"schema"`
+	configCommitInput
 }
 
 type configSchemaOutput struct {
@@ -69,8 +70,17 @@ func (r *ConfigSchemaRoute) postConfigSchema(req *restful.Request, res *restful.
 		return
 	}
 
+	if !readCommitHeaders(req, res, &input.configCommitInput) {
+		return
+	}
+
+	options := &config.SetRecordValuesOptions{
+		Note:     input.Note,
+		Trailers: input.Trailers,
+	}
+
 	ctx := req.Request.Context()
-	node, err := r.configService.InsertRecord(ctx, nil, scope, accountId, userId, input.RecordMetadata, input.Schema)
+	node, err := r.configService.InsertRecord(ctx, nil, scope, accountId, userId, input.RecordMetadata, input.Schema, options)
 	if err != nil {
 		res.WriteErrorString(http.StatusInternalServerError, err.Error())
 		return
@@ -177,6 +187,11 @@ func (r *ConfigSchemaRoute) getSchema(req *restful.Request, res *restful.Respons
 	}
 
 	ctx := req.Request.Context()
+
+	if _, ok := resolveRecordQueryVersion(ctx, res, r.configService, query); !ok {
+		return
+	}
+
 	// schema, err := r.configSchemaService.GetSchema(ctx, nil, query)
 	var err error
 	var schema *config.ConfigSchemaRecord
@@ -237,6 +252,8 @@ func (r *ConfigSchemaRoute) Prefixed(ws *restful.WebService, prefix string) {
 	ws.Route(ws.POST(prefix + "/schemas").To(r.postConfigSchema).
 		Doc("Create a new config schema").
 		Operation("postConfigSchema").
+		Param(ws.HeaderParameter("X-Config-Commit-Message", "Commit message stored as the note of the new version, the body note takes precedence").DataType("string")).
+		Param(ws.HeaderParameter("X-Config-Commit-Trailer", "Commit trailer as Key: value (e.g. Ticket: CHG-1234), may be repeated").DataType("string")).
 		Reads(configSchemaInput{}).
 		Writes(config.ConfigSchemaRecord{}))
 
@@ -272,6 +289,7 @@ func (r *ConfigSchemaRoute) Prefixed(ws *restful.WebService, prefix string) {
 		Operation("getLatestSchemaForPath").
 		Param(ws.PathParameter("collectionKey", "collection key").DataType("string")).
 		Param(ws.PathParameter("itemKey", "item key").DataType("string")).
+		Param(ws.PathParameter("configVersionHash", "version hash or tag name").DataType("string")).
 		Writes(config.ConfigSchemaRecord{}))
 
 	ws.Route(ws.GET(prefix + "/schemas/{collectionKey}/_/{configVersionHash}").To(
@@ -281,6 +299,7 @@ func (r *ConfigSchemaRoute) Prefixed(ws *restful.WebService, prefix string) {
 		Doc("Get the config schema for a path and version hash (keyed schema)").
 		Operation("getLatestSchemaForPath").
 		Param(ws.PathParameter("collectionKey", "collection key").DataType("string")).
+		Param(ws.PathParameter("configVersionHash", "version hash or tag name").DataType("string")).
 		Writes(config.ConfigSchemaRecord{}))
 
 	ws.Route(ws.GET(prefix + "/schema_version/{configVersionHash}").
@@ -289,7 +308,7 @@ func (r *ConfigSchemaRoute) Prefixed(ws *restful.WebService, prefix string) {
 		}).
 		Doc("Get a config schema for a specific version hash").
 		Operation("getSchema").
-		Param(ws.PathParameter("configVersionHash", "identifier of the schema (the ConfigVersionHash of the record node)").DataType("string")).
+		Param(ws.PathParameter("configVersionHash", "identifier of the schema (the ConfigVersionHash of the record node, or a tag name)").DataType("string")).
 		Writes(config.ConfigSchemaRecord{}))
 
 }
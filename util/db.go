@@ -18,6 +18,12 @@ func WithTransaction(db *gorm.DB, tx *gorm.DB, fn func(tx *gorm.DB) error) error
 	}
 }
 
+// Upsert updates the row matching attrs with assign, or creates it from both, and loads
+// it into dest. assign is a map since a struct would skip the zero values.
+func Upsert(tx *gorm.DB, attrs interface{}, assign map[string]interface{}, dest interface{}) error {
+	return tx.Where(attrs).Attrs(attrs).Assign(assign).FirstOrCreate(dest).Error
+}
+
 var sqlParamRegex = regexp.MustCompile(`(\$[0-9]|\?)`)
 
 func FormatDebugQuery(query string, args ...interface{}) string {
@@ -84,6 +90,11 @@ func ScanSingleValueInto(rs *gorm.DB, dest interface{}) error {
 	defer rows.Close()
 
 	if !rows.Next() {
+		// Errors raised while executing the query are reported here
+		if err := rows.Err(); err != nil {
+			logger.Printf("util.ScanValueInto: rows.Err(): %v", err)
+			return err
+		}
 		logger.Printf("util.ScanValueInto: unable to get next row\n")
 		return gorm.ErrRecordNotFound
 	}
@@ -117,7 +128,7 @@ func RawGetJsonValue(ctx context.Context, db *gorm.DB, tx *gorm.DB, dest interfa
 
 	return WithTransaction(db, tx, func(tx *gorm.DB) error {
 
-		rs := db.Raw(query, args...)
+		rs := tx.Raw(query, args...)
 		if rs.Error != nil {
 			logger.Printf("util.RawGetJsonValue: rs.Error: %v", rs.Error)
 			return rs.Error
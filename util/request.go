@@ -165,8 +165,17 @@ func GetRequestCheckoutTokenIdPathParam(req *restful.Request) *CheckoutTokenId {
 
 // Returns the scope determined by whether account_id and user_id are path parameters. Always returns both
 // account_id and user_id, even if they are not path parameters. Returns ScopeKindInvaild in
-// other cases.
+// other cases. Requests to the global routes (marked with the globalScope attribute) return
+// ScopeKindGlobal with GlobalScopeAccountId and the requesting user.
 func GetRequestScopeAndIds(request *restful.Request) (ScopeKind, AccountId, UserId) {
+	if RequestBoolAttribute(request, "globalScope") {
+		userId := GetRequestUserIdAttribute(request)
+		if userId == nil {
+			return ScopeKindInvalid, "", ""
+		}
+		return ScopeKindGlobal, GlobalScopeAccountId, *userId
+	}
+
 	accountId := GetValidatedRequestAccountId(request)
 	if accountId == nil {
 		return ScopeKindInvalid, "", ""
@@ -10,6 +10,9 @@ const (
 	ScopeKindUser    ScopeKind = "user"
 )
 
+// The global repository is stored under the platform account, without a user
+const GlobalScopeAccountId AccountId = ROOT_ACCOUNT_ID
+
 func ScopeKindPtr(s string) *ScopeKind {
 	v := ScopeKind(s)
 	return &v